@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/masterzen/winrm"
+	"github.com/masterzen/winrm/soap"
+	"io"
+	"k8s.io/klog/v2"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// WinRM authentication modes, selected with WINRM_AUTH
+const (
+	winrmAuthNtlm        = "ntlm"
+	winrmAuthKerberos    = "kerberos"
+	winrmAuthCertificate = "certificate"
+	winrmAuthBasic       = "basic"
+)
+
+const defaultKrb5Config = "/etc/krb5.conf"
+
+// winrmTransport returns the transport for the auth mode in WINRM_AUTH, NTLM by default. NTLM over http seals
+// every message. Client certificate auth adds the certificate to endpoint.
+func winrmTransport(endpoint *winrm.Endpoint, user string, password string) (func() winrm.Transporter, error) {
+	switch mode := strings.ToLower(os.Getenv("WINRM_AUTH")); mode {
+	case "", winrmAuthNtlm:
+		if !endpoint.HTTPS {
+			transport := newEncryptedTransport(user, password)
+			return func() winrm.Transporter { return transport }, nil
+		}
+		return func() winrm.Transporter { return &winrm.ClientNTLM{} }, nil
+	case winrmAuthBasic:
+		if !endpoint.HTTPS {
+			klog.Warning("basic auth over http sends the winrm password in the clear")
+		}
+		// masterzen/winrm's default transport sends basic auth
+		return nil, nil
+	case winrmAuthCertificate:
+		if !endpoint.HTTPS {
+			return nil, errors.New("client certificate auth requires an https WINRM_HOST")
+		}
+		cert, err := os.ReadFile(os.Getenv("WINRM_CLIENT_CERT_FILE"))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read WINRM_CLIENT_CERT_FILE: %w", err)
+		}
+		key, err := os.ReadFile(os.Getenv("WINRM_CLIENT_KEY_FILE"))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read WINRM_CLIENT_KEY_FILE: %w", err)
+		}
+		endpoint.Cert, endpoint.Key = cert, key
+		return func() winrm.Transporter { return &winrm.ClientAuthRequest{} }, nil
+	case winrmAuthKerberos:
+		// Only NTLM seals messages over http. Kerberos message encryption (GSS_Wrap) isn't implemented, so
+		// Kerberos would have to send them in the clear.
+		if !endpoint.HTTPS {
+			return nil, errors.New("kerberos auth requires an https WINRM_HOST, use ntlm for http")
+		}
+		transport, err := newKerberosTransport(endpoint.Host, user, password)
+		if err != nil {
+			return nil, err
+		}
+		return func() winrm.Transporter { return transport }, nil
+	default:
+		return nil, fmt.Errorf("unknown WINRM_AUTH %q, expected ntlm, kerberos, certificate or basic", mode)
+	}
+}
+
+// kerberosTransport authenticates every request with a ticket for the host's HTTP service principal
+type kerberosTransport struct {
+	client *client.Client
+	spn    string
+	url    string
+	http   *http.Client
+}
+
+// kerberosSPN returns the service principal WinRM registers for host. The service class is HTTP for both
+// http and https unless WINRM_SPN_SERVICE overrides it, e.g. with WSMAN.
+func kerberosSPN(host string) string {
+	service := os.Getenv("WINRM_SPN_SERVICE")
+	if service == "" {
+		service = "HTTP"
+	}
+	return service + "/" + host
+}
+
+// newKerberosTransport logs in with the keytab in WINRM_KRB5_KEYTAB, or the password. user can include the
+// realm, e.g. csi@EXAMPLE.COM, otherwise it's WINRM_KRB5_REALM or krb5.conf's default realm.
+func newKerberosTransport(host string, user string, password string) (*kerberosTransport, error) {
+	configPath := os.Getenv("KRB5_CONFIG")
+	if configPath == "" {
+		configPath = defaultKrb5Config
+	}
+	krb5Config, err := config.Load(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load krb5 config %s: %w", configPath, err)
+	}
+
+	user, realm, found := strings.Cut(user, "@")
+	if !found {
+		realm = os.Getenv("WINRM_KRB5_REALM")
+	}
+	if realm == "" {
+		realm = krb5Config.LibDefaults.DefaultRealm
+	}
+	if user == "" || realm == "" {
+		return nil, errors.New("kerberos auth needs WINRM_USER and a realm")
+	}
+
+	var krbClient *client.Client
+	if keytabPath := os.Getenv("WINRM_KRB5_KEYTAB"); keytabPath != "" {
+		kt, err := keytab.Load(keytabPath)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load WINRM_KRB5_KEYTAB: %w", err)
+		}
+		krbClient = client.NewWithKeytab(user, realm, kt, krb5Config, client.DisablePAFXFAST(true))
+	} else {
+		if password == "" {
+			return nil, errors.New("kerberos auth needs WINRM_KRB5_KEYTAB or WINRM_PASSWORD")
+		}
+		krbClient = client.NewWithPassword(user, realm, password, krb5Config, client.DisablePAFXFAST(true))
+	}
+	return &kerberosTransport{client: krbClient, spn: kerberosSPN(host)}, nil
+}
+
+func (t *kerberosTransport) Transport(endpoint *winrm.Endpoint) error {
+	tlsConfig := &tls.Config{ServerName: endpoint.TLSServerName, InsecureSkipVerify: endpoint.Insecure}
+	if len(endpoint.CACert) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(endpoint.CACert) {
+			return errors.New("unable to read certificates")
+		}
+	}
+	t.http = &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       tlsConfig,
+		ResponseHeaderTimeout: endpoint.Timeout,
+	}}
+
+	t.url = fmt.Sprintf("https://%s:%d/wsman", endpoint.Host, endpoint.Port)
+	return nil
+}
+
+// Post sends a request, errors are worded like masterzen/winrm's so callers can classify them the same way
+func (t *kerberosTransport) Post(_ *winrm.Client, request *soap.SoapMessage) (string, error) {
+	httpRequest, err := http.NewRequest("POST", t.url, strings.NewReader(request.String()))
+	if err != nil {
+		return "", fmt.Errorf("impossible to create http request %w", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	if err = spnego.SetSPNEGOHeader(t.client, httpRequest, t.spn); err != nil {
+		return "", fmt.Errorf("couldn't get kerberos ticket for %s: %w", t.spn, err)
+	}
+
+	response, err := t.http.Do(httpRequest)
+	if err != nil {
+		return "", fmt.Errorf("unknown error %w", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("error while reading request body %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("http error %d: %s", response.StatusCode, body)
+	}
+	return string(body), nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWinrmClientBasicAuth(t *testing.T) {
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	caFile := server.caFile(t)
+	t.Setenv("WINRM_AUTH", "Basic")
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	client, err := newWinrmClient(server.URL, &caFile)
+	require.NoError(t, err)
+
+	assert.NoError(t, checkWinrmClient(context.Background(), client))
+	assert.Equal(t, []string{"Create", "Command", "Receive", "Signal", "Delete"}, server.Actions())
+}
+
+func TestWinrmClientCertificateAuth(t *testing.T) {
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	caFile := server.caFile(t)
+	certFile, keyFile := server.clientCertificate(t, testWinrmUser)
+	t.Setenv("WINRM_AUTH", winrmAuthCertificate)
+	t.Setenv("WINRM_CLIENT_CERT_FILE", certFile)
+	t.Setenv("WINRM_CLIENT_KEY_FILE", keyFile)
+
+	client, err := newWinrmClient(server.URL, &caFile)
+	require.NoError(t, err)
+	assert.NoError(t, checkWinrmClient(context.Background(), client))
+
+	// A certificate mapped to someone else is rejected
+	certFile, keyFile = server.clientCertificate(t, "someone")
+	t.Setenv("WINRM_CLIENT_CERT_FILE", certFile)
+	t.Setenv("WINRM_CLIENT_KEY_FILE", keyFile)
+	client, err = newWinrmClient(server.URL, &caFile)
+	require.NoError(t, err)
+	assert.ErrorContains(t, checkWinrmClient(context.Background(), client), "401")
+}
+
+func TestWinrmClientCertificateAuthRequiresHttps(t *testing.T) {
+	t.Setenv("WINRM_AUTH", winrmAuthCertificate)
+
+	_, err := newWinrmClient("http://hyperv01:5985", nil)
+	assert.ErrorContains(t, err, "requires an https WINRM_HOST")
+
+	t.Setenv("WINRM_CLIENT_CERT_FILE", filepath.Join(t.TempDir(), "missing.crt"))
+	_, err = newWinrmClient("https://hyperv01:5986", nil)
+	assert.ErrorContains(t, err, "WINRM_CLIENT_CERT_FILE")
+}
+
+func TestWinrmClientUnknownAuth(t *testing.T) {
+	t.Setenv("WINRM_AUTH", "digest")
+
+	_, err := newWinrmClient("http://hyperv01:5985", nil)
+
+	assert.ErrorContains(t, err, `unknown WINRM_AUTH "digest"`)
+}
+
+func TestKerberosSPN(t *testing.T) {
+	assert.Equal(t, "HTTP/hyperv01.example.com", kerberosSPN("hyperv01.example.com"))
+
+	t.Setenv("WINRM_SPN_SERVICE", "WSMAN")
+	assert.Equal(t, "WSMAN/hyperv01.example.com", kerberosSPN("hyperv01.example.com"))
+}
+
+// writeKrb5Config writes a krb5.conf whose only KDC is kdc and sets KRB5_CONFIG to it
+func writeKrb5Config(t *testing.T, kdc string) {
+	krb5Config := fmt.Sprintf(`[libdefaults]
+  default_realm = EXAMPLE.COM
+  udp_preference_limit = 1
+
+[realms]
+  EXAMPLE.COM = {
+    kdc = %s
+  }
+`, kdc)
+	path := filepath.Join(t.TempDir(), "krb5.conf")
+	require.NoError(t, os.WriteFile(path, []byte(krb5Config), 0600))
+	t.Setenv("KRB5_CONFIG", path)
+}
+
+func TestWinrmClientKerberos(t *testing.T) {
+	// Nothing listens on the KDC port once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener.Close()
+	writeKrb5Config(t, listener.Addr().String())
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	caFile := server.caFile(t)
+	t.Setenv("WINRM_AUTH", winrmAuthKerberos)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	client, err := newWinrmClient(server.URL, &caFile)
+	require.NoError(t, err)
+
+	err = checkWinrmClient(context.Background(), client)
+	assert.ErrorContains(t, err, "couldn't get kerberos ticket for HTTP/127.0.0.1")
+	assert.Empty(t, server.Actions())
+}
+
+func TestWinrmClientKerberosRequiresHttps(t *testing.T) {
+	t.Setenv("WINRM_AUTH", winrmAuthKerberos)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	_, err := newWinrmClient("http://hyperv01:5985", nil)
+	assert.ErrorContains(t, err, "kerberos auth requires an https WINRM_HOST")
+}
+
+func TestKerberosTransportConfig(t *testing.T) {
+	writeKrb5Config(t, "127.0.0.1:88")
+
+	transport, err := newKerberosTransport("hyperv01", "csi@CORP.EXAMPLE.COM", testWinrmPassword)
+	require.NoError(t, err)
+	assert.Equal(t, "CORP.EXAMPLE.COM", transport.client.Credentials.Domain())
+	assert.Equal(t, "csi", transport.client.Credentials.UserName())
+
+	transport, err = newKerberosTransport("hyperv01", "csi", testWinrmPassword)
+	require.NoError(t, err)
+	assert.Equal(t, "EXAMPLE.COM", transport.client.Credentials.Domain())
+
+	_, err = newKerberosTransport("hyperv01", "csi", "")
+	assert.ErrorContains(t, err, "WINRM_KRB5_KEYTAB or WINRM_PASSWORD")
+
+	t.Setenv("WINRM_KRB5_KEYTAB", filepath.Join(t.TempDir(), "missing.keytab"))
+	_, err = newKerberosTransport("hyperv01", "csi", "")
+	assert.ErrorContains(t, err, "couldn't load WINRM_KRB5_KEYTAB")
+
+	t.Setenv("KRB5_CONFIG", filepath.Join(t.TempDir(), "missing.conf"))
+	_, err = newKerberosTransport("hyperv01", "csi", testWinrmPassword)
+	assert.ErrorContains(t, err, "couldn't load krb5 config")
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/nijave/hyperv-csi/pkg"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// validateConfig checks the config file, if there is one, together with the environment
+func validateConfig() error {
+	config := driverConfig{Version: configVersion}
+	if configFile != "" {
+		var err error
+		if config, err = loadConfig(configFile); err != nil {
+			return err
+		}
+	}
+	config.apply()
+	return config.validate(config.service(grpcService))
+}
+
+// commandFlags returns a command's flags with -o for its output format
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	output := flags.String("o", "table", "Output format, table or json")
+	return flags, output
+}
+
+// validOutput checks an -o output format
+func validOutput(output string) bool {
+	return output == "table" || output == "json"
+}
+
+// parseCommandFlags parses a command's flags, it's false for invalid flags, an unknown output format or the
+// wrong number of arguments
+func parseCommandFlags(flags *flag.FlagSet, output *string, args []string, arguments int) bool {
+	return flags.Parse(args) == nil && validOutput(*output) && flags.NArg() == arguments
+}
+
+// printOutput writes value as JSON, or as the table printTable writes
+func printOutput(w io.Writer, output string, value any, printTable func(table io.Writer)) {
+	if output == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(value)
+		return
+	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	printTable(table)
+	table.Flush()
+}
+
+// setupCommand loads the config for a command that talks to the host like the controller
+func setupCommand() bool {
+	if err := setupConfig("controller"); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// claimVolumePrefix is for commands that change the host. Like the controller they refuse to touch a volume prefix
+// another cluster claimed, commands that only read work on any prefix.
+func claimVolumePrefix(controller *pkg.HypervCsiController) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(driverSettings.Timeouts.Connect, defaultConnectTimeout))
+	defer cancel()
+	if err := controller.ClaimVolumePrefix(ctx); err != nil {
+		return fmt.Errorf("couldn't claim the volume prefix: %w", err)
+	}
+	return nil
+}
+
+// runCommand runs a one-off operator command against the Hyper-V host instead of serving gRPC
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate":
+		// The controller's volume and pool locks are per process and nothing on the host stops it from attaching,
+		// deleting or rewriting the pool index while a volume moves. A running controller migrates volumes through
+		// ControllerModifyVolume instead.
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: hyperv-csi migrate <volume id> <pool>, with the controller stopped")
+			return 2
+		}
+		if !setupCommand() {
+			return 1
+		}
+		controller := newHostController()
+		if err := claimVolumePrefix(controller); err != nil {
+			fmt.Fprintf(os.Stderr, "migration failed: %v\n", err)
+			return 1
+		}
+		if err := controller.MigrateVolume(context.Background(), args[1], args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "migration failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("volume %s migrated to pool %s\n", args[1], args[2])
+		return 0
+	case "reconcile":
+		flags, output := commandFlags("reconcile")
+		cleanup := flags.Bool("cleanup", false, "Delete orphaned and temp volumes and detach stale attachments past the grace period")
+		gracePeriod := flags.Duration("grace-period", 0, "How long a finding is left alone before cleanup (default reconcile.gracePeriod or 24h)")
+		if !parseCommandFlags(flags, output, args[1:], 0) {
+			fmt.Fprintln(os.Stderr, "usage: hyperv-csi reconcile [-o table|json] [-cleanup] [-grace-period <duration>]")
+			return 2
+		}
+		if !setupCommand() {
+			return 1
+		}
+		if *gracePeriod == 0 {
+			*gracePeriod = timeout(driverSettings.Reconcile.GracePeriod, defaultReconcileGracePeriod)
+		}
+		controller := newHostController()
+		if *cleanup {
+			if err := claimVolumePrefix(controller); err != nil {
+				fmt.Fprintf(os.Stderr, "reconcile failed: %v\n", err)
+				return 1
+			}
+		}
+		reconciler, err := newReconciler(controller, *cleanup, *gracePeriod)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reconcile failed: %v\n", err)
+			return 1
+		}
+		findings, err := reconciler.Run(context.Background())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reconcile failed: %v\n", err)
+			return 1
+		}
+		printFindings(os.Stdout, *output, findings)
+		return 0
+	case "trash":
+		return runTrashCommand(args[1:])
+	case "volumes":
+		return runVolumesCommand(args[1:])
+	case "chain":
+		return runChainCommand(args[1:])
+	case "attach", "detach":
+		return runAttachCommand(args[0], args[1:])
+	case "exec":
+		return runExecCommand(args[1:])
+	case "config":
+		if len(args) < 2 || len(args) > 3 || args[1] != "validate" {
+			fmt.Fprintln(os.Stderr, "usage: hyperv-csi [--config <file>] config validate [<file>]")
+			return 2
+		}
+		if len(args) == 3 {
+			configFile = args[2]
+		}
+		if err := validateConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+			return 1
+		}
+		fmt.Println("config is valid")
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+}
+
+// printFindings writes reconcile findings
+func printFindings(w io.Writer, output string, findings []pkg.ReconcileFinding) {
+	printOutput(w, output, findings, func(table io.Writer) {
+		fmt.Fprintln(table, "KIND\tVOLUME\tVM\tFIRST SEEN\tACTION")
+		for _, finding := range findings {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", finding.Kind, finding.VolumeId, finding.VMName,
+				finding.FirstSeen.Format(time.RFC3339), finding.Action)
+		}
+	})
+}
+
+// runTrashCommand lists, restores or purges soft deleted volumes
+func runTrashCommand(args []string) int {
+	flags, output := commandFlags("trash")
+	valid := flags.Parse(args) == nil && validOutput(*output)
+	args = flags.Args()
+	valid = valid && (len(args) == 1 && args[0] == "list" || len(args) == 2 && (args[0] == "restore" || args[0] == "purge"))
+	if !valid {
+		fmt.Fprintln(os.Stderr, "usage: hyperv-csi trash [-o table|json] list | restore <volume id> | purge <volume id>")
+		return 2
+	}
+	if !setupCommand() {
+		return 1
+	}
+	ctx := context.Background()
+	controller := newHostController()
+	if args[0] != "list" {
+		if err := claimVolumePrefix(controller); err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed: %v\n", args[0], err)
+			return 1
+		}
+	}
+	switch args[0] {
+	case "list":
+		trashed, err := controller.ListTrash(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't list trash: %v\n", err)
+			return 1
+		}
+		printOutput(os.Stdout, *output, trashed, func(table io.Writer) {
+			fmt.Fprintln(table, "VOLUME\tPOOL\tDELETED\tPVC")
+			for _, volume := range trashed {
+				fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", volume.VolumeId, volume.Pool, volume.DeletedAt.Format(time.RFC3339),
+					claimName(volume.PVCNamespace, volume.PVCName))
+			}
+		})
+	case "restore":
+		if err := controller.RestoreVolume(ctx, args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "restore failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("volume %s restored\n", args[1])
+	case "purge":
+		if err := controller.PurgeVolume(ctx, args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "purge failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("volume %s purged\n", args[1])
+	}
+	return 0
+}
+
+// claimName is namespace/name, or empty for volumes created without --extra-create-metadata
+func claimName(namespace string, name string) string {
+	if name == "" {
+		return ""
+	}
+	return namespace + "/" + name
+}
+
+// runVolumesCommand lists volumes or inspects one
+func runVolumesCommand(args []string) int {
+	flags, output := commandFlags("volumes")
+	valid := flags.Parse(args) == nil && validOutput(*output)
+	args = flags.Args()
+	valid = valid && (len(args) == 1 && args[0] == "list" || len(args) == 2 && args[0] == "inspect")
+	if !valid {
+		fmt.Fprintln(os.Stderr, "usage: hyperv-csi volumes [-o table|json] list | inspect <volume id>")
+		return 2
+	}
+	if !setupCommand() {
+		return 1
+	}
+	ctx := context.Background()
+	controller := newHostController()
+	if args[0] == "list" {
+		volumes, err := controller.ListVolumeInfo(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't list volumes: %v\n", err)
+			return 1
+		}
+		printOutput(os.Stdout, *output, volumes, func(table io.Writer) {
+			fmt.Fprintln(table, "VOLUME\tPOOL\tSIZE\tPVC\tVMS")
+			for _, volume := range volumes {
+				fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\n", volume.VolumeId, volume.Pool, volume.CapacityBytes,
+					claimName(volume.PVCNamespace, volume.PVCName), strings.Join(volume.VMs, ","))
+			}
+		})
+		return 0
+	}
+
+	volume, err := controller.InspectVolume(ctx, args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't inspect volume: %v\n", err)
+		return 1
+	}
+	printOutput(os.Stdout, *output, volume, func(table io.Writer) {
+		fields := [][2]string{
+			{"Volume", volume.VolumeId},
+			{"Pool", volume.Pool},
+			{"Path", volume.Path},
+			{"Size", fmt.Sprint(volume.CapacityBytes)},
+			{"Cluster", volume.ClusterId},
+			{"PVC", claimName(volume.PVCNamespace, volume.PVCName)},
+			{"PV", volume.PVName},
+			{"VMs", strings.Join(volume.VMs, ",")},
+		}
+		if volume.QoS != nil {
+			fields = append(fields, [2]string{"QoS", fmt.Sprintf("min %d max %d IOPS %s", volume.QoS.MinimumIOPS, volume.QoS.MaximumIOPS, volume.QoS.PolicyId)})
+		}
+		for _, field := range fields {
+			fmt.Fprintf(table, "%s:\t%s\n", field[0], field[1])
+		}
+		for i, vhd := range volume.Chain {
+			fmt.Fprintf(table, "Chain %d:\t%s\n", i, vhd.Path)
+		}
+	})
+	return 0
+}
+
+// runChainCommand shows the VHD chain ControllerPublishVolume walks for a volume
+func runChainCommand(args []string) int {
+	flags, output := commandFlags("chain")
+	if !parseCommandFlags(flags, output, args, 1) {
+		fmt.Fprintln(os.Stderr, "usage: hyperv-csi chain [-o table|json] <volume id>")
+		return 2
+	}
+	if !setupCommand() {
+		return 1
+	}
+	chain, err := newHostController().VolumeChain(context.Background(), flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't get chain: %v\n", err)
+		return 1
+	}
+	printOutput(os.Stdout, *output, chain, func(table io.Writer) {
+		fmt.Fprintln(table, "#\tPATH\tPARENT\tDISK ID\tSIZE")
+		for i, vhd := range chain {
+			fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%d\n", i, vhd.Path, vhd.ParentPath, vhd.DiskIdentifier, vhd.Size)
+		}
+	})
+	return 0
+}
+
+// runAttachCommand attaches a volume to a VM or detaches it like ControllerPublishVolume and ControllerUnpublishVolume
+func runAttachCommand(command string, args []string) int {
+	flags, output := commandFlags(command)
+	// Like migrate, these bypass the controller's per process volume locks
+	readOnly, usage := new(bool), "usage: hyperv-csi detach [-o table|json] <volume id> <vm>, with the controller stopped"
+	if command == "attach" {
+		readOnly = flags.Bool("read-only", false, "Attach a per-VM differencing child like a read-only-many volume")
+		usage = "usage: hyperv-csi attach [-o table|json] [-read-only] <volume id> <vm>, with the controller stopped"
+	}
+	if !parseCommandFlags(flags, output, args, 2) {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if !setupCommand() {
+		return 1
+	}
+	ctx := context.Background()
+	controller := newHostController()
+	if err := claimVolumePrefix(controller); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", command, err)
+		return 1
+	}
+	volumeId, vmName := flags.Arg(0), flags.Arg(1)
+
+	if command == "detach" {
+		_, err := controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeId, NodeId: vmName})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "detach failed: %v\n", err)
+			return 1
+		}
+		result := map[string]string{"volumeId": volumeId, "vm": vmName}
+		printOutput(os.Stdout, *output, result, func(table io.Writer) {
+			fmt.Fprintf(table, "volume %s detached from %s\n", volumeId, vmName)
+		})
+		return 0
+	}
+
+	mode := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	if *readOnly {
+		mode = csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	}
+	response, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: volumeId,
+		NodeId:   vmName,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "attach failed: %v\n", err)
+		return 1
+	}
+	result := map[string]any{"volumeId": volumeId, "vm": vmName, "publishContext": response.PublishContext}
+	printOutput(os.Stdout, *output, result, func(table io.Writer) {
+		fmt.Fprintf(table, "volume %s attached to %s\n", volumeId, vmName)
+		keys := make([]string, 0, len(response.PublishContext))
+		for key := range response.PublishContext {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(table, "%s:\t%s\n", key, response.PublishContext[key])
+		}
+	})
+	return 0
+}
+
+// execResult is exec's JSON output
+type execResult struct {
+	ExitCode int    `json:"exitCode"`
+	Output   string `json:"output"`
+	Error    string `json:"error,omitempty"`
+}
+
+// runExecCommand runs raw PowerShell on the host the way the controller runs its own commands
+func runExecCommand(args []string) int {
+	flags, output := commandFlags("exec")
+	if flags.Parse(args) != nil || !validOutput(*output) || flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: hyperv-csi exec [-o table|json] <powershell>")
+		return 2
+	}
+	if !setupCommand() {
+		return 1
+	}
+	result, err := newHostController().RunPowerShell(context.Background(), strings.Join(flags.Args(), " "))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "exec failed: %v\n", err)
+		return 1
+	}
+	if *output == "json" {
+		printed := execResult{ExitCode: result.ExitCode, Output: result.Output}
+		if result.Error != nil {
+			printed.Error = result.Error.Error()
+		}
+		printOutput(os.Stdout, *output, printed, nil)
+	} else {
+		if result.Output != "" {
+			fmt.Println(result.Output)
+		}
+		if result.Error != nil {
+			fmt.Fprintf(os.Stderr, "exec failed: %v\n", result.Error)
+		}
+	}
+
+	// Exit codes outside what a process can return are failures too
+	if result.Error != nil || result.ExitCode < 0 || result.ExitCode > 255 {
+		return 1
+	}
+	return result.ExitCode
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/nijave/hyperv-csi/pkg"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrintOutput(t *testing.T) {
+	volumes := []pkg.VolumeInfo{{VolumeId: "data-1", Pool: "default", CapacityBytes: 1024, VMs: []string{"kube01"}}}
+	printTable := func(table io.Writer) {
+		fmt.Fprintln(table, "VOLUME\tPOOL")
+		for _, volume := range volumes {
+			fmt.Fprintf(table, "%s\t%s\n", volume.VolumeId, volume.Pool)
+		}
+	}
+
+	var output bytes.Buffer
+	printOutput(&output, "table", volumes, printTable)
+	assert.Equal(t, "VOLUME  POOL\ndata-1  default\n", output.String())
+
+	output.Reset()
+	printOutput(&output, "json", volumes, printTable)
+	assert.JSONEq(t, `[{"volumeId": "data-1", "pool": "default", "path": "", "capacityBytes": 1024, "vms": ["kube01"]}]`, output.String())
+}
+
+func TestPrintFindings(t *testing.T) {
+	firstSeen := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	findings := []pkg.ReconcileFinding{{Kind: "stale-attachment", VolumeId: "data-1", VMName: "kube01", FirstSeen: firstSeen, Action: "detached"}}
+
+	var output bytes.Buffer
+	printFindings(&output, "table", findings)
+
+	assert.Equal(t, "KIND              VOLUME  VM      FIRST SEEN            ACTION\n"+
+		"stale-attachment  data-1  kube01  2024-01-01T00:00:00Z  detached\n", output.String())
+}
+
+func TestOperatorCommandUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"volumes"},
+		{"volumes", "inspect"},
+		{"volumes", "-o", "yaml", "list"},
+		{"volumes", "delete", "data-1"},
+		{"chain"},
+		{"chain", "data-1", "data-2"},
+		{"attach", "data-1"},
+		{"detach", "-read-only", "data-1", "kube01"},
+		{"exec"},
+		{"exec", "-o", "xml", "Get-VM"},
+		{"trash", "-o", "yaml", "list"},
+		{"reconcile", "-o", "csv"},
+	} {
+		assert.Equal(t, 2, runCommand(args), args)
+	}
+}
+
+func TestOnlyChangingCommandsClaimVolumePrefix(t *testing.T) {
+	var lock sync.Mutex
+	commands := make([]string, 0)
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, func(ctx context.Context, command string) (int, string, string) {
+		lock.Lock()
+		defer lock.Unlock()
+		commands = append(commands, command)
+		if strings.Contains(command, "Get-Content") && strings.Contains(command, "pv-owner.json") {
+			return 0, `{"clusterId": "prod"}`, ""
+		}
+		return echoHandler(ctx, command)
+	})
+	caFile := server.caFile(t)
+	t.Setenv("WINRM_HOST", server.URL)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+	t.Setenv("WINRM_CA_FILE_PATH", caFile)
+	t.Setenv("KUBE_CLUSTER_ID", "staging")
+
+	// Commands that only read don't look at the owner, let alone write it
+	controller := newHostController()
+	lock.Lock()
+	for _, command := range commands {
+		assert.NotContains(t, command, "pv-owner.json")
+	}
+	lock.Unlock()
+
+	// Another cluster's prefix is left alone by commands that change the host
+	err := claimVolumePrefix(controller)
+	assert.ErrorIs(t, err, pkg.ErrVolumePrefixOwned)
+	lock.Lock()
+	defer lock.Unlock()
+	for _, command := range commands {
+		assert.NotContains(t, command, "Set-Content")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/nijave/hyperv-csi/pkg"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// configVersion is the only config file schema so far
+const configVersion = 1
+
+const (
+	defaultConnectTimeout   = 5 * time.Second
+	defaultDiscoveryTimeout = 30 * time.Second
+	// defaultReconcileGracePeriod is how long cleanup leaves a finding alone, long enough for a slow CreateVolume
+	defaultReconcileGracePeriod = 24 * time.Hour
+	// hypervScsiSlots is how many disks a VM's SCSI controller takes
+	hypervScsiSlots = 64
+)
+
+// driverConfig is the file given with --config, YAML or JSON. Settings that also have an environment variable
+// only fill it in when it isn't set, so the environment overrides the file.
+type driverConfig struct {
+	Version int `yaml:"version"`
+	// Service is -grpc-service, the flag overrides it
+	Service string `yaml:"service"`
+	// CSIAddress is CSI_ADDRESS
+	CSIAddress string `yaml:"csiAddress"`
+	// MetricsAddress is METRICS_ADDRESS, empty turns the metrics server off
+	MetricsAddress *string `yaml:"metricsAddress"`
+	// ClusterID is KUBE_CLUSTER_ID, it tells apart the Kubernetes clusters sharing a host
+	ClusterID string `yaml:"clusterId"`
+
+	Host      hostConfig      `yaml:"host"`
+	Cluster   clusterConfig   `yaml:"cluster"`
+	Volumes   volumesConfig   `yaml:"volumes"`
+	Node      nodeConfig      `yaml:"node"`
+	Timeouts  timeoutsConfig  `yaml:"timeouts"`
+	Reconcile reconcileConfig `yaml:"reconcile"`
+}
+
+type hostConfig struct {
+	// URL is WINRM_HOST
+	URL string `yaml:"url"`
+	// CAFile is WINRM_CA_FILE_PATH
+	CAFile string     `yaml:"caFile"`
+	Auth   authConfig `yaml:"auth"`
+}
+
+// authConfig has no password, it only comes from WINRM_PASSWORD or passwordFile so it stays out of the file
+type authConfig struct {
+	// Mode is ntlm, kerberos, certificate or basic. Over http only ntlm encrypts messages.
+	Mode           string `yaml:"mode"`
+	User           string `yaml:"user"`
+	UserFile       string `yaml:"userFile"`
+	PasswordFile   string `yaml:"passwordFile"`
+	ClientCertFile string `yaml:"clientCertFile"`
+	ClientKeyFile  string `yaml:"clientKeyFile"`
+	Krb5Config     string `yaml:"krb5Config"`
+	Keytab         string `yaml:"keytab"`
+	Realm          string `yaml:"realm"`
+	SPNService     string `yaml:"spnService"`
+	SSHKeyFile     string `yaml:"sshKeyFile"`
+	SSHKnownHosts  string `yaml:"sshKnownHosts"`
+}
+
+type clusterConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Name is the node's topology, it has to match (Get-Cluster).Name ignoring case
+	Name string `yaml:"name"`
+}
+
+type volumesConfig struct {
+	Path  string            `yaml:"path"`
+	Pools map[string]string `yaml:"pools"`
+	// Prefix starts every volume's file name
+	Prefix string `yaml:"prefix"`
+	// DefaultCapacity is a size like 20Gi
+	DefaultCapacity   string `yaml:"defaultCapacity"`
+	DefaultFilesystem string `yaml:"defaultFilesystem"`
+	// NameTemplate puts a readable name in front of new volume IDs, e.g. {{.PVCNamespace}}-{{.PVCName}}
+	NameTemplate string `yaml:"nameTemplate"`
+	// SoftDelete moves deleted volumes to a trash directory in their pool, see the trash command
+	SoftDelete bool `yaml:"softDelete"`
+	// TrashRetention is how long deleted volumes stay in the trash, until they're purged by hand when it isn't set
+	TrashRetention time.Duration `yaml:"trashRetention"`
+}
+
+type nodeConfig struct {
+	// ID is KUBE_NODE_NAME
+	ID string `yaml:"id"`
+	// ReservedScsiSlots are kept for the VM's own disks
+	ReservedScsiSlots *int `yaml:"reservedScsiSlots"`
+}
+
+type timeoutsConfig struct {
+	// Connect bounds the startup check of the host
+	Connect time.Duration `yaml:"connect"`
+	// Operation bounds each request to the host, WinRM polls for a long command's output so the command itself
+	// can take longer. Over ssh it bounds connecting.
+	Operation time.Duration `yaml:"operation"`
+	// Discovery bounds failover cluster discovery at startup
+	Discovery time.Duration `yaml:"discovery"`
+}
+
+type reconcileConfig struct {
+	// Interval runs the reconciler in the controller, it's off when it isn't set
+	Interval time.Duration `yaml:"interval"`
+	// Cleanup removes what the reconciler finds once it's been found for GracePeriod, 24h when it isn't set
+	Cleanup     bool          `yaml:"cleanup"`
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+}
+
+// configFile is the file given with --config
+var configFile string
+
+// driverSettings is the loaded --config file, it's empty without one
+var driverSettings driverConfig
+
+// setupConfig loads configFile into driverSettings and fills in the environment from it
+func setupConfig(service string) error {
+	if configFile == "" {
+		return nil
+	}
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	config.apply()
+	driverSettings = config
+	return config.validate(config.service(service))
+}
+
+// loadConfig reads a config file, JSON is read as YAML. Unknown settings are errors so typos don't go unnoticed.
+func loadConfig(path string) (driverConfig, error) {
+	var config driverConfig
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("couldn't read config: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("couldn't parse config %s: %w", path, err)
+	}
+	if config.Version != configVersion {
+		return config, fmt.Errorf("config %s: unsupported version %d, expected %d", path, config.Version, configVersion)
+	}
+	return config, nil
+}
+
+// environment maps the file's settings to the environment variables they stand in for
+func (c driverConfig) environment() map[string]string {
+	env := map[string]string{
+		"CSI_ADDRESS":            c.CSIAddress,
+		"KUBE_CLUSTER_ID":        c.ClusterID,
+		"WINRM_HOST":             c.Host.URL,
+		"WINRM_CA_FILE_PATH":     c.Host.CAFile,
+		"WINRM_AUTH":             c.Host.Auth.Mode,
+		"WINRM_USER":             c.Host.Auth.User,
+		"WINRM_USER_FILE":        c.Host.Auth.UserFile,
+		"WINRM_PASSWORD_FILE":    c.Host.Auth.PasswordFile,
+		"WINRM_CLIENT_CERT_FILE": c.Host.Auth.ClientCertFile,
+		"WINRM_CLIENT_KEY_FILE":  c.Host.Auth.ClientKeyFile,
+		"KRB5_CONFIG":            c.Host.Auth.Krb5Config,
+		"WINRM_KRB5_KEYTAB":      c.Host.Auth.Keytab,
+		"WINRM_KRB5_REALM":       c.Host.Auth.Realm,
+		"WINRM_SPN_SERVICE":      c.Host.Auth.SPNService,
+		"WINRM_SSH_KEY_FILE":     c.Host.Auth.SSHKeyFile,
+		"WINRM_SSH_KNOWN_HOSTS":  c.Host.Auth.SSHKnownHosts,
+		"HV_CLUSTER_NAME":        c.Cluster.Name,
+		"HV_VOLUME_PATH":         c.Volumes.Path,
+		"KUBE_NODE_NAME":         c.Node.ID,
+	}
+	if c.Cluster.Enabled {
+		env["HV_CLUSTER"] = "true"
+	}
+	if len(c.Volumes.Pools) > 0 {
+		pools := make([]string, 0, len(c.Volumes.Pools))
+		for name, path := range c.Volumes.Pools {
+			pools = append(pools, name+"="+path)
+		}
+		sort.Strings(pools)
+		env["HV_VOLUME_POOLS"] = strings.Join(pools, ",")
+	}
+	return env
+}
+
+// service returns the gRPC service to run, -grpc-service overrides the file
+func (c driverConfig) service(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if c.Service != "" {
+		return c.Service
+	}
+	return "controller"
+}
+
+// defaultCapacity is volumes.defaultCapacity in bytes, zero when it isn't set
+func (c driverConfig) defaultCapacity() int64 {
+	capacity, _ := parseCapacity(c.Volumes.DefaultCapacity)
+	return capacity
+}
+
+// nameTemplate is volumes.nameTemplate parsed, nil when it isn't set
+func (c driverConfig) nameTemplate() *template.Template {
+	if c.Volumes.NameTemplate == "" {
+		return nil
+	}
+	nameTemplate, _ := pkg.ParseVolumeNameTemplate(c.Volumes.NameTemplate)
+	return nameTemplate
+}
+
+// maxVolumes is how many volumes fit in the SCSI slots that aren't reserved, zero when no reservation is set
+func (c driverConfig) maxVolumes() int64 {
+	if c.Node.ReservedScsiSlots == nil {
+		return 0
+	}
+	return int64(hypervScsiSlots - *c.Node.ReservedScsiSlots)
+}
+
+// apply sets the environment variables the file has a value for, unless they're already set
+func (c driverConfig) apply() {
+	for name, value := range c.environment() {
+		if _, set := os.LookupEnv(name); value != "" && !set {
+			os.Setenv(name, value)
+		}
+	}
+	if _, set := os.LookupEnv("METRICS_ADDRESS"); c.MetricsAddress != nil && !set {
+		os.Setenv("METRICS_ADDRESS", *c.MetricsAddress)
+	}
+}
+
+// validate checks the file's settings along with the environment variables that override them
+func (c driverConfig) validate(service string) error {
+	failures := make([]error, 0)
+	fail := func(format string, args ...any) {
+		failures = append(failures, fmt.Errorf(format, args...))
+	}
+
+	if service != "controller" && service != "driver" {
+		fail("service: unknown service %q, expected controller or driver", service)
+	}
+	if service == "controller" {
+		host := os.Getenv("WINRM_HOST")
+		if parsed, err := url.Parse(host); host == "" {
+			fail("host.url (WINRM_HOST): the controller needs a host")
+		} else if err != nil {
+			fail("host.url (WINRM_HOST): %v", err)
+		} else if parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != "ssh" {
+			fail("host.url (WINRM_HOST): unsupported scheme %q, expected http, https or ssh", parsed.Scheme)
+		} else if parsed.Hostname() == "" {
+			fail("host.url (WINRM_HOST): %q has no host name", host)
+		} else if parsed.Scheme == "http" && strings.EqualFold(os.Getenv("WINRM_AUTH"), winrmAuthKerberos) {
+			// Only NTLM seals messages over http, Kerberos message encryption isn't implemented
+			fail("host.auth.mode (WINRM_AUTH): kerberos needs an https host.url, only ntlm encrypts messages over http")
+		}
+	}
+	switch mode := strings.ToLower(os.Getenv("WINRM_AUTH")); mode {
+	case "", winrmAuthNtlm, winrmAuthKerberos, winrmAuthCertificate, winrmAuthBasic:
+	default:
+		fail("host.auth.mode (WINRM_AUTH): unknown mode %q, expected ntlm, kerberos, certificate or basic", mode)
+	}
+	if cluster := os.Getenv("HV_CLUSTER"); cluster != "" {
+		if _, err := strconv.ParseBool(cluster); err != nil {
+			fail("cluster.enabled (HV_CLUSTER): %q isn't true or false", cluster)
+		}
+	}
+	for name, path := range c.Volumes.Pools {
+		if name == "" || strings.ContainsAny(name, "=,") || strings.Contains(path, ",") {
+			fail("volumes.pools: pool %q can't contain a comma or have = in its name", name)
+		}
+	}
+	if _, err := parsePools(os.Getenv("HV_VOLUME_POOLS")); err != nil {
+		fail("volumes.pools (HV_VOLUME_POOLS): %v", err)
+	}
+
+	if clusterId := os.Getenv("KUBE_CLUSTER_ID"); strings.TrimSpace(clusterId) != clusterId {
+		fail("clusterId (KUBE_CLUSTER_ID): %q has leading or trailing spaces", clusterId)
+	}
+	if strings.ContainsAny(c.Volumes.Prefix, `\/:*?"<>|`) {
+		fail("volumes.prefix: %q can't be part of a file name", c.Volumes.Prefix)
+	}
+	if c.Volumes.DefaultCapacity != "" {
+		if _, err := parseCapacity(c.Volumes.DefaultCapacity); err != nil {
+			fail("volumes.defaultCapacity: %v", err)
+		}
+	}
+	if c.Volumes.NameTemplate != "" {
+		if _, err := pkg.ParseVolumeNameTemplate(c.Volumes.NameTemplate); err != nil {
+			fail("volumes.nameTemplate: %v", err)
+		}
+	}
+	if c.Volumes.DefaultFilesystem != "" && !pkg.SupportedFilesystem(c.Volumes.DefaultFilesystem) {
+		fail("volumes.defaultFilesystem: unsupported filesystem %q", c.Volumes.DefaultFilesystem)
+	}
+	if reserved := c.Node.ReservedScsiSlots; reserved != nil && (*reserved < 0 || *reserved >= hypervScsiSlots) {
+		fail("node.reservedScsiSlots: %d isn't between 0 and %d", *reserved, hypervScsiSlots-1)
+	}
+	for i, timeout := range []time.Duration{c.Timeouts.Connect, c.Timeouts.Operation, c.Timeouts.Discovery} {
+		if timeout < 0 {
+			fail("timeouts.%s: %s is negative", []string{"connect", "operation", "discovery"}[i], timeout)
+		}
+	}
+	if c.Volumes.TrashRetention < 0 {
+		fail("volumes.trashRetention: %s is negative", c.Volumes.TrashRetention)
+	} else if c.Volumes.TrashRetention > 0 && !c.Volumes.SoftDelete {
+		fail("volumes.trashRetention: only applies with volumes.softDelete")
+	}
+	if c.Reconcile.Interval < 0 {
+		fail("reconcile.interval: %s is negative", c.Reconcile.Interval)
+	}
+	if c.Reconcile.GracePeriod < 0 {
+		fail("reconcile.gracePeriod: %s is negative", c.Reconcile.GracePeriod)
+	}
+	return errors.Join(failures...)
+}
+
+// parseCapacity reads a size in bytes with an optional Ki, Mi, Gi or Ti suffix, e.g. 20Gi
+func parseCapacity(value string) (int64, error) {
+	number, multiplier := value, int64(1)
+	for i, suffix := range []string{"Ki", "Mi", "Gi", "Ti"} {
+		if trimmed, found := strings.CutSuffix(value, suffix); found {
+			number, multiplier = trimmed, int64(1)<<(10*(i+1))
+			break
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a positive number of bytes or one like 20Gi", value)
+	}
+	if size > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return size * multiplier, nil
+}
+
+// timeout returns configured, or fallback when it isn't set
+func timeout(configured time.Duration, fallback time.Duration) time.Duration {
+	if configured == 0 {
+		return fallback
+	}
+	return configured
+}
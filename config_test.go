@@ -0,0 +1,224 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// unsetEnv clears every environment variable a config file can set, they're restored after the test
+func unsetEnv(t *testing.T) {
+	names := []string{"METRICS_ADDRESS", "HV_CLUSTER", "HV_VOLUME_POOLS"}
+	for name := range (driverConfig{}).environment() {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		value, set := os.LookupEnv(name)
+		os.Unsetenv(name)
+		t.Cleanup(func() {
+			if set {
+				os.Setenv(name, value)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	unsetEnv(t)
+	path := writeConfig(t, "config.yaml", `
+version: 1
+service: driver
+metricsAddress: ""
+clusterId: prod
+host:
+  url: https://hyperv01:5986
+  caFile: /etc/hyperv-csi/ca.pem
+  auth:
+    mode: kerberos
+    userFile: /etc/hyperv-csi/user
+    keytab: /etc/hyperv-csi/csi.keytab
+cluster:
+  enabled: true
+  name: hvcluster
+volumes:
+  path: C:\ClusterStorage\Volume1
+  pools:
+    ssd: D:\Volumes
+    archive: E:\Volumes
+  prefix: k8s-
+  defaultCapacity: 10Gi
+  defaultFilesystem: xfs
+  nameTemplate: "{{.PVCNamespace}}-{{.PVCName}}"
+  softDelete: true
+  trashRetention: 168h
+node:
+  reservedScsiSlots: 2
+timeouts:
+  connect: 10s
+  discovery: 1m
+reconcile:
+  interval: 1h
+  cleanup: true
+`)
+	// The environment overrides the file
+	t.Setenv("WINRM_CA_FILE_PATH", "/override/ca.pem")
+
+	config, err := loadConfig(path)
+	require.NoError(t, err)
+	config.apply()
+
+	assert.Equal(t, "https://hyperv01:5986", os.Getenv("WINRM_HOST"))
+	assert.Equal(t, "/override/ca.pem", os.Getenv("WINRM_CA_FILE_PATH"))
+	assert.Equal(t, "prod", os.Getenv("KUBE_CLUSTER_ID"))
+	assert.Equal(t, "kerberos", os.Getenv("WINRM_AUTH"))
+	assert.Equal(t, "/etc/hyperv-csi/user", os.Getenv("WINRM_USER_FILE"))
+	assert.Equal(t, "/etc/hyperv-csi/csi.keytab", os.Getenv("WINRM_KRB5_KEYTAB"))
+	assert.Equal(t, "true", os.Getenv("HV_CLUSTER"))
+	assert.Equal(t, "hvcluster", os.Getenv("HV_CLUSTER_NAME"))
+	assert.Equal(t, `C:\ClusterStorage\Volume1`, os.Getenv("HV_VOLUME_PATH"))
+	assert.Equal(t, `archive=E:\Volumes,ssd=D:\Volumes`, os.Getenv("HV_VOLUME_POOLS"))
+	metricsAddress, set := os.LookupEnv("METRICS_ADDRESS")
+	assert.True(t, set)
+	assert.Empty(t, metricsAddress)
+	_, set = os.LookupEnv("KUBE_NODE_NAME")
+	assert.False(t, set)
+
+	assert.Equal(t, "driver", config.service(""))
+	assert.Equal(t, "controller", config.service("controller"))
+	assert.Equal(t, int64(10*1024*1024*1024), config.defaultCapacity())
+	assert.Equal(t, int64(62), config.maxVolumes())
+	assert.NotNil(t, config.nameTemplate())
+	assert.True(t, config.Volumes.SoftDelete)
+	assert.Equal(t, 7*24*time.Hour, config.Volumes.TrashRetention)
+	assert.Equal(t, 10*time.Second, timeout(config.Timeouts.Connect, defaultConnectTimeout))
+	assert.Equal(t, time.Minute, timeout(config.Timeouts.Discovery, defaultDiscoveryTimeout))
+	assert.Equal(t, time.Hour, config.Reconcile.Interval)
+	assert.Equal(t, defaultReconcileGracePeriod, timeout(config.Reconcile.GracePeriod, defaultReconcileGracePeriod))
+	assert.NoError(t, config.validate("controller"))
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	unsetEnv(t)
+	path := writeConfig(t, "config.json", `{"version": 1, "host": {"url": "ssh://hyperv01"}, "volumes": {"defaultCapacity": "1073741824"}}`)
+
+	config, err := loadConfig(path)
+	require.NoError(t, err)
+	config.apply()
+
+	assert.Equal(t, "ssh://hyperv01", os.Getenv("WINRM_HOST"))
+	assert.Equal(t, "controller", config.service(""))
+	assert.Equal(t, int64(1024*1024*1024), config.defaultCapacity())
+	assert.Zero(t, config.maxVolumes())
+	assert.NoError(t, config.validate(config.service("")))
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorContains(t, err, "couldn't read config")
+
+	_, err = loadConfig(writeConfig(t, "config.yaml", "version: 1\nvolumes:\n  prefx: k8s-\n"))
+	assert.ErrorContains(t, err, "field prefx not found")
+
+	_, err = loadConfig(writeConfig(t, "config.yaml", "version: 1\ntimeouts:\n  connect: soon\n"))
+	assert.ErrorContains(t, err, "couldn't parse config")
+
+	_, err = loadConfig(writeConfig(t, "config.yaml", "host:\n  url: https://hyperv01\n"))
+	assert.ErrorContains(t, err, "unsupported version 0, expected 1")
+}
+
+func TestValidateConfig(t *testing.T) {
+	unsetEnv(t)
+	t.Setenv("WINRM_HOST", "ftp://hyperv01")
+	t.Setenv("WINRM_AUTH", "digest")
+	t.Setenv("HV_CLUSTER", "maybe")
+	t.Setenv("HV_VOLUME_POOLS", "ssd")
+	reserved := 64
+	config := driverConfig{
+		Version: configVersion,
+		Volumes: volumesConfig{
+			Prefix:            "k8s/",
+			DefaultCapacity:   "20GB",
+			DefaultFilesystem: "ntfs",
+			NameTemplate:      "{{.Namespace}}",
+			Pools:             map[string]string{"a,b": `D:\Volumes`},
+			TrashRetention:    time.Hour,
+		},
+		Node:      nodeConfig{ReservedScsiSlots: &reserved},
+		Timeouts:  timeoutsConfig{Discovery: -time.Second},
+		Reconcile: reconcileConfig{GracePeriod: -time.Hour},
+	}
+
+	err := config.validate("controller")
+
+	require.Error(t, err)
+	for _, message := range []string{
+		`host.url (WINRM_HOST): unsupported scheme "ftp", expected http, https or ssh`,
+		`host.auth.mode (WINRM_AUTH): unknown mode "digest"`,
+		`cluster.enabled (HV_CLUSTER): "maybe" isn't true or false`,
+		`volumes.pools: pool "a,b" can't contain a comma`,
+		`volumes.pools (HV_VOLUME_POOLS): couldn't parse pool "ssd", expected name=path`,
+		`volumes.prefix: "k8s/" can't be part of a file name`,
+		`volumes.defaultCapacity: invalid size "20GB"`,
+		`volumes.defaultFilesystem: unsupported filesystem "ntfs"`,
+		`volumes.nameTemplate: template: volume name:1:2: executing "volume name" at <.Namespace>: can't evaluate field Namespace`,
+		`node.reservedScsiSlots: 64 isn't between 0 and 63`,
+		`timeouts.discovery: -1s is negative`,
+		`reconcile.gracePeriod: -1h0m0s is negative`,
+		`volumes.trashRetention: only applies with volumes.softDelete`,
+	} {
+		assert.ErrorContains(t, err, message)
+	}
+
+	assert.ErrorContains(t, config.validate("nodes"), `service: unknown service "nodes"`)
+	os.Unsetenv("WINRM_HOST")
+	assert.ErrorContains(t, config.validate("controller"), "host.url (WINRM_HOST): the controller needs a host")
+	// The driver doesn't talk to the host
+	assert.NotContains(t, config.validate("driver").Error(), "WINRM_HOST")
+	t.Setenv("WINRM_HOST", "http://hyperv01:5985")
+	t.Setenv("WINRM_AUTH", "kerberos")
+	assert.ErrorContains(t, config.validate("controller"), "host.auth.mode (WINRM_AUTH): kerberos needs an https host.url")
+}
+
+func TestParseCapacity(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"512":   512,
+		"64Ki":  64 * 1024,
+		"100Mi": 100 * 1024 * 1024,
+		"20Gi":  20 * 1024 * 1024 * 1024,
+		"2Ti":   2 * 1024 * 1024 * 1024 * 1024,
+	} {
+		capacity, err := parseCapacity(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, capacity, value)
+	}
+	for _, value := range []string{"", "0", "-1Gi", "20G", "Gi", "9000000000Ti"} {
+		_, err := parseCapacity(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestConfigValidateCommand(t *testing.T) {
+	unsetEnv(t)
+	t.Cleanup(func() { configFile = "" })
+	valid := writeConfig(t, "valid.yaml", "version: 1\nhost:\n  url: http://hyperv01\n")
+	invalid := writeConfig(t, "invalid.yaml", "version: 1\nhost:\n  url: http://hyperv01\nvolumes:\n  defaultFilesystem: ntfs\n")
+
+	assert.Equal(t, 0, runCommand([]string{"config", "validate", valid}))
+	assert.Equal(t, 1, runCommand([]string{"config", "validate", invalid}))
+	assert.Equal(t, 2, runCommand([]string{"config"}))
+	assert.Equal(t, 2, runCommand([]string{"config", "check"}))
+	assert.Equal(t, 2, runCommand([]string{"reconcile", "-cleanup", "now"}))
+	assert.Equal(t, 2, runCommand([]string{"trash", "restore"}))
+	assert.Equal(t, 2, runCommand([]string{"trash", "empty", "pv-1"}))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Azure/go-ntlmssp"
+	"github.com/masterzen/winrm"
+	"github.com/masterzen/winrm/soap"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	encryptedProtocol    = "application/HTTP-SPNEGO-session-encrypted"
+	encryptedBoundary    = "--Encrypted Boundary"
+	encryptedContentType = `multipart/encrypted;protocol="` + encryptedProtocol + `";boundary="Encrypted Boundary"`
+)
+
+// errSessionExpired is returned when the host has forgotten a session, e.g. after the connection was closed
+var errSessionExpired = errors.New("http error 401: winrm session expired")
+
+// encryptMessage frames a sealed message the way WinRM expects it over http, see MS-WSMV 2.2.9.1
+func encryptMessage(session *ntlmSession, message []byte) []byte {
+	sealed, signature := session.outbound.seal(message)
+	body := bytes.NewBufferString(encryptedBoundary + "\r\n")
+	fmt.Fprintf(body, "\tContent-Type: %s\r\n", encryptedProtocol)
+	fmt.Fprintf(body, "\tOriginalContent: type=application/soap+xml;charset=UTF-8;Length=%d\r\n", len(message))
+	body.WriteString(encryptedBoundary + "\r\n\tContent-Type: application/octet-stream\r\n")
+	binary.Write(body, binary.LittleEndian, uint32(len(signature)))
+	body.Write(signature)
+	body.Write(sealed)
+	body.WriteString(encryptedBoundary + "--\r\n")
+	return body.Bytes()
+}
+
+// decryptMessage unseals every part of a multipart/encrypted body
+func decryptMessage(session *ntlmSession, body []byte) ([]byte, error) {
+	var message []byte
+	for {
+		header, rest, found := bytes.Cut(body, []byte("\tContent-Type: application/octet-stream\r\n"))
+		if !found {
+			break
+		}
+		_, length, found := bytes.Cut(header, []byte("Length="))
+		if !found {
+			return nil, errors.New("encrypted message is missing its length")
+		}
+		length, _, _ = bytes.Cut(length, []byte("\r\n"))
+		messageLength, err := strconv.Atoi(string(length))
+		if err != nil {
+			return nil, fmt.Errorf("invalid encrypted message length: %w", err)
+		}
+		if len(rest) < 4 {
+			return nil, errors.New("encrypted message is truncated")
+		}
+		signatureLength := int(binary.LittleEndian.Uint32(rest))
+		if len(rest) < 4+signatureLength+messageLength {
+			return nil, errors.New("encrypted message is truncated")
+		}
+		signature := rest[4 : 4+signatureLength]
+		unsealed, err := session.inbound.unseal(rest[4+signatureLength:4+signatureLength+messageLength], signature)
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, unsealed...)
+		body = rest[4+signatureLength+messageLength:]
+	}
+	if message == nil {
+		return nil, errors.New("no encrypted message in response")
+	}
+	return message, nil
+}
+
+// encryptedTransport seals messages with NTLM so http endpoints work without AllowUnencrypted, like Windows' own
+// WinRM client. The host ties a session to the connection it was set up on, so every session gets its own.
+type encryptedTransport struct {
+	user     string
+	domain   string
+	password string
+	url      string
+	client   func() *http.Client
+
+	lock sync.Mutex
+	idle []*encryptedSession
+}
+
+type encryptedSession struct {
+	http *http.Client
+	ntlm *ntlmSession
+}
+
+func newEncryptedTransport(user string, password string) *encryptedTransport {
+	user, domain, _ := ntlmssp.GetDomain(user)
+	return &encryptedTransport{user: user, domain: domain, password: password}
+}
+
+func (t *encryptedTransport) Transport(endpoint *winrm.Endpoint) error {
+	t.url = fmt.Sprintf("http://%s:%d/wsman", endpoint.Host, endpoint.Port)
+	t.client = func() *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			ResponseHeaderTimeout: endpoint.Timeout,
+			MaxConnsPerHost:       1,
+		}}
+	}
+	return nil
+}
+
+// Post sends request over an idle session or a new one, errors are worded like masterzen/winrm's so callers can
+// classify them the same way
+func (t *encryptedTransport) Post(_ *winrm.Client, request *soap.SoapMessage) (string, error) {
+	message := []byte(request.String())
+	for attempt := 0; ; attempt++ {
+		session, reused, err := t.session()
+		if err != nil {
+			return "", err
+		}
+		status, body, err := session.post(t.url, message)
+		if err != nil {
+			// The session's sequence numbers are out of step with the host's, it can't be reused
+			session.http.CloseIdleConnections()
+		}
+		// The host closes idle connections and forgets their sessions, a new session picks up where it left off
+		if attempt == 0 && (errors.Is(err, errSessionExpired) || reused && closedConnection(err)) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		t.release(session)
+		if status != http.StatusOK {
+			return "", fmt.Errorf("http error %d: %s", status, body)
+		}
+		return string(body), nil
+	}
+}
+
+// closedConnection is true when the connection was closed before there was a response
+func closedConnection(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// session returns an idle session, or sets up a new one
+func (t *encryptedTransport) session() (*encryptedSession, bool, error) {
+	t.lock.Lock()
+	if len(t.idle) > 0 {
+		session := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		t.lock.Unlock()
+		return session, true, nil
+	}
+	t.lock.Unlock()
+
+	session := &encryptedSession{http: t.client()}
+	if err := t.authenticate(session); err != nil {
+		session.http.CloseIdleConnections()
+		return nil, false, err
+	}
+	return session, false, nil
+}
+
+func (t *encryptedTransport) release(session *encryptedSession) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.idle = append(t.idle, session)
+}
+
+// authenticate runs the NTLM handshake with empty requests on the session's connection
+func (t *encryptedTransport) authenticate(session *encryptedSession) error {
+	response, err := session.handshake(t.url, ntlmNegotiateMessage())
+	if err != nil {
+		return err
+	}
+	token, found := strings.CutPrefix(response.Header.Get("WWW-Authenticate"), "Negotiate ")
+	if response.StatusCode != http.StatusUnauthorized || !found {
+		return fmt.Errorf("http error %d: host didn't send an ntlm challenge", response.StatusCode)
+	}
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("invalid ntlm challenge: %w", err)
+	}
+	challenge, err := parseNtlmChallenge(raw)
+	if err != nil {
+		return err
+	}
+
+	domain := t.domain
+	if domain == "" && !strings.Contains(t.user, "@") {
+		domain = challenge.targetName
+	}
+	clientChallenge, sessionKey := make([]byte, 8), make([]byte, 16)
+	rand.Read(clientChallenge)
+	rand.Read(sessionKey)
+	authenticate, err := ntlmAuthenticateMessage(challenge, t.user, domain, t.password, clientChallenge, sessionKey)
+	if err != nil {
+		return err
+	}
+	response, err = session.handshake(t.url, authenticate)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("http error %d: ntlm authentication failed", response.StatusCode)
+	}
+	session.ntlm = newNtlmSession(sessionKey, true)
+	return nil
+}
+
+func (s *encryptedSession) handshake(url string, token []byte) (*http.Response, error) {
+	request, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("impossible to create http request %w", err)
+	}
+	request.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	response, err := s.http.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("unknown error %w", err)
+	}
+	// The connection is only reused once the body has been read
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	return response, nil
+}
+
+// post sends a sealed message and unseals the response
+func (s *encryptedSession) post(url string, message []byte) (int, []byte, error) {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(encryptMessage(s.ntlm, message)))
+	if err != nil {
+		return 0, nil, fmt.Errorf("impossible to create http request %w", err)
+	}
+	request.Header.Set("Content-Type", encryptedContentType)
+	response, err := s.http.Do(request)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unknown error %w", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error while reading request body %w", err)
+	}
+	if response.StatusCode == http.StatusUnauthorized {
+		return 0, nil, errSessionExpired
+	}
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "multipart/encrypted") {
+		return 0, nil, fmt.Errorf("http response error: %d - invalid content type", response.StatusCode)
+	}
+	body, err = decryptMessage(s.ntlm, body)
+	return response.StatusCode, body, err
+}
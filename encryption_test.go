@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestEncryptMessage(t *testing.T) {
+	client, server := newNtlmSession(ntlmTestSessionKey, true), newNtlmSession(ntlmTestSessionKey, false)
+	message := []byte(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"></s:Envelope>`)
+
+	body := encryptMessage(client, message)
+
+	assert.Contains(t, string(body), "\tOriginalContent: type=application/soap+xml;charset=UTF-8;Length=75\r\n")
+	assert.NotContains(t, string(body), "Envelope")
+	decrypted, err := decryptMessage(server, body)
+	require.NoError(t, err)
+	assert.Equal(t, message, decrypted)
+
+	_, err = decryptMessage(server, body[:len(body)-30])
+	assert.ErrorContains(t, err, "truncated")
+	_, err = decryptMessage(server, message)
+	assert.ErrorContains(t, err, "no encrypted message")
+}
+
+// sealedPlaintext is "Plaintext" sealed with the MS-NLMP 4.2.4.4 session key, framed the way MS-WSMV 2.2.9.1
+// lays out an encrypted http message. The sealed bytes and signature are the spec's, not this package's output.
+var sealedPlaintext = append(append([]byte("--Encrypted Boundary\r\n"+
+	"\tContent-Type: application/HTTP-SPNEGO-session-encrypted\r\n"+
+	"\tOriginalContent: type=application/soap+xml;charset=UTF-8;Length=18\r\n"+
+	"--Encrypted Boundary\r\n"+
+	"\tContent-Type: application/octet-stream\r\n"+
+	"\x10\x00\x00\x00"),
+	unhex("010000007fb38ec5c55d497600000000"+"54e50165bf1936dc996020c1811b0f06fb5f")...),
+	"--Encrypted Boundary--\r\n"...)
+
+func TestEncryptMessageFixture(t *testing.T) {
+	assert.Equal(t, sealedPlaintext, encryptMessage(newNtlmSession(ntlmTestSessionKey, true), ntlmUnicode("Plaintext")))
+
+	decrypted, err := decryptMessage(newNtlmSession(ntlmTestSessionKey, false), sealedPlaintext)
+	require.NoError(t, err)
+	assert.Equal(t, ntlmUnicode("Plaintext"), decrypted)
+}
+
+func TestWinrmClientEncrypted(t *testing.T) {
+	server := newHTTPWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	client, err := newWinrmClient(server.URL, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, checkWinrmClient(context.Background(), client))
+	assert.Equal(t, []string{"Create", "Command", "Receive", "Signal", "Delete"}, server.Actions())
+	// Every request went over the one session
+	assert.Equal(t, 1, server.Sessions())
+
+	// The host forgets sessions when their connection closes, the client sets up a new one
+	server.CloseClientConnections()
+	require.NoError(t, checkWinrmClient(context.Background(), client))
+	assert.Equal(t, 2, server.Sessions())
+	assert.Zero(t, server.OpenShells())
+}
+
+func TestWinrmClientEncryptedWrongPassword(t *testing.T) {
+	server := newHTTPWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", "hunter3")
+
+	client, err := newWinrmClient(server.URL, nil)
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, checkWinrmClient(context.Background(), client), "http error 401")
+	assert.Empty(t, server.Actions())
+}
+
+func TestWinrmClientUnencryptedRejected(t *testing.T) {
+	server := newHTTPWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	t.Setenv("WINRM_AUTH", winrmAuthBasic)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	client, err := newWinrmClient(server.URL, nil)
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, checkWinrmClient(context.Background(), client), "400")
+	assert.Empty(t, server.Actions())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nijave/hyperv-csi/pkg"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"os"
+	"strings"
+	"time"
+)
+
+// newKubernetesClient connects with the pod's service account, or KUBECONFIG outside a cluster
+func newKubernetesClient() (kubernetes.Interface, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure kubernetes client: %w", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// kubernetesVolumes lists the driver's PersistentVolumes and VolumeAttachments for the reconciler
+func kubernetesVolumes(client kubernetes.Interface) func(ctx context.Context) (*pkg.KubernetesVolumes, error) {
+	return func(ctx context.Context) (*pkg.KubernetesVolumes, error) {
+		known := &pkg.KubernetesVolumes{Volumes: map[string]bool{}, Attachments: map[string]map[string]bool{}}
+		persistentVolumes, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		// VolumeAttachments name the PersistentVolume, not the volume handle
+		handles := map[string]string{}
+		for _, persistentVolume := range persistentVolumes.Items {
+			if csi := persistentVolume.Spec.CSI; csi != nil && csi.Driver == pkg.DriverName {
+				known.Volumes[csi.VolumeHandle] = true
+				handles[persistentVolume.Name] = csi.VolumeHandle
+			}
+		}
+
+		attachments, err := client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, attachment := range attachments.Items {
+			source := attachment.Spec.Source.PersistentVolumeName
+			if attachment.Spec.Attacher != pkg.DriverName || source == nil || handles[*source] == "" {
+				continue
+			}
+			handle := handles[*source]
+			if known.Attachments[handle] == nil {
+				known.Attachments[handle] = map[string]bool{}
+			}
+			known.Attachments[handle][strings.ToLower(attachment.Spec.NodeName)] = true
+		}
+		return known, nil
+	}
+}
+
+// newReconciler returns a reconciler comparing the controller's volumes with the cluster's
+func newReconciler(controller *pkg.HypervCsiController, cleanup bool, gracePeriod time.Duration) (*pkg.Reconciler, error) {
+	client, err := newKubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	return &pkg.Reconciler{
+		Controller:  controller,
+		Kubernetes:  kubernetesVolumes(client),
+		Cleanup:     cleanup,
+		GracePeriod: gracePeriod,
+	}, nil
+}
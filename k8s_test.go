@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"github.com/nijave/hyperv-csi/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func csiPersistentVolume(name string, driver string, handle string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: handle},
+			},
+		},
+	}
+}
+
+func volumeAttachment(name string, attacher string, persistentVolume string, node string) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: attacher,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &persistentVolume},
+			NodeName: node,
+		},
+	}
+}
+
+func TestKubernetesVolumes(t *testing.T) {
+	client := fake.NewClientset(
+		csiPersistentVolume("pvc-1", pkg.DriverName, "volume-1"),
+		csiPersistentVolume("pvc-2", pkg.DriverName, "volume-2"),
+		csiPersistentVolume("pvc-ebs", "ebs.csi.aws.com", "vol-0123"),
+		&corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "nfs"}},
+		volumeAttachment("csi-1", pkg.DriverName, "pvc-1", "kube01"),
+		volumeAttachment("csi-2", pkg.DriverName, "pvc-1", "Kube02"),
+		volumeAttachment("csi-ebs", "ebs.csi.aws.com", "pvc-ebs", "kube01"),
+	)
+
+	known, err := kubernetesVolumes(client)(context.Background())
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"volume-1": true, "volume-2": true}, known.Volumes)
+	assert.Equal(t, map[string]map[string]bool{"volume-1": {"kube01": true, "kube02": true}}, known.Attachments)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/masterzen/winrm"
 	"github.com/nijave/hyperv-csi/pkg"
@@ -10,25 +12,78 @@ import (
 	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 )
 
-func createWinrmClient(caFilePath *string) *winrm.Client {
-	parsed, err := url.Parse(os.Getenv("WINRM_HOST"))
+// recordFile is where -record saves every PowerShell command and its output
+var recordFile string
+
+// grpcService is -grpc-service, empty when the flag isn't given
+var grpcService string
+
+// envOrFile reads a setting from the file named by <name>_FILE, e.g. a mounted Secret, falling back to <name>
+func envOrFile(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read %s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// winrmCredentials returns the WinRM user and password
+func winrmCredentials() (string, string, error) {
+	user, err := envOrFile("WINRM_USER")
 	if err != nil {
-		klog.Error(err)
-		klog.Warning("couldn't parse WINRM_HOST environment variable")
+		return "", "", err
+	}
+	password, err := envOrFile("WINRM_PASSWORD")
+	return user, password, err
+}
+
+// recordedSecrets are scrubbed from recorded fixtures: the WinRM, Kerberos or SSH user and password, read
+// again for every command in case they've been rotated
+func recordedSecrets() []string {
+	user, password, _ := winrmCredentials()
+	secrets := []string{user, password}
+	if host, err := url.Parse(os.Getenv("WINRM_HOST")); err == nil && host.User != nil {
+		hostPassword, _ := host.User.Password()
+		secrets = append(secrets, host.User.Username(), hostPassword)
+	}
+	return secrets
+}
+
+// credentialFiles are the files WinRM clients are built from, the clients are rebuilt when they change
+func credentialFiles() []string {
+	files := make([]string, 0)
+	for _, name := range []string{"WINRM_USER_FILE", "WINRM_PASSWORD_FILE", "WINRM_CA_FILE_PATH", "WINRM_KRB5_KEYTAB", "WINRM_CLIENT_CERT_FILE",
+		"WINRM_CLIENT_KEY_FILE", "WINRM_SSH_KEY_FILE", "WINRM_SSH_KNOWN_HOSTS"} {
+		if path := os.Getenv(name); path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+func newWinrmClient(host string, caFilePath *string) (*winrm.Client, error) {
+	parsed, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse winrm host: %w", err)
 	}
 
 	var port int
 	if parsed.Port() != "" {
 		port, err = strconv.Atoi(parsed.Port())
 		if err != nil {
-			klog.Fatalf("couldn't parse port from WINRM_HOST: %v", err)
+			return nil, fmt.Errorf("couldn't parse port from winrm host: %w", err)
 		}
 	} else {
 		port = 5985
@@ -39,34 +94,135 @@ func createWinrmClient(caFilePath *string) *winrm.Client {
 		klog.InfoS("using non-default ca file", "cacert", *caFilePath)
 		caCert, err = os.ReadFile(*caFilePath)
 		if err != nil {
-			klog.Fatalf("couldn't read ca file %v", err)
+			return nil, fmt.Errorf("couldn't read ca file %w", err)
 		}
 	}
 
-	endpoint := winrm.NewEndpoint(parsed.Hostname(), port, parsed.Scheme == "https", false, caCert, nil, nil, 0)
-	params := winrm.DefaultParameters
-	params.TransportDecorator = func() winrm.Transporter { return &winrm.ClientNTLM{} }
-	winrmClient, err := winrm.NewClientWithParameters(endpoint, os.Getenv("WINRM_USER"), os.Getenv("WINRM_PASSWORD"), params)
+	user, password, err := winrmCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := winrm.NewEndpoint(parsed.Hostname(), port, parsed.Scheme == "https", false, caCert, nil, nil, driverSettings.Timeouts.Operation)
+	// DefaultParameters is shared, every client gets its own copy
+	params := *winrm.DefaultParameters
+	params.TransportDecorator, err = winrmTransport(endpoint, user, password)
+	if err != nil {
+		return nil, err
+	}
+	winrmClient, err := winrm.NewClientWithParameters(endpoint, user, password, &params)
+	if err != nil {
+		return nil, fmt.Errorf("could not create winrm client for %s: %w", endpoint.Host, err)
+	}
+	return winrmClient, nil
+}
+
+// checkWinrmClient runs a trivial command to make sure the host is reachable and the credentials work
+func checkWinrmClient(ctx context.Context, winrmClient pkg.RemotePowerShellRunner) error {
+	// winrm copies stdout and stderr concurrently so they can't share a buffer
+	var stdout, stderr bytes.Buffer
+	exit, err := winrmClient.RunWithContext(ctx, "echo ok", &stdout, &stderr)
 	if err != nil {
-		klog.Error(err)
-		klog.Fatalf("could not create winrm client for %s", endpoint.Host)
+		return fmt.Errorf("winrm check failed: %w", err)
+	}
+	if exit != 0 {
+		klog.Warning(stdout.String(), stderr.String())
+		return fmt.Errorf("winrm check failed with exit code %d", exit)
 	}
+	klog.InfoS("winrm check", "status", strings.Trim(stdout.String(), " \n\r\t"))
+	return nil
+}
 
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	output := new(bytes.Buffer)
-	exit, err := winrmClient.RunWithContext(ctx, "echo ok", output, output)
+// createWinrmClient returns a client that retries transient failures. The controller keeps running when the
+// host can't be reached, Probe reports it as not ready until the host is back.
+func createWinrmClient(caFilePath *string) pkg.RemotePowerShellRunner {
+	winrmClient, err := newResilientClient(os.Getenv("WINRM_HOST"), caFilePath)
+	if err != nil {
+		klog.Fatal(err)
+	}
 
-	if exit != 0 || err != nil {
-		klog.Warning(output.String())
-		klog.Fatalf("failed exit %d, %v", exit, err)
-	} else {
-		klog.InfoS("winrm check", "status", strings.Trim(output.String(), " \n\r\t"))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(driverSettings.Timeouts.Connect, defaultConnectTimeout))
+	defer cancel()
+	if err = checkWinrmClient(ctx, winrmClient); err != nil {
+		klog.ErrorS(err, "starting degraded, hyper-v host isn't reachable")
 	}
 
 	return winrmClient
 }
 
-func initController(grpcServer *grpc.Server) {
+// winrmClients are every client newResilientClient built, they're rebuilt when the credentials change
+var winrmClients struct {
+	lock    sync.Mutex
+	runners []*pkg.ResilientRunner
+}
+
+// newRemoteClient returns a WinRM client for host, or an OpenSSH one for an ssh:// host
+func newRemoteClient(host string, caFilePath *string) (pkg.RemotePowerShellRunner, error) {
+	parsed, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse winrm host: %w", err)
+	}
+	// Return nil rather than a typed nil on errors
+	if parsed.Scheme == "ssh" {
+		client, err := newSSHClient(parsed)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	client, err := newWinrmClient(host, caFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// newResilientClient wraps a client for host in a runner that retries and reconnects
+func newResilientClient(host string, caFilePath *string) (*pkg.ResilientRunner, error) {
+	runner, err := pkg.NewResilientRunner(func() (pkg.RemotePowerShellRunner, error) {
+		return newRemoteClient(host, caFilePath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	winrmClients.lock.Lock()
+	defer winrmClients.lock.Unlock()
+	winrmClients.runners = append(winrmClients.runners, runner)
+	return runner, nil
+}
+
+// reconnectWinrmClients rebuilds every client with the current credentials
+func reconnectWinrmClients() error {
+	winrmClients.lock.Lock()
+	defer winrmClients.lock.Unlock()
+	failures := make([]error, 0)
+	for _, runner := range winrmClients.runners {
+		if err := runner.Reconnect(); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	return errors.Join(failures...)
+}
+
+// parsePools reads named pools from a comma separated list of name=path pairs
+func parsePools(pools string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, pool := range strings.Split(pools, ",") {
+		if strings.TrimSpace(pool) == "" {
+			continue
+		}
+		name, path, found := strings.Cut(pool, "=")
+		if !found {
+			return nil, fmt.Errorf("couldn't parse pool %q, expected name=path", pool)
+		}
+		parsed[strings.TrimSpace(name)] = strings.TrimSpace(path)
+	}
+	return parsed, nil
+}
+
+// newHostController connects to the host and discovers the failover cluster without changing anything on the host,
+// operator commands that only read use it as is
+func newHostController() *pkg.HypervCsiController {
 	var caFilePath *string
 	if caFilePathOverride := os.Getenv("WINRM_CA_FILE_PATH"); len(caFilePathOverride) > 0 {
 		caFilePath = &caFilePathOverride
@@ -77,28 +233,130 @@ func initController(grpcServer *grpc.Server) {
 	if newVolumePath := os.Getenv("HV_VOLUME_PATH"); len(newVolumePath) > 0 {
 		volumePath = newVolumePath
 	}
+	pools, err := parsePools(os.Getenv("HV_VOLUME_POOLS"))
+	if err != nil {
+		klog.Fatalf("invalid HV_VOLUME_POOLS: %v", err)
+	}
 	hypervCsiController := &pkg.HypervCsiController{
-		WinrmClient: createWinrmClient(caFilePath),
-		VolumePath:  volumePath,
+		WinrmClient:     createWinrmClient(caFilePath),
+		VolumePath:      volumePath,
+		Pools:           pools,
+		VolumePrefix:    driverSettings.Volumes.Prefix,
+		DefaultCapacity: driverSettings.defaultCapacity(),
+		ClusterId:       os.Getenv("KUBE_CLUSTER_ID"),
+		NameTemplate:    driverSettings.nameTemplate(),
+		SoftDelete:      driverSettings.Volumes.SoftDelete,
+		TrashRetention:  driverSettings.Volumes.TrashRetention,
+	}
+	var recorder *pkg.Recorder
+	if recordFile != "" {
+		klog.InfoS("recording powershell session", "file", recordFile)
+		recorder = pkg.NewRecorder(recordFile, recordedSecrets)
+		hypervCsiController.WinrmClient = recorder.Wrap(hypervCsiController.WinrmClient)
 	}
 
+	if clusterMode, _ := strconv.ParseBool(os.Getenv("HV_CLUSTER")); clusterMode {
+		// Cluster nodes are reached the same way as the cluster name, only the host differs
+		hypervCsiController.Cluster = &pkg.ClusterConfig{
+			NodeClient: func(node string) (pkg.RemotePowerShellRunner, error) {
+				nodeHost, err := url.Parse(os.Getenv("WINRM_HOST"))
+				if err != nil {
+					return nil, err
+				}
+				if nodeHost.Port() != "" {
+					nodeHost.Host = node + ":" + nodeHost.Port()
+				} else {
+					nodeHost.Host = node
+				}
+				client, err := newResilientClient(nodeHost.String(), caFilePath)
+				if err != nil {
+					return nil, err
+				}
+				if recorder == nil {
+					return client, nil
+				}
+				return recorder.Wrap(client), nil
+			},
+		}
+		if len(os.Getenv("HV_VOLUME_PATH")) == 0 {
+			// Let cluster discovery pick a cluster shared volume
+			hypervCsiController.VolumePath = ""
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout(driverSettings.Timeouts.Discovery, defaultDiscoveryTimeout))
+		defer cancel()
+		if err := hypervCsiController.DiscoverCluster(ctx); err != nil {
+			// Probe retries discovery
+			klog.ErrorS(err, "starting degraded, failover cluster discovery failed")
+		}
+	}
+	return hypervCsiController
+}
+
+// newController is newHostController for the controller service, it also claims the volume prefix and reconnects
+// when the credentials change
+func newController() *pkg.HypervCsiController {
+	hypervCsiController := newHostController()
+
+	// Two clusters can't share a volume prefix, the controller only starts degraded when the host can't be reached
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(driverSettings.Timeouts.Connect, defaultConnectTimeout))
+	defer cancel()
+	if err := hypervCsiController.ClaimVolumePrefix(ctx); errors.Is(err, pkg.ErrVolumePrefixOwned) {
+		klog.Fatal(err)
+	} else if err != nil {
+		// Probe retries the claim
+		klog.ErrorS(err, "starting degraded, couldn't claim the volume prefix")
+	}
+
+	if files := credentialFiles(); len(files) > 0 {
+		go pkg.WatchCredentials(context.Background(), files, reconnectWinrmClients)
+	}
+
+	return hypervCsiController
+}
+
+// newGRPCServer logs, traces and measures every RPC
+func newGRPCServer() *grpc.Server {
+	return grpc.NewServer(grpc.ChainUnaryInterceptor(pkg.LoggingInterceptor, pkg.TracingInterceptor(), pkg.MetricsInterceptor))
+}
+
+func initController(grpcServer *grpc.Server, hypervCsiController *pkg.HypervCsiController) {
 	csi.RegisterControllerServer(grpcServer, hypervCsiController)
 	csi.RegisterIdentityServer(grpcServer, hypervCsiController)
 }
 
-func initDriver(grpcServer *grpc.Server) {
-	hypervCsiController := &pkg.HypervCsiController{}
-	csi.RegisterIdentityServer(grpcServer, hypervCsiController)
-	hypervCsiDriver := &pkg.HypervCsiDriver{}
+func initDriver(grpcServer *grpc.Server, hypervCsiDriver *pkg.HypervCsiDriver) {
+	csi.RegisterIdentityServer(grpcServer, hypervCsiDriver)
 	csi.RegisterNodeServer(grpcServer, hypervCsiDriver)
 }
 
+// serveHTTP serves Prometheus metrics on /metrics, identity's health checks on /healthz and liveness on /livez
+func serveHTTP(address string, identity csi.IdentityServer) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", pkg.MetricsHandler())
+	mux.Handle("/healthz", pkg.HealthHandler(identity))
+	mux.Handle("/livez", pkg.LivenessHandler())
+	klog.InfoS("serving metrics and health checks", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.ErrorS(err, "http server stopped", "address", address)
+	}
+}
+
 func main() {
-	var grpcService string
 	klog.InitFlags(nil)
-	flag.StringVar(&grpcService, "grpc-service", "controller", "Which gRPC services should run")
+	flag.StringVar(&grpcService, "grpc-service", "", "Which gRPC services should run, controller or driver (default controller)")
+	flag.StringVar(&recordFile, "record", "", "Record every PowerShell command and its output to this fixtures file")
+	flag.StringVar(&configFile, "config", "", "YAML or JSON config file, environment variables override it")
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	if err := setupConfig(grpcService); err != nil {
+		klog.Fatalf("invalid config: %v", err)
+	}
+	grpcService = driverSettings.service(grpcService)
+
 	socket := "/run/csi/socket"
 	if envSocket := os.Getenv("CSI_ADDRESS"); len(envSocket) > 0 {
 		socket = envSocket
@@ -115,18 +373,51 @@ func main() {
 		klog.Fatalf("failed to listen: %v", err)
 	}
 	defer listen.Close()
-	grpcServer := grpc.NewServer()
+	shutdownTracing, err := pkg.SetupTracing(context.Background())
+	if err != nil {
+		klog.Fatalf("couldn't set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+	grpcServer := newGRPCServer()
+
+	metricsAddress := ":9820"
+	if envMetricsAddress, ok := os.LookupEnv("METRICS_ADDRESS"); ok {
+		metricsAddress = envMetricsAddress
+	}
 
+	var identity csi.IdentityServer
 	switch grpcService {
 	case "controller":
-		initController(grpcServer)
+		controller := newController()
+		initController(grpcServer, controller)
+		identity = controller
+		if controller.SoftDelete && controller.TrashRetention > 0 {
+			go controller.PurgeTrashLoop(context.Background())
+		}
+		if interval := driverSettings.Reconcile.Interval; interval > 0 {
+			reconciler, err := newReconciler(controller, driverSettings.Reconcile.Cleanup,
+				timeout(driverSettings.Reconcile.GracePeriod, defaultReconcileGracePeriod))
+			if err != nil {
+				klog.Fatalf("couldn't start reconciler: %v", err)
+			}
+			go reconciler.Loop(context.Background(), interval)
+		}
 	case "driver":
-		initDriver(grpcServer)
+		driver := &pkg.HypervCsiDriver{
+			DefaultFilesystem: driverSettings.Volumes.DefaultFilesystem,
+			MaxVolumes:        driverSettings.maxVolumes(),
+		}
+		initDriver(grpcServer, driver)
+		identity = driver
 	default:
 		listen.Close()
 		klog.Fatal("invalid grpc-service specified")
 	}
 
+	if metricsAddress != "" {
+		go serveHTTP(metricsAddress, identity)
+	}
+
 	klog.Infof("server %s listening at %v", grpcService, listen.Addr())
 	if err := grpcServer.Serve(listen); err != nil {
 		klog.Fatalf("failed to serve: %v", err)
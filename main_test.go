@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/nijave/hyperv-csi/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testWinrmUser     = "csi"
+	testWinrmPassword = "hunter2"
+)
+
+func echoHandler(ctx context.Context, command string) (int, string, string) {
+	if command == "echo ok" {
+		return 0, "ok\r\n", ""
+	}
+	return 1, "", "'" + command + "' is not recognized as an internal or external command"
+}
+
+func TestCreateWinrmClient(t *testing.T) {
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	caFile := server.caFile(t)
+	t.Setenv("WINRM_HOST", server.URL)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	client := createWinrmClient(&caFile)
+
+	require.NotNil(t, client)
+	assert.Equal(t, []string{"Create", "Command", "Receive", "Signal", "Delete"}, server.Actions())
+	assert.Zero(t, server.OpenShells())
+}
+
+func TestCreateWinrmClientDegraded(t *testing.T) {
+	// Nothing listens on the port once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener.Close()
+	t.Setenv("WINRM_HOST", "http://"+listener.Addr().String())
+
+	client := createWinrmClient(nil)
+
+	require.NotNil(t, client)
+	assert.ErrorContains(t, checkWinrmClient(context.Background(), client), "connection refused")
+}
+
+func TestWinrmClientRequiresCA(t *testing.T) {
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	client, err := newWinrmClient(server.URL, nil)
+	require.NoError(t, err)
+
+	err = checkWinrmClient(context.Background(), client)
+	assert.ErrorContains(t, err, "certificate")
+	assert.Empty(t, server.Actions())
+}
+
+func TestWinrmClientWrongPassword(t *testing.T) {
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	caFile := server.caFile(t)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", "hunter3")
+
+	client, err := newWinrmClient(server.URL, &caFile)
+	require.NoError(t, err)
+
+	err = checkWinrmClient(context.Background(), client)
+	assert.ErrorContains(t, err, "401")
+	assert.Empty(t, server.Actions())
+}
+
+func TestWinrmClientPasswordRotation(t *testing.T) {
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, echoHandler)
+	caFile := server.caFile(t)
+	passwordFile := filepath.Join(t.TempDir(), "WINRM_PASSWORD")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("hunter1\n"), 0600))
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", "ignored")
+	t.Setenv("WINRM_PASSWORD_FILE", passwordFile)
+
+	client, err := newResilientClient(server.URL, &caFile)
+	require.NoError(t, err)
+	assert.ErrorContains(t, checkWinrmClient(context.Background(), client), "401")
+
+	require.NoError(t, os.WriteFile(passwordFile, []byte(testWinrmPassword+"\n"), 0600))
+	require.NoError(t, client.Reconnect())
+	assert.NoError(t, checkWinrmClient(context.Background(), client))
+}
+
+func TestRecordedSecrets(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "WINRM_PASSWORD")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("hunter1\n"), 0600))
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD_FILE", passwordFile)
+	t.Setenv("WINRM_HOST", "ssh://csi@hyperv01:22")
+
+	assert.ElementsMatch(t, []string{testWinrmUser, "hunter1", "csi", ""}, recordedSecrets())
+
+	require.NoError(t, os.WriteFile(passwordFile, []byte(testWinrmPassword+"\n"), 0600))
+	assert.Contains(t, recordedSecrets(), testWinrmPassword)
+}
+
+func TestWinrmClientExitCode(t *testing.T) {
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, func(ctx context.Context, command string) (int, string, string) {
+		return 3, "partial output", "it broke"
+	})
+	caFile := server.caFile(t)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	client, err := newWinrmClient(server.URL, &caFile)
+	require.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := client.RunWithContext(context.Background(), "exit 3", &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Equal(t, 3, exitCode)
+	assert.Equal(t, "partial output", stdout.String())
+	assert.Equal(t, "it broke", stderr.String())
+
+	assert.ErrorContains(t, checkWinrmClient(context.Background(), client), "exit code 3")
+}
+
+func TestWinrmClientTimeout(t *testing.T) {
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, func(ctx context.Context, command string) (int, string, string) {
+		// Hangs until the client signals the command to stop
+		<-ctx.Done()
+		return 1, "", ""
+	})
+	caFile := server.caFile(t)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	client, err := newWinrmClient(server.URL, &caFile)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err = checkWinrmClient(ctx, client)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	// Several Receives timed out before the client gave up and terminated the command
+	actions := server.Actions()
+	assert.Greater(t, strings.Count(strings.Join(actions, ","), "Receive"), 1)
+	assert.Contains(t, actions, "Signal")
+	assert.Zero(t, server.OpenShells())
+}
+
+func TestWinrmClientCliXmlError(t *testing.T) {
+	const newVhdError = "#< CLIXML\r\n<Objs Version=\"1.1.0.1\" xmlns=\"http://schemas.microsoft.com/powershell/2004/04\"><S S=\"Error\">New-VHD : Failed to create the virtual hard disk._x000D__x000A_</S><S S=\"Error\">The file exists. (0x80070050)._x000D__x000A_</S></Objs>"
+	var commands []string
+	server := newWsmanServer(t, testWinrmUser, testWinrmPassword, func(ctx context.Context, command string) (int, string, string) {
+		commands = append(commands, command)
+		switch {
+		case strings.Contains(command, "New-VHD"):
+			return 1, "", newVhdError
+		case strings.Contains(command, "ConvertTo-Json @("):
+			// No volumes exist yet
+			return 0, "[]", ""
+		}
+		return 0, "", ""
+	})
+	caFile := server.caFile(t)
+	t.Setenv("WINRM_USER", testWinrmUser)
+	t.Setenv("WINRM_PASSWORD", testWinrmPassword)
+
+	client, err := newWinrmClient(server.URL, &caFile)
+	require.NoError(t, err)
+	// Record what came back over the wire so the raw CLIXML can be checked
+	sessionFile := filepath.Join(t.TempDir(), "session.json")
+	recorder := pkg.NewRecorder(sessionFile, recordedSecrets)
+	controller := &pkg.HypervCsiController{
+		WinrmClient: recorder.Wrap(client),
+		VolumePath:  "V:\\Hyper-V\\Virtual Hard Disks",
+	}
+
+	_, err = controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+
+	require.Error(t, err)
+	assert.NotEqual(t, codes.OK, status.Code(err))
+	require.NotEmpty(t, commands)
+	assert.True(t, strings.HasPrefix(commands[0], "powershell.exe -NoProfile -Command "), commands[0])
+	assert.Contains(t, commands[len(commands)-1], "New-VHD -Path 'V:\\Hyper-V\\Virtual Hard Disks\\")
+
+	var recorded []pkg.RecordedCommand
+	session, err := os.ReadFile(sessionFile)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(session, &recorded))
+	newVhd := recorded[len(recorded)-1]
+	assert.Equal(t, 1, newVhd.ExitCode)
+	assert.Equal(t, newVhdError, newVhd.Stderr)
+}
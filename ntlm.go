@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/md4"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLM negotiate flags, see MS-NLMP 2.2.2.5
+const (
+	ntlmNegotiateUnicode                 = 1 << 0
+	ntlmRequestTarget                    = 1 << 2
+	ntlmNegotiateSign                    = 1 << 4
+	ntlmNegotiateSeal                    = 1 << 5
+	ntlmNegotiateNtlm                    = 1 << 9
+	ntlmNegotiateAlwaysSign              = 1 << 15
+	ntlmNegotiateExtendedSessionSecurity = 1 << 19
+	ntlmNegotiateTargetInfo              = 1 << 23
+	ntlmNegotiate128                     = 1 << 29
+	ntlmNegotiateKeyExch                 = 1 << 30
+	ntlmNegotiate56                      = 1 << 31
+)
+
+// ntlmSealingFlags all have to be negotiated for a session that can seal messages
+const ntlmSealingFlags = ntlmNegotiateSign | ntlmNegotiateSeal | ntlmNegotiateExtendedSessionSecurity | ntlmNegotiate128 | ntlmNegotiateKeyExch
+
+const ntlmClientFlags = ntlmSealingFlags | ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNtlm |
+	ntlmNegotiateAlwaysSign | ntlmNegotiateTargetInfo | ntlmNegotiate56
+
+// ntlmAvTimestamp is the MsvAvTimestamp AV pair in a challenge's target info
+const ntlmAvTimestamp = 7
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+type ntlmVarField struct {
+	Len    uint16
+	MaxLen uint16
+	Offset uint32
+}
+
+func (f ntlmVarField) read(message []byte) []byte {
+	if int(f.Offset)+int(f.Len) > len(message) {
+		return nil
+	}
+	return message[f.Offset : f.Offset+uint32(f.Len)]
+}
+
+func ntlmUnicode(value string) []byte {
+	encoded := utf16.Encode([]rune(value))
+	raw := make([]byte, len(encoded)*2)
+	for i, char := range encoded {
+		binary.LittleEndian.PutUint16(raw[i*2:], char)
+	}
+	return raw
+}
+
+func ntlmFromUnicode(raw []byte) string {
+	decoded := make([]uint16, len(raw)/2)
+	for i := range decoded {
+		decoded[i] = binary.LittleEndian.Uint16(raw[i*2:])
+	}
+	return string(utf16.Decode(decoded))
+}
+
+func hmacMd5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, part := range data {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+func rc4Crypt(key []byte, data []byte) []byte {
+	cipher, err := rc4.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	crypted := make([]byte, len(data))
+	cipher.XORKeyStream(crypted, data)
+	return crypted
+}
+
+// ntlmNegotiateMessage asks for NTLMv2 with a session that can seal messages
+func ntlmNegotiateMessage() []byte {
+	message := bytes.NewBuffer(append([]byte(nil), ntlmSignature...))
+	binary.Write(message, binary.LittleEndian, uint32(1))
+	binary.Write(message, binary.LittleEndian, uint32(ntlmClientFlags))
+	// No domain or workstation
+	message.Write(make([]byte, 16))
+	return message.Bytes()
+}
+
+// ntlmChallenge is the part of a challenge message the client uses
+type ntlmChallenge struct {
+	flags           uint32
+	serverChallenge []byte
+	targetName      string
+	targetInfo      []byte
+}
+
+func parseNtlmChallenge(message []byte) (*ntlmChallenge, error) {
+	var fields struct {
+		Signature       [8]byte
+		MessageType     uint32
+		TargetName      ntlmVarField
+		Flags           uint32
+		ServerChallenge [8]byte
+		Reserved        [8]byte
+		TargetInfo      ntlmVarField
+	}
+	if err := binary.Read(bytes.NewReader(message), binary.LittleEndian, &fields); err != nil {
+		return nil, fmt.Errorf("invalid ntlm challenge: %w", err)
+	}
+	if !bytes.Equal(fields.Signature[:], ntlmSignature) || fields.MessageType != 2 {
+		return nil, errors.New("invalid ntlm challenge")
+	}
+	return &ntlmChallenge{
+		flags:           fields.Flags,
+		serverChallenge: fields.ServerChallenge[:],
+		targetName:      ntlmFromUnicode(fields.TargetName.read(message)),
+		targetInfo:      fields.TargetInfo.read(message),
+	}, nil
+}
+
+// timestamp returns the server's MsvAvTimestamp, if it sent one
+func (c *ntlmChallenge) timestamp() []byte {
+	info := c.targetInfo
+	for len(info) >= 4 {
+		id, length := binary.LittleEndian.Uint16(info), int(binary.LittleEndian.Uint16(info[2:]))
+		if id == 0 || len(info) < 4+length {
+			break
+		}
+		if id == ntlmAvTimestamp {
+			return info[4 : 4+length]
+		}
+		info = info[4+length:]
+	}
+	return nil
+}
+
+// ntlmResponseKey is NTOWFv2, the key NTLMv2 responses are computed with
+func ntlmResponseKey(user string, domain string, password string) []byte {
+	hash := md4.New()
+	hash.Write(ntlmUnicode(password))
+	return hmacMd5(hash.Sum(nil), ntlmUnicode(strings.ToUpper(user)+domain))
+}
+
+// ntlmV2Response returns the NTLMv2 challenge response and the session base key
+func ntlmV2Response(responseKey []byte, serverChallenge []byte, clientChallenge []byte, timestamp []byte, targetInfo []byte) ([]byte, []byte) {
+	temp := bytes.NewBuffer([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write(make([]byte, 4))
+	temp.Write(targetInfo)
+	temp.Write(make([]byte, 4))
+
+	proof := hmacMd5(responseKey, serverChallenge, temp.Bytes())
+	return append(proof, temp.Bytes()...), hmacMd5(responseKey, proof)
+}
+
+// ntlmAuthenticateMessage answers challenge, exportedSessionKey becomes the key the session seals messages with
+func ntlmAuthenticateMessage(challenge *ntlmChallenge, user string, domain string, password string, clientChallenge []byte, exportedSessionKey []byte) ([]byte, error) {
+	if challenge.flags&ntlmSealingFlags != ntlmSealingFlags {
+		return nil, fmt.Errorf("host doesn't support ntlm message encryption, flags %#x", challenge.flags)
+	}
+
+	responseKey := ntlmResponseKey(user, domain, password)
+	timestamp := challenge.timestamp()
+	lmResponse := make([]byte, 24)
+	if timestamp == nil {
+		timestamp = make([]byte, 8)
+		// Windows file time, 100ns intervals since 1601
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100)+116444736000000000)
+		lmResponse = append(hmacMd5(responseKey, challenge.serverChallenge, clientChallenge), clientChallenge...)
+	}
+	ntResponse, sessionBaseKey := ntlmV2Response(responseKey, challenge.serverChallenge, clientChallenge, timestamp, challenge.targetInfo)
+	encryptedSessionKey := rc4Crypt(sessionBaseKey, exportedSessionKey)
+
+	const headerLength = 64
+	payload := [][]byte{lmResponse, ntResponse, ntlmUnicode(domain), ntlmUnicode(user), nil, encryptedSessionKey}
+	message := bytes.NewBuffer(append([]byte(nil), ntlmSignature...))
+	binary.Write(message, binary.LittleEndian, uint32(3))
+	offset := headerLength
+	for _, field := range payload {
+		binary.Write(message, binary.LittleEndian, ntlmVarField{uint16(len(field)), uint16(len(field)), uint32(offset)})
+		offset += len(field)
+	}
+	binary.Write(message, binary.LittleEndian, challenge.flags&ntlmClientFlags)
+	for _, field := range payload {
+		message.Write(field)
+	}
+	return message.Bytes(), nil
+}
+
+// ntlmSealer seals or unseals the messages going one way in an NTLM session, see MS-NLMP 3.4
+type ntlmSealer struct {
+	signingKey []byte
+	handle     *rc4.Cipher
+	sequence   uint32
+}
+
+func newNtlmSealer(sessionKey []byte, direction string) *ntlmSealer {
+	signingKey := md5.Sum(append(append([]byte(nil), sessionKey...), "session key to "+direction+" signing key magic constant\x00"...))
+	sealingKey := md5.Sum(append(append([]byte(nil), sessionKey...), "session key to "+direction+" sealing key magic constant\x00"...))
+	handle, err := rc4.NewCipher(sealingKey[:])
+	if err != nil {
+		panic(err)
+	}
+	return &ntlmSealer{signingKey: signingKey[:], handle: handle}
+}
+
+// sign returns the signature of the next message. The RC4 state carries over between messages so they have to
+// be signed in order.
+func (s *ntlmSealer) sign(message []byte) []byte {
+	signature := make([]byte, 16)
+	binary.LittleEndian.PutUint32(signature, 1)
+	binary.LittleEndian.PutUint32(signature[12:], s.sequence)
+	s.handle.XORKeyStream(signature[4:12], hmacMd5(s.signingKey, signature[12:], message)[:8])
+	s.sequence++
+	return signature
+}
+
+func (s *ntlmSealer) seal(message []byte) ([]byte, []byte) {
+	sealed := make([]byte, len(message))
+	s.handle.XORKeyStream(sealed, message)
+	return sealed, s.sign(message)
+}
+
+func (s *ntlmSealer) unseal(sealed []byte, signature []byte) ([]byte, error) {
+	message := make([]byte, len(sealed))
+	s.handle.XORKeyStream(message, sealed)
+	if !hmac.Equal(s.sign(message), signature) {
+		return nil, errors.New("ntlm message signature doesn't match")
+	}
+	return message, nil
+}
+
+// ntlmSession seals outbound messages and unseals inbound ones
+type ntlmSession struct {
+	outbound *ntlmSealer
+	inbound  *ntlmSealer
+}
+
+func newNtlmSession(exportedSessionKey []byte, client bool) *ntlmSession {
+	clientToServer := newNtlmSealer(exportedSessionKey, "client-to-server")
+	serverToClient := newNtlmSealer(exportedSessionKey, "server-to-client")
+	if client {
+		return &ntlmSession{outbound: clientToServer, inbound: serverToClient}
+	}
+	return &ntlmSession{outbound: serverToClient, inbound: clientToServer}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// Test vectors from MS-NLMP 4.2.4, NTLMv2 authentication
+var (
+	ntlmTestServerChallenge = unhex("0123456789abcdef")
+	ntlmTestClientChallenge = bytes.Repeat([]byte{0xaa}, 8)
+	ntlmTestSessionKey      = bytes.Repeat([]byte{0x55}, 16)
+	ntlmTestTimestamp       = make([]byte, 8)
+	// MsvAvNbDomainName "Domain", MsvAvNbComputerName "Server" and MsvAvEOL
+	ntlmTestTargetInfo = unhex("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+)
+
+func unhex(value string) []byte {
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func TestNtlmV2Response(t *testing.T) {
+	responseKey := ntlmResponseKey("User", "Domain", "Password")
+	assert.Equal(t, unhex("0c868a403bfd7a93a3001ef22ef02e3f"), responseKey)
+
+	ntResponse, sessionBaseKey := ntlmV2Response(responseKey, ntlmTestServerChallenge, ntlmTestClientChallenge, ntlmTestTimestamp, ntlmTestTargetInfo)
+	assert.Equal(t, unhex("68cd0ab851e51c96aabc927bebef6a1c"), ntResponse[:16])
+	assert.Equal(t, unhex("8de40ccadbc14a82f15cb0ad0de95ca3"), sessionBaseKey)
+	assert.Equal(t, unhex("c5dad2544fc9799094ce1ce90bc9d03e"), rc4Crypt(sessionBaseKey, ntlmTestSessionKey))
+}
+
+func TestNtlmSeal(t *testing.T) {
+	client := newNtlmSession(ntlmTestSessionKey, true)
+
+	sealed, signature := client.outbound.seal(ntlmUnicode("Plaintext"))
+
+	assert.Equal(t, unhex("54e50165bf1936dc996020c1811b0f06fb5f"), sealed)
+	assert.Equal(t, unhex("010000007fb38ec5c55d497600000000"), signature)
+}
+
+func TestNtlmUnseal(t *testing.T) {
+	client, server := newNtlmSession(ntlmTestSessionKey, true), newNtlmSession(ntlmTestSessionKey, false)
+
+	for _, message := range []string{"first", "second", "third"} {
+		sealed, signature := client.outbound.seal([]byte(message))
+		unsealed, err := server.inbound.unseal(sealed, signature)
+		require.NoError(t, err)
+		assert.Equal(t, message, string(unsealed))
+
+		sealed, signature = server.outbound.seal([]byte(message))
+		unsealed, err = client.inbound.unseal(sealed, signature)
+		require.NoError(t, err)
+		assert.Equal(t, message, string(unsealed))
+	}
+
+	// A tampered message, or one out of order, doesn't verify
+	sealed, signature := client.outbound.seal([]byte("fourth"))
+	sealed[0] ^= 1
+	_, err := server.inbound.unseal(sealed, signature)
+	assert.ErrorContains(t, err, "signature")
+}
+
+func TestNtlmAuthenticateMessage(t *testing.T) {
+	challenge, err := parseNtlmChallenge(ntlmChallengeMessage(ntlmClientFlags))
+	require.NoError(t, err)
+	assert.Equal(t, ntlmServerChallenge, challenge.serverChallenge)
+	assert.Equal(t, wsmanNtlmDomain, challenge.targetName)
+
+	message, err := ntlmAuthenticateMessage(challenge, "User", challenge.targetName, "Password", ntlmTestClientChallenge, ntlmTestSessionKey)
+	require.NoError(t, err)
+	// The host recovers the session key from the message
+	sessionKey, ok := ntlmVerify(message, "User", "Password")
+	assert.True(t, ok)
+	assert.Equal(t, ntlmTestSessionKey, sessionKey)
+
+	challenge, err = parseNtlmChallenge(ntlmChallengeMessage(0))
+	require.NoError(t, err)
+	_, err = ntlmAuthenticateMessage(challenge, "User", challenge.targetName, "Password", ntlmTestClientChallenge, ntlmTestSessionKey)
+	assert.ErrorContains(t, err, "doesn't support ntlm message encryption")
+}
+
+func TestParseNtlmChallengeInvalid(t *testing.T) {
+	_, err := parseNtlmChallenge(ntlmNegotiateMessage())
+	assert.ErrorContains(t, err, "invalid ntlm challenge")
+
+	_, err = parseNtlmChallenge([]byte("NTLMSSP"))
+	assert.ErrorContains(t, err, "invalid ntlm challenge")
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+)
+
+// VHD is a virtual hard disk file on the Hyper-V host
+type VHD struct {
+	Path           string `json:"Path"`
+	ParentPath     string `json:"ParentPath"`
+	DiskIdentifier string `json:"DiskIdentifier"`
+	Size           int64  `json:"Size"`
+}
+
+// DiskAttachment is a VHD connected to a VM's SCSI controller
+type DiskAttachment struct {
+	VMName string `json:"VMName"`
+	Path   string `json:"Path"`
+}
+
+// ClusterInfo describes the failover cluster a backend is connected to
+type ClusterInfo struct {
+	Name string `json:"Name"`
+	// SharedVolumes are the paths of the cluster shared volumes, e.g. C:\ClusterStorage\Volume1
+	SharedVolumes []string `json:"Csv"`
+}
+
+var ErrVHDNotFound = errors.New("vhd not found")
+var ErrVMNotFound = errors.New("vm not found")
+
+// ErrDiskInUse is returned when attaching a disk that's already attached to a different VM
+var ErrDiskInUse = errors.New("disk is attached to another vm")
+
+// ErrNoFreeSlot is returned when a VM's SCSI controller has no free locations
+var ErrNoFreeSlot = errors.New("no free scsi location")
+
+// HypervBackend is everything the controller needs from a Hyper-V host. Paths are plain Windows paths,
+// quoting is up to the implementation. Patterns match anywhere in a path, like PowerShell's -like "*pattern*".
+type HypervBackend interface {
+	// ListDisks returns the file names of every .vhdx directly in the directories starting with prefix
+	ListDisks(ctx context.Context, directories []string, prefix string) ([]string, error)
+	// GetVHD returns every VHD whose path starts with pathPrefix
+	GetVHD(ctx context.Context, pathPrefix string) ([]VHD, error)
+	// CreateVHD creates a dynamically expanding VHDX
+	CreateVHD(ctx context.Context, path string, sizeBytes int64) (VHD, error)
+	// CreateDifferencingVHD creates a differencing VHDX, or returns it if it already exists
+	CreateDifferencingVHD(ctx context.Context, path string, parentPath string) (VHD, error)
+	// ResizeVHD grows a VHDX to sizeBytes, also while it's attached
+	ResizeVHD(ctx context.Context, path string, sizeBytes int64) (VHD, error)
+	// SetReadOnly marks a file read-only so nothing can modify it
+	SetReadOnly(ctx context.Context, path string) error
+	MoveFile(ctx context.Context, path string, newPath string) error
+	// DeleteFiles removes the files at paths. It fails with ErrDiskInUse when one of them is attached.
+	DeleteFiles(ctx context.Context, paths []string) error
+	// DeleteFile removes a file, if it exists
+	DeleteFile(ctx context.Context, path string) error
+	// ReadFile returns the contents of a file or an NTFS alternate data stream when stream isn't empty. Missing files are empty.
+	ReadFile(ctx context.Context, path string, stream string) (string, error)
+	WriteFile(ctx context.Context, path string, stream string, content string) error
+	// ReadStreams reads an alternate data stream from every .vhdx directly in the directories starting with prefix.
+	// The result is keyed by file name and leaves out files without the stream.
+	ReadStreams(ctx context.Context, directories []string, prefix string, stream string) (map[string]string, error)
+	// CopyVHDs copies every file starting with pathPrefix to directory, re-pointing differencing disks at the copied parents
+	CopyVHDs(ctx context.Context, pathPrefix string, directory string) error
+	// MoveVHDs moves the files at paths to directory, creating it if needed, and re-points differencing disks at
+	// the moved parents. It fails with ErrDiskInUse when one of the files is attached.
+	MoveVHDs(ctx context.Context, paths []string, directory string) error
+	// MoveAttachedVHDs live moves every file starting with pathPrefix to directory while attached to vmName
+	MoveAttachedVHDs(ctx context.Context, vmName string, pathPrefix string, directory string) error
+	// AttachDisk connects a VHD to a VM's SCSI controller. Attaching a disk to the VM it's already attached to succeeds.
+	AttachDisk(ctx context.Context, vmName string, path string) error
+	// DetachDisk disconnects every disk matching pattern from a VM
+	DetachDisk(ctx context.Context, vmName string, pattern string) error
+	// ListAttachments returns every VM disk matching pattern across all hosts
+	ListAttachments(ctx context.Context, pattern string) ([]DiskAttachment, error)
+	// SetDiskQoS applies QoS to disks matching pattern on vmName, or on every VM when vmName is empty
+	SetDiskQoS(ctx context.Context, vmName string, pattern string, qos *volumeQoS) error
+	// FreeSpace returns the bytes available on the volume holding directory
+	FreeSpace(ctx context.Context, directory string) (int64, error)
+	// ClusterInfo describes the failover cluster the host belongs to
+	ClusterInfo(ctx context.Context) (ClusterInfo, error)
+	// Ping runs a trivial command to check the host is reachable and the credentials work
+	Ping(ctx context.Context) error
+	// CheckHyperV checks the Hyper-V PowerShell module loads
+	CheckHyperV(ctx context.Context) error
+	// CheckDirectory checks a directory exists and files can be created in it
+	CheckDirectory(ctx context.Context, directory string) error
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Topology key reporting which Hyper-V failover cluster a node's VM runs in. VMs live migrate between cluster
+// nodes so volumes on a cluster shared volume are accessible from the whole cluster rather than a single host.
+const topologyClusterKey = "topology." + DriverName + "/cluster"
+
+const clusterSharedVolumeRoot = "C:\\ClusterStorage\\"
+
+// Hyper-V cmdlets fail with a VirtualizationException while a VM is live migrating between owners
+const virtualizationException = "VirtualizationException"
+const clusterRetryAttempts = 5
+const clusterRetryDelay = 2 * time.Second
+
+// ClusterConfig enables failover cluster mode. The controller's WinrmClient connects to the cluster name
+// and VM specific commands run on the VM's current owner node through a client from NodeClient.
+type ClusterConfig struct {
+	// NodeClient creates a client for a cluster node by host name
+	NodeClient func(node string) (RemotePowerShellRunner, error)
+
+	// discovered is set by DiscoverCluster, which health checks retry while RPCs are running
+	discovered  atomic.Pointer[discoveredCluster]
+	nodeClients sync.Map
+}
+
+type discoveredCluster struct {
+	name string
+	// volumePath is the cluster shared volume directory used when VolumePath isn't configured
+	volumePath string
+}
+
+// clusterRetryWait is a variable so tests don't have to wait out retries
+var clusterRetryWait = func(ctx context.Context, attempt int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(clusterRetryDelay * time.Duration(1<<attempt)):
+		return nil
+	}
+}
+
+func (s *HypervCsiController) clusterMode() bool {
+	return s.Cluster != nil
+}
+
+// clusterTopology is the topology of a failover cluster's volumes and nodes. Topology values are compared case
+// sensitively, the name is lowercased so HV_CLUSTER_NAME only has to match Get-Cluster's name ignoring case.
+func clusterTopology(name string) *csi.Topology {
+	return &csi.Topology{Segments: map[string]string{topologyClusterKey: strings.ToLower(name)}}
+}
+
+// clusterName is the failover cluster's name, or empty until it's been discovered
+func (s *HypervCsiController) clusterName() string {
+	if discovered := s.Cluster.discovered.Load(); discovered != nil {
+		return discovered.name
+	}
+	return ""
+}
+
+// volumePath is the default pool's directory. In cluster mode without a VolumePath it's empty until
+// a cluster shared volume has been discovered.
+func (s *HypervCsiController) volumePath() string {
+	if s.VolumePath != "" || !s.clusterMode() {
+		return s.VolumePath
+	}
+	if discovered := s.Cluster.discovered.Load(); discovered != nil {
+		return discovered.volumePath
+	}
+	return ""
+}
+
+// DiscoverCluster looks up the failover cluster name and, when no volume path was configured, the first
+// cluster shared volume to keep volumes on
+func (s *HypervCsiController) DiscoverCluster(ctx context.Context) error {
+	cluster, err := s.backend().ClusterInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if cluster.Name == "" {
+		return errors.New("host isn't part of a failover cluster")
+	}
+
+	discovered := &discoveredCluster{name: cluster.Name, volumePath: s.VolumePath}
+	if discovered.volumePath == "" {
+		if len(cluster.SharedVolumes) == 0 {
+			return errors.New("failover cluster has no cluster shared volumes")
+		}
+		discovered.volumePath = cluster.SharedVolumes[0] + "\\Hyper-V\\Virtual Hard Disks"
+	}
+	// Volumes anywhere else are only reachable from one node and break when the VM migrates
+	directories := []string{discovered.volumePath}
+	for _, directory := range s.Pools {
+		directories = append(directories, directory)
+	}
+	for _, directory := range directories {
+		if !strings.HasPrefix(strings.ToLower(directory), strings.ToLower(clusterSharedVolumeRoot)) {
+			return fmt.Errorf("volume path %s isn't on a cluster shared volume", directory)
+		}
+	}
+
+	s.Cluster.discovered.Store(discovered)
+	klog.InfoS("using failover cluster", "cluster", cluster.Name, "volumePath", discovered.volumePath)
+	return nil
+}
+
+func (b *powerShellBackend) clusterNodeClient(node string) (RemotePowerShellRunner, error) {
+	if client, ok := b.cluster.nodeClients.Load(strings.ToLower(node)); ok {
+		return client.(RemotePowerShellRunner), nil
+	}
+	client, err := b.cluster.NodeClient(node)
+	if err != nil {
+		return nil, err
+	}
+	b.cluster.nodeClients.Store(strings.ToLower(node), client)
+	return client, nil
+}
+
+// vmOwnerClient returns a client for the cluster node currently running a VM
+func (b *powerShellBackend) vmOwnerClient(ctx context.Context, vmName string) (RemotePowerShellRunner, error) {
+	if b.cluster == nil {
+		return b.runner, nil
+	}
+
+	result := b.psRun(idempotent(ctx), fmt.Sprintf("(Get-ClusterGroup -Name %s).OwnerNode.Name", psQuote(vmName)))
+	if result.ExitCode != 0 && result.Error == nil {
+		result.Error = errors.New("powershell error")
+	}
+	if result.Error != nil {
+		klog.ErrorS(result.Error, "couldn't find vm owner node", "vm", vmName, "output", result.Output)
+		return nil, result.Error
+	}
+
+	owner := strings.Trim(result.Output, "\r\n\t ")
+	klog.V(4).InfoS("resolved vm owner", "vm", vmName, "owner", owner)
+	return b.clusterNodeClient(owner)
+}
+
+// psRunOnVMHost runs a command on whichever host runs the VM, retrying while a cluster VM is migrating
+func (b *powerShellBackend) psRunOnVMHost(ctx context.Context, vmName string, cmd string) ExecResult {
+	for attempt := 0; ; attempt++ {
+		client, err := b.vmOwnerClient(ctx, vmName)
+		if err != nil {
+			return ExecResult{ExitCode: -1, Error: err}
+		}
+
+		result := b.psRunWith(ctx, client, cmd)
+		if b.cluster == nil || !strings.Contains(result.Output, virtualizationException) || attempt+1 >= clusterRetryAttempts {
+			return result
+		}
+
+		klog.InfoS("vm may be migrating, retrying", "vm", vmName, "attempt", attempt+1, "output", result.Output)
+		if err = clusterRetryWait(ctx, attempt); err != nil {
+			return ExecResult{ExitCode: -1, Output: result.Output, Error: err}
+		}
+	}
+}
+
+// psRunOnEachHost runs a command on every host that can run VMs, that's every cluster node that's up in cluster mode
+func (b *powerShellBackend) psRunOnEachHost(ctx context.Context, cmd string) []ExecResult {
+	if b.cluster == nil {
+		return []ExecResult{b.psRun(ctx, cmd)}
+	}
+
+	result := b.psRun(idempotent(ctx), "(Get-ClusterNode | Where-Object {$_.State -eq 'Up'}).Name")
+	if result.ExitCode != 0 || result.Error != nil {
+		if result.Error == nil {
+			result.Error = errors.New("powershell error")
+		}
+		return []ExecResult{result}
+	}
+
+	results := make([]ExecResult, 0)
+	for _, node := range strings.Split(result.Output, "\n") {
+		if node = strings.Trim(node, "\r\n\t "); node == "" {
+			continue
+		}
+		client, err := b.clusterNodeClient(node)
+		if err != nil {
+			results = append(results, ExecResult{ExitCode: -1, Error: err})
+			continue
+		}
+		results = append(results, b.psRunWith(ctx, client, cmd))
+	}
+	return results
+}
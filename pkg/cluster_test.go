@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync"
+	"testing"
+)
+
+// funcWinRmClient answers each command with a function of the (encoded) command text
+type funcWinRmClient func(command string) (int, string)
+
+func (f funcWinRmClient) RunWithContext(ctx context.Context, command string, stdout, stderr io.Writer) (int, error) {
+	rc, output := f(command)
+	stdout.Write([]byte(output))
+	return rc, nil
+}
+
+// newClusterController answers commands sent to the cluster name with owners in turn, repeating the last one
+func newClusterController(t *testing.T, owners []string, nodes map[string]funcWinRmClient) *HypervCsiController {
+	ownerLookups := 0
+	clusterName := funcWinRmClient(func(command string) (int, string) {
+		owner := owners[ownerLookups]
+		if ownerLookups < len(owners)-1 {
+			ownerLookups++
+		}
+		return 0, owner
+	})
+
+	originalWait := clusterRetryWait
+	t.Cleanup(func() { clusterRetryWait = originalWait })
+	clusterRetryWait = func(ctx context.Context, attempt int) error { return nil }
+	controller := &HypervCsiController{
+		WinrmClient: clusterName,
+		VolumePath:  "C:\\ClusterStorage\\Volume1",
+		Cluster: &ClusterConfig{
+			NodeClient: func(node string) (RemotePowerShellRunner, error) {
+				client, ok := nodes[node]
+				assert.True(t, ok, "unexpected node %s", node)
+				return client, nil
+			},
+		},
+	}
+	controller.Cluster.discovered.Store(&discoveredCluster{name: "hvcluster", volumePath: controller.VolumePath})
+	return controller
+}
+
+func Test_psRunOnVMHostRetriesMigratingVM(t *testing.T) {
+	calls := map[string]int{}
+	nodes := map[string]funcWinRmClient{
+		"hv01": func(command string) (int, string) {
+			calls["hv01"]++
+			return 1, "Add-VMHardDiskDrive : ... VirtualizationException"
+		},
+		"hv02": func(command string) (int, string) {
+			calls["hv02"]++
+			return 0, ""
+		},
+	}
+	controller := newClusterController(t, []string{"hv01", "hv02"}, nodes)
+
+	result := controller.backend().(*powerShellBackend).psRunOnVMHost(context.Background(), "kube01", "Add-VMHardDiskDrive")
+
+	assert.Equal(t, 0, result.ExitCode)
+	assert.Equal(t, map[string]int{"hv01": 1, "hv02": 1}, calls)
+}
+
+func Test_psRunOnVMHostGivesUp(t *testing.T) {
+	calls := 0
+	nodes := map[string]funcWinRmClient{
+		"hv01": func(command string) (int, string) {
+			calls++
+			return 1, "VirtualizationException"
+		},
+	}
+	controller := newClusterController(t, []string{"hv01"}, nodes)
+
+	result := controller.backend().(*powerShellBackend).psRunOnVMHost(context.Background(), "kube01", "Add-VMHardDiskDrive")
+
+	assert.Equal(t, 1, result.ExitCode)
+	assert.Equal(t, clusterRetryAttempts, calls)
+}
+
+func Test_CreateVolumeClusterTopology(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	hyperv.SetCluster(ClusterInfo{Name: "hvcluster", SharedVolumes: []string{"C:\\ClusterStorage\\Volume1"}})
+	controller.VolumePath = ""
+	controller.Cluster = &ClusterConfig{}
+	assert.NoError(t, controller.DiscoverCluster(context.Background()))
+	assert.Equal(t, "C:\\ClusterStorage\\Volume1\\Hyper-V\\Virtual Hard Disks", controller.volumePath())
+
+	response, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-eab72431-5d15-4152-a8d1-5cf4ea41627e",
+		VolumeCapabilities: singleNodeWriter,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*csi.Topology{{Segments: map[string]string{topologyClusterKey: "hvcluster"}}}, response.Volume.AccessibleTopology)
+}
+
+func Test_ClusterTopologyMatchesNode(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	hyperv.SetCluster(ClusterInfo{Name: "HVCluster", SharedVolumes: []string{"C:\\ClusterStorage\\Volume1"}})
+	controller.VolumePath = ""
+	controller.Cluster = &ClusterConfig{}
+	ctx := context.Background()
+	request := &csi.CreateVolumeRequest{Name: "pvc-eab72431-5d15-4152-a8d1-5cf4ea41627e", VolumeCapabilities: singleNodeWriter}
+
+	// Without the cluster's name the volume couldn't be scheduled anywhere
+	_, err := controller.CreateVolume(ctx, request)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	require.NoError(t, controller.DiscoverCluster(ctx))
+	response, err := controller.CreateVolume(ctx, request)
+	require.NoError(t, err)
+	t.Setenv("HV_CLUSTER_NAME", "hvcluster")
+	node, err := (&HypervCsiDriver{NodeId: "kube01", DevicePath: t.TempDir()}).NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err)
+
+	assert.Equal(t, node.AccessibleTopology.Segments, response.Volume.AccessibleTopology[0].Segments)
+}
+
+func Test_DiscoverClusterRejectsLocalPool(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	hyperv.SetCluster(ClusterInfo{Name: "hvcluster", SharedVolumes: []string{"C:\\ClusterStorage\\Volume1"}})
+	controller.Cluster = &ClusterConfig{}
+
+	assert.ErrorContains(t, controller.DiscoverCluster(context.Background()), "isn't on a cluster shared volume")
+}
+
+func Test_DiscoverClusterWhileServing(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	hyperv.SetCluster(ClusterInfo{Name: "hvcluster", SharedVolumes: []string{"C:\\ClusterStorage\\Volume1"}})
+	controller.VolumePath = ""
+	controller.Cluster = &ClusterConfig{}
+	ctx := context.Background()
+
+	// Discovery failed at startup, so Probe discovers the cluster while RPCs are served. Run with -race.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		controller.Probe(ctx, &csi.ProbeRequest{})
+	}()
+	go func() {
+		defer wg.Done()
+		controller.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "pvc-eab72431-5d15-4152-a8d1-5cf4ea41627e", VolumeCapabilities: singleNodeWriter})
+	}()
+	wg.Wait()
+
+	assert.Equal(t, "hvcluster", controller.clusterName())
+	assert.Equal(t, "C:\\ClusterStorage\\Volume1\\Hyper-V\\Virtual Hard Disks", controller.volumePath())
+}
@@ -1,159 +1,250 @@
 package pkg
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"encoding/xml"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/go-xmlfmt/xmlfmt"
-	"github.com/gofrs/uuid"
-	"github.com/masterzen/winrm"
-	dotnetxml "github.com/nijave/hyperv-csi/dotnet-xml"
-	"github.com/sergeymakinen/go-quote/windows"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/types/known/wrapperspb"
-	"io"
 	"k8s.io/klog/v2"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 )
 
-type remotePowerShellRunner interface {
-	RunWithContext(context.Context, string, io.Writer, io.Writer) (int, error)
-}
-
 type HypervCsiController struct {
 	csi.IdentityServer
 	csi.ControllerServer
-	WinrmClient remotePowerShellRunner
+	WinrmClient RemotePowerShellRunner
 	VolumePath  string
+	// Pools are additional named directories volumes can be placed in, VolumePath is the default pool
+	Pools map[string]string
+	// Cluster is set when WinrmClient connects to a Hyper-V failover cluster
+	Cluster *ClusterConfig
+	// Backend talks to Hyper-V, it defaults to running PowerShell through WinrmClient
+	Backend HypervBackend
+	// VolumePrefix starts the file name of every volume's VHDX, it defaults to pv-
+	VolumePrefix string
+	// DefaultCapacity in bytes is used when a request doesn't ask for a size, it defaults to 20GiB
+	DefaultCapacity int64
+	// ClusterId identifies the Kubernetes cluster when several share a host, volumes tagged by other
+	// clusters are left alone
+	ClusterId string
+	// NameTemplate renders a readable name new volume IDs start with, see ParseVolumeNameTemplate
+	NameTemplate *template.Template
+	// SoftDelete makes DeleteVolume move volumes to the trash, see RestoreVolume
+	SoftDelete bool
+	// TrashRetention is how long soft deleted volumes are kept, they're kept until purged by hand when it's zero
+	TrashRetention time.Duration
+
+	backendOnce sync.Once
+	poolLock    sync.Mutex
+	// volumeLocks rejects concurrent operations on a volume, or on a request name for CreateVolume
+	volumeLocks operationLocks
+	// vmLocks serializes attach and detach on each VM
+	vmLocks serialLocks
+	health  healthCache
+	// prefixClaimed is set once ClaimVolumePrefix succeeds
+	prefixClaimed atomic.Bool
 }
 
-const driverName = "hyperv-csi.nijave.github.com"
+// DriverName is the name PersistentVolumes refer to the driver by
+const DriverName = "hyperv-csi.nijave.github.com"
 const driverVersion = "1.0.0"
 const defaultCapacity = 20 // GB
 const volumeFilePrefix = "pv-"
 
-const CliXmlPrefix = "#< CLIXML"
+// tempVolumePrefix starts the name of a volume CreateVolume hasn't renamed to its ID yet
+const tempVolumePrefix = "temp-"
 
-func psCommand(cmd string) string {
-	cmd = winrm.Powershell(cmd)
-	return strings.Replace(cmd, "powershell.exe", "powershell.exe -NoProfile", 1)
-}
+// readOnlyChildInfix separates a volume ID from the node ID in the file name of
+// a per-node differencing disk, e.g. pv-<volume id>.node-<node id>.vhdx
+const readOnlyChildInfix = ".node-"
 
-type PSRemoteObjects struct {
-	XMLName xml.Name `xml:"Objs"`
-	Objects []string `xml:"S"`
+const publishContextDiskIdentifier = "diskIdentifier"
+const publishContextReadOnly = "readonly"
+
+func (s *HypervCsiController) backend() HypervBackend {
+	s.backendOnce.Do(func() {
+		if s.Backend == nil {
+			s.Backend = newPowerShellBackend(s.WinrmClient, s.Cluster)
+		}
+	})
+	return s.Backend
 }
 
-func parseCliXml(xmlString string) string {
-	xmlString = strings.Trim(xmlString, "\r\n\t ")
-	if !strings.HasPrefix(xmlString, CliXmlPrefix) {
-		return xmlString
-	} else {
-		xmlString = strings.TrimPrefix(xmlString, CliXmlPrefix)
+func (s *HypervCsiController) volumePrefix() string {
+	if s.VolumePrefix == "" {
+		return volumeFilePrefix
 	}
+	return s.VolumePrefix
+}
 
-	var psRemoteObjects PSRemoteObjects
-	err := xml.Unmarshal([]byte(xmlString), &psRemoteObjects)
+func (s *HypervCsiController) readOnlyChildPath(directory string, volumeId string, nodeId string) string {
+	return s.volumeFilePath(directory, volumeId+readOnlyChildInfix+nodeId, true)
+}
+
+// volumeExists reports whether a volume's base VHDX exists
+func (s *HypervCsiController) volumeExists(ctx context.Context, volumeId string) (bool, error) {
+	directory, err := s.volumeDirectory(ctx, volumeId)
 	if err != nil {
-		klog.Warning("couldn't unmarshal Powershell objects")
-		return xmlfmt.FormatXML(xmlString, "", "  ", false)
+		return false, err
 	}
-
-	output := strings.Builder{}
-	for _, str := range psRemoteObjects.Objects {
-		output.WriteString(strings.Replace(dotnetxml.DecodeName(str), "\r\n", "\n", -1))
+	_, err = s.backend().GetVHD(ctx, s.volumeFilePath(directory, volumeId, true))
+	if errors.Is(err, ErrVHDNotFound) {
+		return false, nil
 	}
-
-	return strings.Trim(output.String(), "\r\n\t ")
-}
-
-type ExecResult struct {
-	ExitCode int
-	Output   string
-	Error    error
+	return err == nil, err
 }
 
-func (s *HypervCsiController) psRun(ctx context.Context, cmd string) ExecResult {
-	var bytesOut bytes.Buffer
-	klog.V(8).InfoS("ps command", "command", cmd)
-	exit, err := s.WinrmClient.RunWithContext(ctx, psCommand(cmd), &bytesOut, &bytesOut)
-	psOutput := strings.Trim(bytesOut.String(), "\r\n\t ")
-	klog.V(8).InfoS("ps raw output", "rc", exit, "output", psOutput)
-	psOutput = parseCliXml(psOutput)
-
-	return ExecResult{
-		ExitCode: exit,
-		Output:   psOutput,
-		Error:    err,
+func supportedAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	default:
+		return false
 	}
 }
 
-func (s *HypervCsiController) makeVolumePath(name string, withExtension bool) string {
-	extension := ""
-	if withExtension {
-		extension = ".vhdx"
+// healthChecks are what the controller needs from the Hyper-V host
+func (s *HypervCsiController) healthChecks() []healthCheck {
+	checks := []healthCheck{
+		{name: "winrm", check: s.backend().Ping},
+		{name: "hyper-v module", check: s.backend().CheckHyperV},
 	}
-	return windows.PSSingleQuote.Quote(s.VolumePath + "\\" + volumeFilePrefix + name + extension)
+	if s.clusterMode() {
+		// Discovery fails when the controller starts while the cluster is down
+		checks = append(checks, healthCheck{name: "failover cluster", check: func(ctx context.Context) error {
+			if s.clusterName() != "" {
+				return nil
+			}
+			return s.DiscoverCluster(ctx)
+		}})
+	}
+	checks = append(checks, healthCheck{name: "volume path", check: func(ctx context.Context) error {
+		for _, directory := range s.poolDirectories() {
+			if err := s.backend().CheckDirectory(ctx, directory); err != nil {
+				return fmt.Errorf("%s: %w", directory, err)
+			}
+		}
+		return nil
+	}})
+	checks = append(checks, healthCheck{name: "volume prefix", check: func(ctx context.Context) error {
+		if s.prefixClaimed.Load() {
+			return nil
+		}
+		return s.ClaimVolumePrefix(ctx)
+	}})
+	return checks
 }
 
 // IdentityServer
 func (s *HypervCsiController) Probe(ctx context.Context, request *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	logRequest("identity probe", request)
-	return &csi.ProbeResponse{Ready: &wrapperspb.BoolValue{Value: true}}, nil
+	return s.health.probe(ctx, s.healthChecks())
 }
 
 func (s *HypervCsiController) GetPluginInfo(ctx context.Context, request *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	logRequest("identity plugin info", request)
 	return &csi.GetPluginInfoResponse{
-		Name:          driverName,
+		Name:          DriverName,
 		VendorVersion: driverVersion,
 	}, nil
 }
 
 func (s *HypervCsiController) GetPluginCapabilities(ctx context.Context, request *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	logRequest("identity plugin capabilities", request)
-
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+	capabilities := []*csi.PluginCapability{
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 				},
 			},
 		},
+		{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+					Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+				},
+			},
+		},
+	}
+	if s.clusterMode() {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
+
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: capabilities,
 	}, nil
 }
 
 // ControllerServer
 func (s *HypervCsiController) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	logRequest("listing volumes", request)
-
-	listCommand := fmt.Sprintf("Get-Item %s | Select Name", s.makeVolumePath(volumeFilePrefix+"*", true))
-	result := s.psRun(ctx, listCommand)
+	if request.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max entries can't be negative")
+	}
+	if request.StartingToken != "" && !validVolumeId(request.StartingToken) {
+		return nil, status.Errorf(codes.Aborted, "invalid starting token %q", request.StartingToken)
+	}
 
-	if result.ExitCode != 0 || result.Error != nil {
-		if result.Error == nil {
-			result.Error = errors.New("powershell error")
+	volumeFiles, err := s.backend().ListDisks(ctx, s.poolDirectories(), s.volumePrefix())
+	if err != nil {
+		return nil, err
+	}
+	volumesMetadata, err := s.listVolumeMetadata(ctx)
+	if err != nil {
+		// Ownership can't be told without it, the Kubernetes names are only informational
+		if s.ClusterId != "" {
+			return nil, err
 		}
-		klog.ErrorS(result.Error, "error listing volumes", "exitCode", result.ExitCode, "output", result.Output)
-		return nil, result.Error
+		klog.ErrorS(err, "couldn't read volume metadata, listing volumes without it")
+		volumesMetadata = map[string]*volumeMetadata{}
+	}
+	foreign := s.foreignIn(volumesMetadata)
+	if request.StartingToken == "" {
+		s.updateProvisionedBytes(ctx)
 	}
 
-	volumeFiles := strings.Split(result.Output, "\r")
-	volumeList := make([]*csi.ListVolumesResponse_Entry, len(volumeFiles))
-	for i, volumeFile := range volumeFiles {
-		volumeList[i] = &csi.ListVolumesResponse_Entry{
+	volumeList := make([]*csi.ListVolumesResponse_Entry, 0, len(volumeFiles))
+	volumeEntries := map[string]*csi.ListVolumesResponse_Entry{}
+	readOnlyChildren := map[string][]string{}
+	for _, volumeFile := range volumeFiles {
+		volumeId := strings.TrimPrefix(strings.TrimSuffix(volumeFile, ".vhdx"), s.volumePrefix())
+
+		parentId, nodeId, isChild := strings.Cut(volumeId, readOnlyChildInfix)
+		if _, ok := foreign[parentId]; ok {
+			continue
+		}
+		// Leftovers of failed CreateVolume calls aren't volumes, the reconciler cleans them up
+		if strings.HasPrefix(volumeId, tempVolumePrefix) {
+			continue
+		}
+		// Per-node differencing disks of read-only-many volumes aren't volumes themselves
+		if isChild {
+			readOnlyChildren[parentId] = append(readOnlyChildren[parentId], nodeId)
+			continue
+		}
+
+		var volumeContext map[string]string
+		if metadata, ok := volumesMetadata[volumeId]; ok {
+			volumeContext = metadata.volumeContext()
+		}
+		entry := &csi.ListVolumesResponse_Entry{
 			Volume: &csi.Volume{
-				VolumeId:           strings.TrimPrefix(strings.TrimSuffix(volumeFile, ".vhdx"), volumeFilePrefix),
+				VolumeId:           volumeId,
 				CapacityBytes:      0,
-				VolumeContext:      nil,
+				VolumeContext:      volumeContext,
 				ContentSource:      nil,
 				AccessibleTopology: nil,
 			},
@@ -162,17 +253,36 @@ func (s *HypervCsiController) ListVolumes(ctx context.Context, request *csi.List
 				VolumeCondition:  nil, // OPTIONAL
 			},
 		}
+		volumeEntries[volumeId] = entry
+		volumeList = append(volumeList, entry)
+	}
+
+	for parentId, nodeIds := range readOnlyChildren {
+		if entry, ok := volumeEntries[parentId]; ok {
+			entry.Status.PublishedNodeIds = nodeIds
+		}
+	}
+
+	// Pages are ordered by volume ID and the token is the last ID returned so volumes
+	// created or deleted between pages don't shift the remaining pages
+	sort.Slice(volumeList, func(i, j int) bool { return volumeList[i].Volume.VolumeId < volumeList[j].Volume.VolumeId })
+	if request.StartingToken != "" {
+		start := sort.Search(len(volumeList), func(i int) bool { return volumeList[i].Volume.VolumeId > request.StartingToken })
+		volumeList = volumeList[start:]
+	}
+	nextToken := ""
+	if request.MaxEntries > 0 && int(request.MaxEntries) < len(volumeList) {
+		volumeList = volumeList[:request.MaxEntries]
+		nextToken = volumeList[len(volumeList)-1].Volume.VolumeId
 	}
 
 	return &csi.ListVolumesResponse{
 		Entries:   volumeList,
-		NextToken: "", // TODO pagination
+		NextToken: nextToken,
 	}, nil
 }
 
 func (s *HypervCsiController) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	logRequest("creating volume", request)
-
 	response := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:           "",
@@ -183,20 +293,69 @@ func (s *HypervCsiController) CreateVolume(ctx context.Context, request *csi.Cre
 		},
 	}
 
-	if len(request.VolumeCapabilities) > 0 {
-		if request.VolumeCapabilities[0].AccessMode.GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			capabilities := make([]string, len(request.VolumeCapabilities))
-			for _, capability := range request.VolumeCapabilities {
-				capabilities = append(capabilities, capability.String())
-			}
-			klog.InfoS("unsupported capabilities", "capabilities", strings.Join(capabilities, ","))
+	if request.Name == "" {
+		return response, status.Error(codes.InvalidArgument, "volume name is required")
+	}
+	if len(request.VolumeCapabilities) == 0 {
+		return response, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+	for _, capability := range request.VolumeCapabilities {
+		if !supportedAccessMode(capability.GetAccessMode().GetMode()) {
+			klog.InfoS("unsupported capabilities", "capability", capability.String())
 			return response, status.Error(codes.InvalidArgument, "")
 		}
 	}
+	if err := checkMutableParameters(request.MutableParameters); err != nil {
+		return response, err
+	}
+
+	metadata := &volumeMetadata{
+		Name:         request.Name,
+		ClusterId:    s.ClusterId,
+		PVCName:      request.Parameters[parameterPVCName],
+		PVCNamespace: request.Parameters[parameterPVCNamespace],
+		PVName:       request.Parameters[parameterPVName],
+	}
+	response.Volume.VolumeContext = metadata.volumeContext()
+	if encrypted, ok := request.Parameters[volumeParameterEncrypted]; ok {
+		if isEncrypted, err := strconv.ParseBool(encrypted); err != nil {
+			return response, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q", volumeParameterEncrypted, encrypted)
+		} else if isEncrypted {
+			// The node does the actual encryption so it needs to know about it when publishing
+			if response.Volume.VolumeContext == nil {
+				response.Volume.VolumeContext = map[string]string{}
+			}
+			response.Volume.VolumeContext[volumeParameterEncrypted] = "true"
+		}
+	}
 
-	var capacity int64
-	capacity = defaultCapacity * 1024 * 1024 * 1024
+	qos, err := parseVolumeQoS(request.Parameters, nil)
+	if err != nil {
+		return response, err
+	}
+	// VolumeAttributesClass parameters take precedence over the StorageClass
+	if metadata.QoS, err = parseVolumeQoS(request.MutableParameters, qos); err != nil {
+		return response, err
+	}
+
+	pool := request.Parameters[volumeParameterPool]
+	if mutablePool, ok := request.MutableParameters[volumeParameterPool]; ok {
+		pool = mutablePool
+	}
+	poolDirectory, err := s.poolDirectory(pool)
+	if err != nil {
+		return response, err
+	}
+
+	capacity := s.DefaultCapacity
+	if capacity == 0 {
+		capacity = defaultCapacity * 1024 * 1024 * 1024
+	}
 	if request.CapacityRange != nil {
+		if request.CapacityRange.LimitBytes < 0 || request.CapacityRange.RequiredBytes < 0 ||
+			(request.CapacityRange.LimitBytes > 0 && request.CapacityRange.RequiredBytes > request.CapacityRange.LimitBytes) {
+			return response, status.Error(codes.OutOfRange, "invalid capacity range")
+		}
 		if request.CapacityRange.LimitBytes > 0 {
 			capacity = request.CapacityRange.LimitBytes
 		}
@@ -206,83 +365,157 @@ func (s *HypervCsiController) CreateVolume(ctx context.Context, request *csi.Cre
 	}
 
 	response.Volume.CapacityBytes = capacity
+	if s.clusterMode() {
+		// A volume without the cluster's topology couldn't be scheduled anywhere, Probe retries discovery
+		if s.clusterName() == "" {
+			return response, status.Error(codes.Unavailable, "failover cluster hasn't been discovered yet")
+		}
+		// Any VM in the cluster can reach a volume on a cluster shared volume
+		response.Volume.AccessibleTopology = []*csi.Topology{clusterTopology(s.clusterName())}
+	}
+
+	unlock, err := s.volumeLocks.acquire(request.Name)
+	if err != nil {
+		return response, err
+	}
+	defer unlock()
 
-	volumePath := s.makeVolumePath("temp-"+strings.Split(request.Name, "-")[1], true)
+	// Idempotence, the request name is kept in the volume's metadata
+	existingId, err := s.findVolumeByName(ctx, request.Name)
+	if err != nil {
+		return response, err
+	}
+	if existingId != "" {
+		return s.existingVolume(ctx, request, response, existingId)
+	}
+
+	// Make a temp volume based on the request name and rename it to the VHD's GUID. Attached VHD can be located by last portion of GUID on host
+	tempName := fmt.Sprintf("%s%x", tempVolumePrefix, sha256.Sum256([]byte(request.Name)))[:len(tempVolumePrefix)+16]
+	volumePath := s.volumeFilePath(poolDirectory, tempName, true)
 	klog.InfoS("creating volume", "path", volumePath, "size", capacity)
-	// Make a temp volume based on the request ID and rename it to the VHD's GUID. Attached VHD can be located by last portion of GUID on host
-	createVolumeCommand := fmt.Sprintf(`$p = %s; $id = (New-VHD -Path $p -SizeBytes %d -Dynamic).DiskIdentifier.ToLower(); Move-Item $p (Join-Path -Path (Split-Path -Parent $p) -ChildPath "%s${id}.vhdx"); echo $id`, volumePath, capacity, volumeFilePrefix)
-	result := s.psRun(ctx, createVolumeCommand)
+	// A previous attempt may have stopped before the rename
+	vhds, err := s.backend().GetVHD(ctx, volumePath)
+	if err != nil && !errors.Is(err, ErrVHDNotFound) {
+		return response, err
+	}
+	var vhd VHD
+	if len(vhds) > 0 {
+		vhd = vhds[0]
+	} else if vhd, err = s.backend().CreateVHD(ctx, volumePath, capacity); err != nil {
+		return response, err
+	}
+	// The name is written before the rename so a volume can always be found by its request name
+	if err = s.writeVolumeMetadata(ctx, volumePath, metadata); err != nil {
+		return response, err
+	}
+	volumeId, err := s.newVolumeId(metadata, vhd.DiskIdentifier)
+	if err != nil {
+		return response, err
+	}
+	if err = s.setVolumePool(ctx, volumeId, pool); err != nil {
+		return response, err
+	}
+	if err = s.backend().MoveFile(ctx, volumePath, s.volumeFilePath(poolDirectory, volumeId, true)); err != nil {
+		return response, err
+	}
+	klog.InfoS("created volume", "volumeId", volumeId, "pvc", metadata.PVCNamespace+"/"+metadata.PVCName)
 
-	if result.ExitCode != 0 {
-		klog.Error(result.Output)
-		return response, errors.New(fmt.Sprintf("command failed with exit code %d", result.ExitCode))
-	} else {
-		klog.Info(result.Output)
+	response.Volume.VolumeId = volumeId
+	response.Volume.CapacityBytes = vhd.Size
+	return response, nil
+}
+
+// existingVolume answers a repeated CreateVolume request with the volume created the first time
+func (s *HypervCsiController) existingVolume(ctx context.Context, request *csi.CreateVolumeRequest, response *csi.CreateVolumeResponse, volumeId string) (*csi.CreateVolumeResponse, error) {
+	directory, err := s.volumeDirectory(ctx, volumeId)
+	if err != nil {
+		return response, err
+	}
+	vhds, err := s.backend().GetVHD(ctx, s.volumeFilePath(directory, volumeId, true))
+	if err != nil {
+		return response, err
 	}
 
-	hopefullyUuid := strings.Trim(result.Output, "\r\n")
-	if _, err := uuid.FromString(hopefullyUuid); err != nil {
-		psError := errors.New("unexpected New-VHD output. Expected parseable uuid")
-		klog.ErrorS(psError, "message", hopefullyUuid)
-		return nil, psError
+	size := vhds[0].Size
+	if size < request.GetCapacityRange().GetRequiredBytes() ||
+		(request.GetCapacityRange().GetLimitBytes() > 0 && size > request.GetCapacityRange().GetLimitBytes()) {
+		return response, status.Errorf(codes.AlreadyExists, "volume %s already exists with a different size", request.Name)
 	}
 
-	response.Volume.VolumeId = hopefullyUuid
-	return response, result.Error
+	klog.InfoS("volume already exists", "name", request.Name, "volumeId", volumeId)
+	response.Volume.VolumeId = volumeId
+	response.Volume.CapacityBytes = size
+	return response, nil
 }
 
 func (s *HypervCsiController) DeleteVolume(ctx context.Context, request *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	logRequest("deleting volume", request)
 	response := &csi.DeleteVolumeResponse{}
-
-	deleteCommand := psCommand(fmt.Sprintf("Remove-Item -Force (%s+\"*\")", s.makeVolumePath(request.VolumeId, false)))
-	result := s.psRun(ctx, deleteCommand)
-
-	if result.ExitCode != 0 {
-		err := errors.New("powershell error")
-		klog.ErrorS(err, "exitCode", result.ExitCode, "output", result.Output)
+	if request.VolumeId == "" {
+		return response, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	unlock, err := s.volumeLocks.acquire(request.VolumeId)
+	if err != nil {
 		return response, err
 	}
+	defer unlock()
 
-	if strings.Contains(result.Output, "failed to delete attached volume") {
-		klog.Errorf("volume %s not found in volume list", request.VolumeId)
-		return response, errors.New("powershell error")
+	if err = s.checkVolumeOwner(ctx, request.VolumeId); err != nil {
+		return response, err
+	}
+	if s.SoftDelete {
+		err = s.trashVolume(ctx, request.VolumeId)
+	} else {
+		var directory string
+		if directory, err = s.volumeDirectory(ctx, request.VolumeId); err != nil {
+			return response, err
+		}
+		var files []string
+		if files, err = s.volumeFiles(ctx, directory, request.VolumeId); err != nil {
+			return response, err
+		}
+		err = s.backend().DeleteFiles(ctx, files)
+	}
+	if err != nil {
+		if errors.Is(err, ErrDiskInUse) {
+			return response, status.Errorf(codes.FailedPrecondition, "volume %s is published", request.VolumeId)
+		}
+		return response, err
 	}
 
-	return response, result.Error
+	return response, s.setVolumePool(ctx, request.VolumeId, "")
 }
 
 func (s *HypervCsiController) ValidateVolumeCapabilities(ctx context.Context, request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	response := &csi.ValidateVolumeCapabilitiesResponse{
-		Confirmed: nil,
-		Message:   "",
+	if request.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if len(request.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+	exists, err := s.volumeExists(ctx, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", request.VolumeId)
 	}
 
-	responseCapabilities := make([]*csi.VolumeCapability, 0)
+	// Only confirm when every capability is supported
 	for _, capability := range request.VolumeCapabilities {
-		// Not sure if this is the right way to switch on capability...
-		switch capability.GetAccessMode().GetMode() {
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
-			responseCapabilities = append(responseCapabilities, &csi.VolumeCapability{
-				AccessMode: &csi.VolumeCapability_AccessMode{
-					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-				},
-				AccessType: &csi.VolumeCapability_Mount{
-					// All fields are optional
-					Mount: &csi.VolumeCapability_MountVolume{},
-				},
-			})
-		default:
+		if !supportedAccessMode(capability.GetAccessMode().GetMode()) || capability.GetBlock() != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: "unsupported capability " + capability.String(),
+			}, nil
 		}
 	}
 
-	response.Confirmed = &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-		VolumeCapabilities: responseCapabilities,
-		VolumeContext:      request.VolumeContext,
-		Parameters:         nil,
-	}
-
-	return response, nil
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeCapabilities: request.VolumeCapabilities,
+			VolumeContext:      request.VolumeContext,
+			Parameters:         request.Parameters,
+		},
+	}, nil
 }
 
 func (s *HypervCsiController) ControllerGetCapabilities(ctx context.Context, request *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -309,95 +542,334 @@ func (s *HypervCsiController) ControllerGetCapabilities(ctx context.Context, req
 					},
 				},
 			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
 		},
 	}
 	return response, nil
 }
 
-type vhdParentChild struct {
-	Vhd    string `json:"Path"`
-	Parent string `json:"ParentPath"`
-}
-
 func (s *HypervCsiController) ControllerPublishVolume(ctx context.Context, request *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	// TODO v1 attach VHD to VM (last one if there's snapshots...)
-	cmd := fmt.Sprintf("ConvertTo-Json @(Get-VHD (%s+\"*\") | Select ParentPath, Path)", s.makeVolumePath(request.VolumeId, false))
-	result := s.psRun(ctx, cmd)
-
-	if result.ExitCode != 0 {
-		klog.InfoS("powershell error", "output", result)
-		return nil, errors.New("powershell error")
+	if request.VolumeId == "" || request.NodeId == "" || request.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume id, node id and volume capability are required")
 	}
+	if !supportedAccessMode(request.VolumeCapability.GetAccessMode().GetMode()) {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported access mode %s", request.VolumeCapability.GetAccessMode().GetMode())
+	}
+	unlock, err := s.volumeLocks.acquire(request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	var parentChildList []vhdParentChild
-	err := json.Unmarshal([]byte(result.Output), &parentChildList)
+	directory, err := s.volumeDirectory(ctx, request.VolumeId)
 	if err != nil {
-		klog.Warning("couldn't unmarshal parent-child vhd list json")
-		klog.InfoS("json unmarshal error", "output", result)
 		return nil, err
 	}
-	parentChild := map[string]string{}
-	for _, vhd := range parentChildList {
-		parentChild[vhd.Parent] = vhd.Vhd
+	chain, err := s.volumeChain(ctx, directory, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.checkVolumeOwner(ctx, request.VolumeId); err != nil {
+		return nil, err
 	}
+
 	lastParent := ""
-	for {
-		nextParent, ok := parentChild[lastParent]
-		if !ok {
-			break
+	if len(chain) > 0 {
+		lastParent = chain[len(chain)-1].Path
+	}
+
+	publishContext := map[string]string{}
+	attachPath := lastParent
+	if request.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
+		// A VHDX can only be attached to one VM so seal the chain and give each node its own differencing child
+		attachPath = s.readOnlyChildPath(directory, request.VolumeId, request.NodeId)
+		klog.InfoS("creating read-only child vhd", "parent", lastParent, "child", attachPath, "node", request.NodeId)
+		if err = s.backend().SetReadOnly(ctx, lastParent); err != nil {
+			return nil, err
+		}
+		child, err := s.backend().CreateDifferencingVHD(ctx, attachPath, lastParent)
+		if err != nil {
+			return nil, err
 		}
-		lastParent = nextParent
+		publishContext[publishContextDiskIdentifier] = child.DiskIdentifier
+		publishContext[publishContextReadOnly] = "true"
 	}
-	klog.InfoS("attaching vhd", "vhd", lastParent, "node", request.NodeId)
-	// Add-VMHardDiskDrive -VMName vmubt2204kube04 -ControllerType SCSI -ControllerNumber 0 -Path "v:\\hyper-v\\virtual hard disks\\pvc-583055da-f7b4-474f-9bea-59d346c21509.vhdx"
-	cmd = fmt.Sprintf("Add-VMHardDiskDrive -VMName %s -ControllerType SCSI -ControllerNumber 0 -Path '%s'", request.NodeId, lastParent)
-	result = s.psRun(ctx, cmd)
 
-	// Idempotence
-	if strings.Contains(result.Output, "The disk is already connect to the virtual machine") {
-		result.ExitCode = 0
-		result.Error = nil
+	unlockVM, err := s.vmLocks.acquire(ctx, request.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockVM()
+	klog.InfoS("attaching vhd", "vhd", attachPath, "node", request.NodeId)
+	if err = s.backend().AttachDisk(ctx, request.NodeId, attachPath); err != nil {
+		switch {
+		case errors.Is(err, ErrVMNotFound):
+			return nil, status.Errorf(codes.NotFound, "node %s not found", request.NodeId)
+		case errors.Is(err, ErrDiskInUse):
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is published to another node", request.VolumeId)
+		case errors.Is(err, ErrNoFreeSlot):
+			return nil, status.Errorf(codes.ResourceExhausted, "node %s has no free scsi locations", request.NodeId)
+		}
+		return nil, err
 	}
 
-	if result.ExitCode != 0 && result.Error == nil {
-		result.Error = errors.New("powershell error")
+	// Hyper-V forgets drive QoS on detach so restore it from the volume
+	metadata, err := s.getVolumeMetadata(ctx, request.VolumeId)
+	if err != nil {
+		return nil, err
 	}
-	if result.Error != nil {
-		return nil, result.Error
+	if err = s.applyVolumeQoS(ctx, request.VolumeId, request.NodeId, metadata.QoS); err != nil {
+		return nil, err
 	}
 
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{},
+		PublishContext: publishContext,
 	}, nil
 }
 
 func (s *HypervCsiController) ControllerUnpublishVolume(ctx context.Context, request *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	// Get-VMHardDiskDrive -VMName vmubt2204kube04 | Where-Object {$_.Path -like "*pvc-583055da-f7b4-474f-9bea-59d346c21509*"} | Remove-VMHardDiskDrive
-	cmd := fmt.Sprintf("Get-VMHardDiskDrive -VMName %s | Where-Object {$_.Path -like \"*%s*\"} | Remove-VMHardDiskDrive", request.NodeId, request.VolumeId)
-	result := s.psRun(ctx, cmd)
-	if result.ExitCode != 0 && result.Error == nil {
-		result.Error = errors.New("powershell error")
+	if request.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	unlock, err := s.volumeLocks.acquire(request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	directory, err := s.volumeDirectory(ctx, request.VolumeId)
+	if err != nil {
+		return nil, err
 	}
-	if result.Error != nil {
-		return nil, result.Error
+
+	// No node ID means unpublish from every node
+	nodeIds := []string{request.NodeId}
+	if request.NodeId == "" {
+		attachments, err := s.backend().ListAttachments(ctx, request.VolumeId)
+		if err != nil {
+			return nil, err
+		}
+		nodeIds = nodeIds[:0]
+		for _, attachment := range attachments {
+			nodeIds = append(nodeIds, attachment.VMName)
+		}
+	}
+
+	for _, nodeId := range nodeIds {
+		if err = s.detachDisk(ctx, nodeId, request.VolumeId); err != nil && !errors.Is(err, ErrVMNotFound) {
+			return nil, err
+		}
+		// The node's read-only differencing child, if any, is only useful while attached so it's removed too
+		if err = s.backend().DeleteFile(ctx, s.readOnlyChildPath(directory, request.VolumeId, nodeId)); err != nil {
+			return nil, err
+		}
 	}
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
+// detachDisk detaches a volume from a VM once no other attach or detach is running on it
+func (s *HypervCsiController) detachDisk(ctx context.Context, nodeId string, volumeId string) error {
+	unlockVM, err := s.vmLocks.acquire(ctx, nodeId)
+	if err != nil {
+		return err
+	}
+	defer unlockVM()
+	// Get-VMHardDiskDrive -VMName vmubt2204kube04 | Where-Object {$_.Path -like "*pvc-583055da-f7b4-474f-9bea-59d346c21509*"} | Remove-VMHardDiskDrive
+	return s.backend().DetachDisk(ctx, nodeId, volumeId)
+}
+
 func (s *HypervCsiController) GetCapacity(ctx context.Context, request *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	// TODO v2
-	return nil, status.Error(codes.Unimplemented, "")
+	directory, err := s.poolDirectory(request.Parameters[volumeParameterPool])
+	if err != nil {
+		return nil, err
+	}
+	free, err := s.backend().FreeSpace(ctx, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: free,
+	}, nil
 }
 
+// ControllerExpandVolume grows a volume's VHDX, Resize-VHD works while it's attached. The node grows the partition,
+// crypt mapping and filesystem afterwards.
 func (s *HypervCsiController) ControllerExpandVolume(ctx context.Context, request *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	// TODO v2
-	return nil, status.Error(codes.Unimplemented, "")
+	if request.VolumeId == "" || request.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume id and capacity range are required")
+	}
+	required, limit := request.CapacityRange.RequiredBytes, request.CapacityRange.LimitBytes
+	if required <= 0 || limit < 0 || limit > 0 && required > limit {
+		return nil, status.Error(codes.OutOfRange, "invalid capacity range")
+	}
+	unlock, err := s.volumeLocks.acquire(request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	directory, err := s.volumeDirectory(ctx, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.volumeFiles(ctx, directory, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", request.VolumeId)
+	}
+	if err = s.checkVolumeOwner(ctx, request.VolumeId); err != nil {
+		return nil, err
+	}
+	// Differencing disks, checkpoints or read-only children, keep the size they were made with
+	if len(files) > 1 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s has differencing disks and can't be expanded", request.VolumeId)
+	}
+
+	vhds, err := s.backend().GetVHD(ctx, files[0])
+	if err != nil {
+		return nil, err
+	}
+	vhd := vhds[0]
+	if vhd.Size < required {
+		klog.InfoS("expanding volume", "volumeId", request.VolumeId, "from", vhd.Size, "to", required)
+		if vhd, err = s.backend().ResizeVHD(ctx, files[0], required); err != nil {
+			return nil, err
+		}
+	}
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: vhd.Size, NodeExpansionRequired: true}, nil
 }
 
 func (s *HypervCsiController) ControllerGetVolume(ctx context.Context, request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	// TODO v2
-	return nil, status.Error(codes.Unimplemented, "")
+	if request.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	directory, err := s.volumeDirectory(ctx, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	vhds, err := s.backend().GetVHD(ctx, s.volumeFilePath(directory, request.VolumeId, true))
+	if errors.Is(err, ErrVHDNotFound) {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", request.VolumeId)
+	} else if err != nil {
+		return nil, err
+	}
+	metadata, err := s.getVolumeMetadata(ctx, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	// ListVolumes doesn't return other clusters' volumes either, so to this cluster they don't exist
+	if s.ClusterId != "" && !s.ownsVolume(metadata) {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found, it belongs to cluster %q", request.VolumeId, metadata.ClusterId)
+	}
+	attachments, err := s.backend().ListAttachments(ctx, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	nodeIds := make([]string, 0, len(attachments))
+	for _, attachment := range attachments {
+		nodeIds = append(nodeIds, attachment.VMName)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      request.VolumeId,
+			CapacityBytes: vhds[0].Size,
+			VolumeContext: metadata.volumeContext(),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: nodeIds,
+		},
+	}, nil
+}
+
+// checkMutableParameters rejects VolumeAttributesClass parameters that can't be modified
+func checkMutableParameters(parameters map[string]string) error {
+	for key := range parameters {
+		switch key {
+		case volumeParameterMinimumIOPS, volumeParameterMaximumIOPS, volumeParameterQoSPolicyId, volumeParameterPool:
+		default:
+			return status.Errorf(codes.InvalidArgument, "parameter %s can't be modified", key)
+		}
+	}
+	return nil
+}
+
+func (s *HypervCsiController) ControllerModifyVolume(ctx context.Context, request *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	if request.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+
+	if err := checkMutableParameters(request.MutableParameters); err != nil {
+		return nil, err
+	}
+	unlock, err := s.volumeLocks.acquire(request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	exists, err := s.volumeExists(ctx, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", request.VolumeId)
+	}
+	if err = s.checkVolumeOwner(ctx, request.VolumeId); err != nil {
+		return nil, err
+	}
+
+	if pool, ok := request.MutableParameters[volumeParameterPool]; ok {
+		if err := s.MigrateVolume(ctx, request.VolumeId, pool); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata, err := s.getVolumeMetadata(ctx, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.QoS, err = parseVolumeQoS(request.MutableParameters, metadata.QoS); err != nil {
+		return nil, err
+	}
+	if err = s.setVolumeMetadata(ctx, request.VolumeId, metadata); err != nil {
+		return nil, err
+	}
+	if err = s.applyVolumeQoS(ctx, request.VolumeId, "", metadata.QoS); err != nil {
+		return nil, err
+	}
+
+	return &csi.ControllerModifyVolumeResponse{}, nil
 }
 
 func (s *HypervCsiController) ListSnapshots(ctx context.Context, request *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
@@ -5,7 +5,11 @@ import (
 	"errors"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -61,6 +65,20 @@ func Test_parseXmlCliTrailingCharacters(t *testing.T) {
 	assert.Equal(t, output, parseCliXml(input))
 }
 
+func Test_parseXmlCliPrimitives(t *testing.T) {
+	input := `#< CLIXML
+<Objs Version="1.1.0.1" xmlns="http://schemas.microsoft.com/powershell/2004/04">
+  <I32>1</I32>
+  <B>true</B>
+  <Db>2.5</Db>
+  <C>97</C>
+  <Obj RefId="0"><TN RefId="0"><T>System.Management.Automation.PSCustomObject</T></TN></Obj>
+  <Nil />
+  <S>done</S>
+</Objs>`
+	assert.Equal(t, "1\ntrue\n2.5\na\ndone", parseCliXml(input))
+}
+
 type mockWinRmClient struct {
 	ReturnCode int
 	Error      error
@@ -91,6 +109,36 @@ func newController() (*mockWinRmClient, *HypervCsiController) {
 	}
 }
 
+// newSimulatedController returns a controller backed by a simulated Hyper-V host running VMs kube01 and kube02
+func newSimulatedController() (*SimulatedHyperv, *HypervCsiController) {
+	hyperv := NewSimulatedHyperv()
+	hyperv.AddVM("kube01")
+	hyperv.AddVM("kube02")
+	return hyperv, &HypervCsiController{
+		VolumePath: "V:\\Hyper-V\\Virtual Hard Disks",
+		Backend:    hyperv,
+	}
+}
+
+var singleNodeWriter = []*csi.VolumeCapability{
+	{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	},
+}
+
+func createTestVolume(t *testing.T, controller *HypervCsiController, request *csi.CreateVolumeRequest) string {
+	if request.Name == "" {
+		request.Name = "pvc-eab72431-5d15-4152-a8d1-5cf4ea41627e"
+	}
+	if request.VolumeCapabilities == nil {
+		request.VolumeCapabilities = singleNodeWriter
+	}
+	response, err := controller.CreateVolume(context.Background(), request)
+	require.NoError(t, err)
+	return response.Volume.VolumeId
+}
+
 func Test_ListVolumesPowershellGenericError(t *testing.T) {
 	mockWinRm, controller := newController()
 	mockWinRm.ReturnCode = 1
@@ -133,3 +181,383 @@ func Test_ListVolumesValidOutput(t *testing.T) {
 		assert.Equal(t, vol, response.Entries[i].Volume.VolumeId)
 	}
 }
+
+func Test_ListVolumesReadOnlyChildren(t *testing.T) {
+	mockWinRm, controller := newController()
+	mockWinRm.Stdout = "pv-eab72431-5d15-4152-a8d1-5cf4ea41627e.vhdx\r" +
+		"pv-eab72431-5d15-4152-a8d1-5cf4ea41627e.node-kube01.vhdx\r" +
+		"pv-eab72431-5d15-4152-a8d1-5cf4ea41627e.node-kube02.vhdx\r"
+
+	response, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+
+	assert.Nil(t, err)
+	assert.Len(t, response.Entries, 1)
+	assert.Equal(t, "eab72431-5d15-4152-a8d1-5cf4ea41627e", response.Entries[0].Volume.VolumeId)
+	assert.ElementsMatch(t, []string{"kube01", "kube02"}, response.Entries[0].Status.PublishedNodeIds)
+}
+
+func Test_ListVolumesSkipsTempVolumes(t *testing.T) {
+	mockWinRm, controller := newController()
+	mockWinRm.Stdout = "pv-eab72431-5d15-4152-a8d1-5cf4ea41627e.vhdx\r" +
+		"pv-temp-0123456789abcdef.vhdx\r"
+
+	response, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+
+	assert.Nil(t, err)
+	assert.Len(t, response.Entries, 1)
+	assert.Equal(t, "eab72431-5d15-4152-a8d1-5cf4ea41627e", response.Entries[0].Volume.VolumeId)
+}
+
+func Test_CreateVolumeUnsupportedAccessMode(t *testing.T) {
+	_, controller := newController()
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-eab72431-5d15-4152-a8d1-5cf4ea41627e",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}},
+		},
+	})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func Test_IdentityRPCs(t *testing.T) {
+	_, controller := newSimulatedController()
+	ctx := context.Background()
+
+	probe, err := controller.Probe(ctx, &csi.ProbeRequest{})
+	assert.Nil(t, err)
+	assert.True(t, probe.Ready.Value)
+
+	info, err := controller.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, DriverName, info.Name)
+
+	capabilities, err := controller.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, capabilities.Capabilities, 2)
+	assert.Equal(t, csi.PluginCapability_Service_CONTROLLER_SERVICE, capabilities.Capabilities[0].GetService().Type)
+	assert.Equal(t, csi.PluginCapability_VolumeExpansion_ONLINE, capabilities.Capabilities[1].GetVolumeExpansion().Type)
+}
+
+func Test_ControllerGetCapabilities(t *testing.T) {
+	_, controller := newSimulatedController()
+
+	response, err := controller.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+
+	assert.Nil(t, err)
+	rpcs := make([]csi.ControllerServiceCapability_RPC_Type, 0)
+	for _, capability := range response.Capabilities {
+		rpcs = append(rpcs, capability.GetRpc().Type)
+	}
+	assert.Contains(t, rpcs, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME)
+	assert.Contains(t, rpcs, csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME)
+	assert.Contains(t, rpcs, csi.ControllerServiceCapability_RPC_GET_CAPACITY)
+	assert.Contains(t, rpcs, csi.ControllerServiceCapability_RPC_GET_VOLUME)
+	assert.Contains(t, rpcs, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
+}
+
+func Test_CreateVolumeSimulated(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+
+	response, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-eab72431-5d15-4152-a8d1-5cf4ea41627e",
+		VolumeCapabilities: singleNodeWriter,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+		Parameters:         map[string]string{volumeParameterEncrypted: "true"},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024*1024*1024), response.Volume.CapacityBytes)
+	assert.Equal(t, map[string]string{volumeParameterEncrypted: "true"}, response.Volume.VolumeContext)
+	vhds, err := hyperv.GetVHD(ctx, controller.volumeFilePath(controller.VolumePath, response.Volume.VolumeId, true))
+	require.NoError(t, err)
+	assert.Equal(t, response.Volume.VolumeId, vhds[0].DiskIdentifier)
+	assert.Equal(t, int64(1024*1024*1024), vhds[0].Size)
+
+	// The temp file was renamed
+	volumes, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	assert.Len(t, volumes.Entries, 1)
+	assert.Equal(t, response.Volume.VolumeId, volumes.Entries[0].Volume.VolumeId)
+}
+
+func Test_CreateVolumeResumesRename(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	request := &csi.CreateVolumeRequest{Name: "pvc-resumed", VolumeCapabilities: singleNodeWriter}
+
+	// The controller stops after writing the temp volume's metadata
+	hyperv.FailNext("MoveFile", errors.New("connection reset"))
+	_, err := controller.CreateVolume(ctx, request)
+	require.Error(t, err)
+
+	response, err := controller.CreateVolume(ctx, request)
+
+	require.NoError(t, err)
+	assert.False(t, strings.HasPrefix(response.Volume.VolumeId, tempVolumePrefix), response.Volume.VolumeId)
+	assert.Equal(t, 1, hyperv.Calls("CreateVHD"))
+	volumes, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	require.Len(t, volumes.Entries, 1)
+	assert.Equal(t, response.Volume.VolumeId, volumes.Entries[0].Volume.VolumeId)
+}
+
+func Test_CreateVolumeConfiguredDefaults(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	controller.VolumePrefix = "k8s-"
+	controller.DefaultCapacity = 5 * 1024 * 1024 * 1024
+	ctx := context.Background()
+
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+
+	vhds, err := hyperv.GetVHD(ctx, controller.VolumePath+"\\k8s-"+volumeId+".vhdx")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5*1024*1024*1024), vhds[0].Size)
+	volumes, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	require.Len(t, volumes.Entries, 1)
+	assert.Equal(t, volumeId, volumes.Entries[0].Volume.VolumeId)
+}
+
+func Test_CreateVolumeBackendFailure(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	hyperv.FailNext("MoveFile", errors.New("access denied"))
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-eab72431-5d15-4152-a8d1-5cf4ea41627e",
+		VolumeCapabilities: singleNodeWriter,
+	})
+
+	assert.ErrorContains(t, err, "access denied")
+}
+
+func Test_DeleteVolume(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+
+	_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+	assert.Nil(t, err)
+	_, err = hyperv.GetVHD(ctx, controller.volumeFilePath(controller.VolumePath, volumeId, false))
+	assert.ErrorIs(t, err, ErrVHDNotFound)
+
+	// Deleting a volume that's gone succeeds
+	_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+	assert.Nil(t, err)
+}
+
+func Test_DeleteVolumePublished(t *testing.T) {
+	_, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+	require.NoError(t, err)
+
+	_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func Test_ValidateVolumeCapabilities(t *testing.T) {
+	_, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+
+	response, err := controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volumeId,
+		VolumeCapabilities: singleNodeWriter,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, singleNodeWriter, response.Confirmed.VolumeCapabilities)
+
+	response, err = controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: volumeId,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			singleNodeWriter[0],
+			{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, response.Confirmed)
+
+	_, err = controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "eae2dc8f-a05f-4798-a2e7-2f4fc94353cf",
+		VolumeCapabilities: singleNodeWriter,
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_ControllerPublishVolume(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	request := &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]}
+
+	_, err := controller.ControllerPublishVolume(ctx, request)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{controller.volumeFilePath(controller.VolumePath, volumeId, true)}, hyperv.Attachments("kube01"))
+
+	// Idempotent
+	_, err = controller.ControllerPublishVolume(ctx, request)
+	assert.Nil(t, err)
+	assert.Len(t, hyperv.Attachments("kube01"), 1)
+
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube02", VolumeCapability: singleNodeWriter[0]})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func Test_ControllerPublishVolumeNotFound(t *testing.T) {
+	_, controller := newSimulatedController()
+	ctx := context.Background()
+
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "eab72431-5d15-4152-a8d1-5cf4ea41627e", NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube99", VolumeCapability: singleNodeWriter[0]})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_ControllerPublishVolumeNoFreeSlot(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	hyperv.FailNext("AttachDisk", ErrNoFreeSlot)
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func Test_ControllerPublishVolumeReadOnlyMany(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	readOnlyMany := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY}}
+
+	for _, node := range []string{"kube01", "kube02"} {
+		response, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: node, VolumeCapability: readOnlyMany})
+		require.NoError(t, err)
+		childPath := controller.readOnlyChildPath(controller.VolumePath, volumeId, node)
+		assert.Equal(t, []string{childPath}, hyperv.Attachments(node))
+
+		child, err := hyperv.GetVHD(ctx, childPath)
+		require.NoError(t, err)
+		assert.Equal(t, controller.volumeFilePath(controller.VolumePath, volumeId, true), child[0].ParentPath)
+		assert.Equal(t, child[0].DiskIdentifier, response.PublishContext[publishContextDiskIdentifier])
+		assert.Equal(t, "true", response.PublishContext[publishContextReadOnly])
+	}
+	assert.True(t, hyperv.IsReadOnly(controller.volumeFilePath(controller.VolumePath, volumeId, true)))
+
+	volumes, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"kube01", "kube02"}, volumes.Entries[0].Status.PublishedNodeIds)
+
+	_, err = controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01"})
+	require.NoError(t, err)
+	assert.Empty(t, hyperv.Attachments("kube01"))
+	_, err = hyperv.GetVHD(ctx, controller.readOnlyChildPath(controller.VolumePath, volumeId, "kube01"))
+	assert.ErrorIs(t, err, ErrVHDNotFound)
+}
+
+func Test_ControllerUnpublishVolume(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+	require.NoError(t, err)
+
+	request := &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01"}
+	_, err = controller.ControllerUnpublishVolume(ctx, request)
+	assert.Nil(t, err)
+	assert.Empty(t, hyperv.Attachments("kube01"))
+
+	// Idempotent, even once the VM is gone
+	_, err = controller.ControllerUnpublishVolume(ctx, request)
+	assert.Nil(t, err)
+	hyperv.RemoveVM("kube01")
+	_, err = controller.ControllerUnpublishVolume(ctx, request)
+	assert.Nil(t, err)
+}
+
+func Test_GetCapacity(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	controller.Pools = map[string]string{"fast": "F:\\fast"}
+	hyperv.SetFreeSpace("F:\\fast", 1234)
+
+	response, err := controller.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: map[string]string{volumeParameterPool: "fast"}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1234), response.AvailableCapacity)
+}
+
+func Test_ControllerExpandVolume(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024}})
+	// Resize-VHD works on attached disks
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+	require.NoError(t, err)
+
+	response, err := controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), response.CapacityBytes)
+	assert.True(t, response.NodeExpansionRequired)
+	vhds, err := hyperv.GetVHD(ctx, controller.volumeFilePath(controller.VolumePath, volumeId, true))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), vhds[0].Size)
+
+	// Repeating the request, or asking for less, leaves the size alone
+	response, err = controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), response.CapacityBytes)
+	assert.Equal(t, 1, hyperv.Calls("ResizeVHD"))
+
+	_, err = controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: volumeId})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2, LimitBytes: 1},
+	})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	_, err = controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "eab72431-5d15-4152-a8d1-5cf4ea41627e",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_ControllerExpandVolumeDifferencing(t *testing.T) {
+	_, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: multiNodeReader})
+	require.NoError(t, err)
+
+	_, err = controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024 * 1024},
+	})
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func Test_UnimplementedRPCs(t *testing.T) {
+	_, controller := newSimulatedController()
+	ctx := context.Background()
+
+	_, err := controller.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = controller.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = controller.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
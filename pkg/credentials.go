@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"k8s.io/klog/v2"
+	"os"
+	"time"
+)
+
+// credentialWatchInterval is how often WatchCredentials looks for changes. Kubelet only updates mounted
+// Secrets every minute or so, and polling follows the symlink swap it does to update them. It's a variable
+// so tests don't have to wait.
+var credentialWatchInterval = 10 * time.Second
+
+// hashFiles returns a hash of the contents of every file, missing files hash the same as empty ones
+func hashFiles(paths []string) [sha256.Size]byte {
+	hash := sha256.New()
+	for _, path := range paths {
+		content, _ := os.ReadFile(path)
+		contentHash := sha256.Sum256(content)
+		hash.Write(contentHash[:])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// WatchCredentials calls reload whenever the contents of any of paths change, until ctx is done. A failed
+// reload is tried again on the next check.
+func WatchCredentials(ctx context.Context, paths []string, reload func() error) {
+	loaded := hashFiles(paths)
+	ticker := time.NewTicker(credentialWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := hashFiles(paths)
+		if current == loaded {
+			continue
+		}
+		if err := reload(); err != nil {
+			klog.ErrorS(err, "couldn't reload credentials", "files", paths)
+			credentialReloads.WithLabelValues("error").Inc()
+			continue
+		}
+		loaded = current
+		klog.InfoS("reloaded rotated credentials", "files", paths)
+		credentialReloads.WithLabelValues("success").Inc()
+	}
+}
@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_WatchCredentials(t *testing.T) {
+	previous := credentialWatchInterval
+	credentialWatchInterval = 10 * time.Millisecond
+	t.Cleanup(func() { credentialWatchInterval = previous })
+	successes := testutil.ToFloat64(credentialReloads.WithLabelValues("success"))
+	failures := testutil.ToFloat64(credentialReloads.WithLabelValues("error"))
+
+	password := filepath.Join(t.TempDir(), "WINRM_PASSWORD")
+	require.NoError(t, os.WriteFile(password, []byte("hunter1"), 0600))
+	var reloads atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		WatchCredentials(ctx, []string{password}, func() error {
+			// The first reload fails and is tried again
+			if reloads.Add(1) == 1 {
+				return errors.New("password file is half written")
+			}
+			return nil
+		})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, reloads.Load())
+
+	require.NoError(t, os.WriteFile(password, []byte("hunter2"), 0600))
+	assert.Eventually(t, func() bool { return reloads.Load() == 2 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, int32(2), reloads.Load())
+	assert.Equal(t, successes+1, testutil.ToFloat64(credentialReloads.WithLabelValues("success")))
+	assert.Equal(t, failures+1, testutil.ToFloat64(credentialReloads.WithLabelValues("error")))
+}
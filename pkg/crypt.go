@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// StorageClass parameter (copied to the volume context) that enables LUKS encryption on the node
+const volumeParameterEncrypted = "encrypted"
+
+// Node publish/stage secret keys holding the LUKS passphrase. The previous passphrase is only
+// needed while a key rotation is in progress and is replaced on the next publish.
+const secretPassphrase = "passphrase"
+const secretPreviousPassphrase = "previousPassphrase"
+
+const cryptMapperPrefix = "luks-"
+
+// cryptMapperDirectory is a variable so tests can use a temp directory
+var cryptMapperDirectory = "/dev/mapper"
+
+func cryptMapperName(volumeId string) string {
+	return cryptMapperPrefix + volumeId
+}
+
+func cryptMapperPath(volumeId string) string {
+	return cryptMapperDirectory + "/" + cryptMapperName(volumeId)
+}
+
+func cryptMappingExists(volumeId string) bool {
+	_, err := os.Stat(cryptMapperPath(volumeId))
+	return err == nil
+}
+
+// cryptsetup is a variable so tests can stand in for it
+var cryptsetup = func(ctx context.Context, key string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "cryptsetup", args...)
+	cmd.Stdin = strings.NewReader(key)
+	return cmd.CombinedOutput()
+}
+
+// exitCode is a command's exit status, or -1 if it didn't run
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// cryptNeedsFormat is true for a blank partition and false for a LUKS one. isLuks exits with 1 for
+// anything that isn't LUKS, and blkid -p with 2 when it finds no signature. Anything else, like an
+// existing filesystem or cryptsetup not running, is an error so data is never formatted over.
+func cryptNeedsFormat(ctx context.Context, partitionPath string) (bool, error) {
+	out, err := cryptsetup(ctx, "", "isLuks", partitionPath)
+	if err == nil {
+		return false, nil
+	}
+	if exitCode(err) != 1 {
+		return false, status.Errorf(codes.Internal, "couldn't check if %s is luks formatted: %v: %s", partitionPath, err, strings.TrimSpace(string(out)))
+	}
+
+	// blkid exits with 2 for missing devices too
+	if _, err = os.Stat(partitionPath); err != nil {
+		return false, status.Errorf(codes.Internal, "couldn't check %s for existing data: %v", partitionPath, err)
+	}
+	out, err = exec.CommandContext(ctx, "blkid", "-p", partitionPath).CombinedOutput()
+	if err == nil {
+		return false, status.Errorf(codes.FailedPrecondition, "%s isn't luks formatted and has existing data: %s", partitionPath, strings.TrimSpace(string(out)))
+	}
+	if exitCode(err) != 2 {
+		return false, status.Errorf(codes.Internal, "couldn't check %s for existing data: %v: %s", partitionPath, err, strings.TrimSpace(string(out)))
+	}
+	return true, nil
+}
+
+// cryptOpen formats the partition with LUKS if it's blank and opens it as a device mapper target,
+// returning the path of the unencrypted block device. Read-only partitions are never formatted or re-keyed.
+func cryptOpen(ctx context.Context, partitionPath string, volumeId string, secrets map[string]string, readOnly bool) (string, error) {
+	logger := klog.FromContext(ctx)
+	passphrase := secrets[secretPassphrase]
+	if passphrase == "" {
+		return "", status.Errorf(codes.InvalidArgument, "encrypted volume requires %q in node secrets", secretPassphrase)
+	}
+
+	mapperPath := cryptMapperPath(volumeId)
+	if cryptMappingExists(volumeId) {
+		logger.V(4).Info("crypt mapping already open", "pv", volumeId, "mapper", mapperPath)
+		return mapperPath, nil
+	}
+
+	openArgs := []string{"luksOpen", "--key-file=-", partitionPath, cryptMapperName(volumeId)}
+	if readOnly {
+		openArgs = append(openArgs, "--readonly")
+	}
+
+	needsFormat, err := cryptNeedsFormat(ctx, partitionPath)
+	if err != nil {
+		logger.Error(err, "not opening luks partition", "pv", volumeId, "partition", partitionPath)
+		return "", err
+	}
+	if needsFormat && readOnly {
+		return "", status.Error(codes.FailedPrecondition, "read-only volume isn't luks formatted")
+	} else if needsFormat {
+		logger.Info("formatting pv with luks", "pv", volumeId, "partition", partitionPath)
+		if out, err := cryptsetup(ctx, passphrase, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file=-", partitionPath); err != nil {
+			logger.Error(err, "couldn't luks format partition", "partition", partitionPath, "output", string(out))
+			return "", err
+		}
+	}
+
+	out, err := cryptsetup(ctx, passphrase, openArgs...)
+	if err == nil {
+		return mapperPath, nil
+	}
+
+	previousPassphrase := secrets[secretPreviousPassphrase]
+	if previousPassphrase == "" {
+		logger.Error(err, "couldn't open luks partition", "partition", partitionPath, "output", string(out))
+		return "", err
+	}
+
+	if readOnly {
+		if out, err = cryptsetup(ctx, previousPassphrase, openArgs...); err != nil {
+			logger.Error(err, "couldn't open luks partition", "partition", partitionPath, "output", string(out))
+			return "", err
+		}
+		return mapperPath, nil
+	}
+
+	logger.Info("rotating luks passphrase", "pv", volumeId)
+	if err = cryptRotateKey(ctx, partitionPath, previousPassphrase, passphrase); err != nil {
+		return "", err
+	}
+	if out, err = cryptsetup(ctx, passphrase, openArgs...); err != nil {
+		logger.Error(err, "couldn't open luks partition after key rotation", "partition", partitionPath, "output", string(out))
+		return "", err
+	}
+
+	return mapperPath, nil
+}
+
+// cryptRotateKey replaces the key slot unlocked by oldKey with newKey
+func cryptRotateKey(ctx context.Context, partitionPath string, oldKey string, newKey string) error {
+	// cryptsetup only reads one key from stdin so the new key goes through a private temp file
+	newKeyFile, err := os.CreateTemp("", "hyperv-csi-key-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(newKeyFile.Name())
+	_, err = newKeyFile.WriteString(newKey)
+	if closeErr := newKeyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if out, err := cryptsetup(ctx, oldKey, "luksChangeKey", "--key-file=-", partitionPath, newKeyFile.Name()); err != nil {
+		klog.FromContext(ctx).Error(err, "couldn't change luks key", "partition", partitionPath, "output", string(out))
+		return err
+	}
+	return nil
+}
+
+func cryptClose(ctx context.Context, volumeId string) error {
+	logger := klog.FromContext(ctx)
+	if !cryptMappingExists(volumeId) {
+		return nil
+	}
+
+	logger.Info("closing crypt mapping", "pv", volumeId)
+	if out, err := cryptsetup(ctx, "", "luksClose", cryptMapperName(volumeId)); err != nil {
+		logger.Error(err, "couldn't close luks mapping", "pv", volumeId, "output", string(out))
+		return err
+	}
+	return nil
+}
+
+// cryptResize grows the crypt mapping to fill its (already grown) partition
+func cryptResize(ctx context.Context, volumeId string, secrets map[string]string) error {
+	if !cryptMappingExists(volumeId) {
+		return errors.New("crypt mapping isn't open")
+	}
+
+	if out, err := cryptsetup(ctx, secrets[secretPassphrase], "resize", "--key-file=-", cryptMapperName(volumeId)); err != nil {
+		klog.FromContext(ctx).Error(err, "couldn't resize luks mapping", "pv", volumeId, "output", string(out))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newLoopDevice attaches a sparse file as a loop device. cryptsetup needs root and a real block device.
+func newLoopDevice(t *testing.T) string {
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices require root")
+	}
+	for _, binary := range []string{"cryptsetup", "losetup"} {
+		if _, err := exec.LookPath(binary); err != nil {
+			t.Skipf("%s not installed", binary)
+		}
+	}
+
+	backingFile := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, os.WriteFile(backingFile, nil, 0600))
+	require.NoError(t, os.Truncate(backingFile, 64*1024*1024))
+
+	out, err := exec.Command("losetup", "--find", "--show", backingFile).Output()
+	if err != nil {
+		t.Skipf("couldn't create loop device: %v", err)
+	}
+	device := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("losetup", "-d", device).Run() })
+	return device
+}
+
+func Test_cryptOpenRequiresPassphrase(t *testing.T) {
+	_, err := cryptOpen(context.Background(), "/dev/null", "eab72431-5d15-4152-a8d1-5cf4ea41627e", map[string]string{}, false)
+	assert.ErrorContains(t, err, secretPassphrase)
+}
+
+// stubCryptsetup replaces cryptsetup with a shell exit code and records the commands it's asked to run
+func stubCryptsetup(t *testing.T, code string) *[]string {
+	original := cryptsetup
+	t.Cleanup(func() { cryptsetup = original })
+	commands := make([]string, 0)
+	cryptsetup = func(ctx context.Context, key string, args ...string) ([]byte, error) {
+		commands = append(commands, args[0])
+		return exec.CommandContext(ctx, "sh", "-c", "exit "+code).CombinedOutput()
+	}
+	return &commands
+}
+
+func Test_cryptOpenNeverFormatsExistingData(t *testing.T) {
+	for _, binary := range []string{"blkid", "mkfs.ext4"} {
+		if _, err := exec.LookPath(binary); err != nil {
+			t.Skipf("%s not installed", binary)
+		}
+	}
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, os.WriteFile(disk, nil, 0600))
+	require.NoError(t, os.Truncate(disk, 16*1024*1024))
+	require.NoError(t, exec.Command("mkfs.ext4", "-q", "-F", disk).Run())
+	secrets := map[string]string{secretPassphrase: "first"}
+	ctx := context.Background()
+
+	// Not LUKS, with an ext4 filesystem on it
+	commands := stubCryptsetup(t, "1")
+	_, err := cryptOpen(ctx, disk, "eab72431-5d15-4152-a8d1-5cf4ea41627e", secrets, false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, []string{"isLuks"}, *commands)
+
+	// isLuks failing for any other reason, e.g. a missing device
+	commands = stubCryptsetup(t, "4")
+	_, err = cryptOpen(ctx, disk, "eab72431-5d15-4152-a8d1-5cf4ea41627e", secrets, false)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, []string{"isLuks"}, *commands)
+
+	output, err := exec.Command("blkid", "-p", "-s", "TYPE", "-o", "value", disk).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "ext4", strings.TrimSpace(string(output)))
+}
+
+func Test_cryptNeedsFormat(t *testing.T) {
+	if _, err := exec.LookPath("blkid"); err != nil {
+		t.Skip("blkid not installed")
+	}
+	blank := filepath.Join(t.TempDir(), "blank.img")
+	require.NoError(t, os.WriteFile(blank, nil, 0600))
+	require.NoError(t, os.Truncate(blank, 16*1024*1024))
+	ctx := context.Background()
+
+	stubCryptsetup(t, "1")
+	needsFormat, err := cryptNeedsFormat(ctx, blank)
+	require.NoError(t, err)
+	assert.True(t, needsFormat)
+
+	_, err = cryptNeedsFormat(ctx, filepath.Join(t.TempDir(), "missing.img"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	stubCryptsetup(t, "0")
+	needsFormat, err = cryptNeedsFormat(ctx, blank)
+	require.NoError(t, err)
+	assert.False(t, needsFormat)
+}
+
+func Test_cryptOpenFormatAndClose(t *testing.T) {
+	device := newLoopDevice(t)
+	volumeId := "test-" + filepath.Base(device)
+	ctx := context.Background()
+
+	mapperPath, err := cryptOpen(ctx, device, volumeId, map[string]string{secretPassphrase: "first"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, cryptMapperPath(volumeId), mapperPath)
+	assert.True(t, cryptMappingExists(volumeId))
+
+	// Idempotent while open
+	_, err = cryptOpen(ctx, device, volumeId, map[string]string{secretPassphrase: "first"}, false)
+	assert.NoError(t, err)
+
+	assert.NoError(t, cryptClose(ctx, volumeId))
+	assert.False(t, cryptMappingExists(volumeId))
+	assert.NoError(t, cryptClose(ctx, volumeId))
+}
+
+func Test_cryptOpenKeyRotation(t *testing.T) {
+	device := newLoopDevice(t)
+	volumeId := "test-" + filepath.Base(device)
+	ctx := context.Background()
+
+	_, err := cryptOpen(ctx, device, volumeId, map[string]string{secretPassphrase: "first"}, false)
+	require.NoError(t, err)
+	require.NoError(t, cryptClose(ctx, volumeId))
+
+	_, err = cryptOpen(ctx, device, volumeId, map[string]string{secretPassphrase: "second"}, false)
+	assert.Error(t, err)
+
+	_, err = cryptOpen(ctx, device, volumeId, map[string]string{secretPassphrase: "second", secretPreviousPassphrase: "first"}, false)
+	require.NoError(t, err)
+	require.NoError(t, cryptClose(ctx, volumeId))
+
+	// The old passphrase no longer unlocks the volume
+	_, err = cryptOpen(ctx, device, volumeId, map[string]string{secretPassphrase: "first"}, false)
+	assert.Error(t, err)
+	_, err = cryptOpen(ctx, device, volumeId, map[string]string{secretPassphrase: "second"}, false)
+	assert.NoError(t, err)
+	assert.NoError(t, cryptClose(ctx, volumeId))
+}
+
+func Test_NodeUnpublishKeepsSharedCryptMapping(t *testing.T) {
+	directory := t.TempDir()
+	devicePath := filepath.Join(directory, "dev")
+	require.NoError(t, os.MkdirAll(filepath.Join(devicePath, "disk", "by-id"), 0700))
+	volumeId := "eab72431-5d15-4152-a8d1-5cf4ea41627e"
+	require.NoError(t, os.WriteFile(filepath.Join(devicePath, "disk", "by-id", "wwn-0x60022480"+volumeDeviceSuffix(volumeId)), nil, 0600))
+
+	originalDirectory := cryptMapperDirectory
+	cryptMapperDirectory = filepath.Join(directory, "mapper")
+	t.Cleanup(func() { cryptMapperDirectory = originalDirectory })
+	require.NoError(t, os.MkdirAll(cryptMapperDirectory, 0700))
+	commands := stubCryptsetup(t, "0")
+	stub := cryptsetup
+	cryptsetup = func(ctx context.Context, key string, args ...string) ([]byte, error) {
+		switch args[0] {
+		case "luksOpen":
+			require.NoError(t, os.WriteFile(cryptMapperDirectory+"/"+args[3], nil, 0600))
+		case "luksClose":
+			require.NoError(t, os.Remove(cryptMapperDirectory+"/"+args[1]))
+		}
+		return stub(ctx, key, args...)
+	}
+
+	mounter := NewSimulatedMounter()
+	driver := &HypervCsiDriver{NodeId: "kube01", DevicePath: devicePath, Mounter: mounter}
+	ctx := context.Background()
+	targets := []string{filepath.Join(directory, "target-1"), filepath.Join(directory, "target-2")}
+	for _, target := range targets {
+		_, err := driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeId,
+			TargetPath:       target,
+			VolumeCapability: singleNodeWriter[0],
+			VolumeContext:    map[string]string{volumeParameterEncrypted: "true"},
+			Secrets:          map[string]string{secretPassphrase: "first"},
+		})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"isLuks", "luksOpen"}, *commands)
+
+	_, err := driver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeId, TargetPath: targets[0]})
+	require.NoError(t, err)
+	assert.True(t, cryptMappingExists(volumeId))
+	assert.NotContains(t, *commands, "luksClose")
+
+	_, err = driver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeId, TargetPath: targets[1]})
+	require.NoError(t, err)
+	assert.False(t, cryptMappingExists(volumeId))
+	assert.Contains(t, *commands, "luksClose")
+}
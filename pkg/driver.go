@@ -2,14 +2,13 @@ package pkg
 
 import (
 	"context"
-	"fmt"
-	"github.com/bitfield/script"
+	"errors"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -18,6 +17,19 @@ const hypervScsiControllerReserved = 4
 const hypervScsiControllerAvailable = hypervScsiControllerMax - hypervScsiControllerReserved
 const defaultFilesystem = "ext4"
 
+// supportedFilesystems can be formatted and grown by the node
+var supportedFilesystems = []string{"ext2", "ext3", "ext4", "xfs"}
+
+// SupportedFilesystem reports whether the node can format and grow fsType
+func SupportedFilesystem(fsType string) bool {
+	for _, supported := range supportedFilesystems {
+		if fsType == supported {
+			return true
+		}
+	}
+	return false
+}
+
 //const hostFilesystemMountPoint = "/host"
 
 func volumeDeviceSuffix(volumeId string) string {
@@ -25,150 +37,351 @@ func volumeDeviceSuffix(volumeId string) string {
 }
 
 type HypervCsiDriver struct {
+	csi.IdentityServer
 	csi.NodeServer
+	// NodeId is the name of the node's VM, it defaults to $KUBE_NODE_NAME
+	NodeId string
+	// DevicePath is where block devices are found, it defaults to /dev
+	DevicePath string
+	// Mounter partitions, formats and mounts devices, it defaults to running the usual command line tools
+	Mounter Mounter
+	// DefaultFilesystem is used when a volume doesn't ask for one, it defaults to ext4
+	DefaultFilesystem string
+	// MaxVolumes is how many volumes can be attached to the node, it defaults to the VM's SCSI slots less the
+	// ones kept for its own disks
+	MaxVolumes int64
+
+	// volumeLocks rejects a publish or unpublish while another is running for the same volume
+	volumeLocks operationLocks
+	health      healthCache
+}
+
+func (s *HypervCsiDriver) mounter() Mounter {
+	if s.Mounter == nil {
+		return metricsMounter{execMounter{}}
+	}
+	return metricsMounter{s.Mounter}
+}
+
+func (s *HypervCsiDriver) devicePath() string {
+	if s.DevicePath == "" {
+		return "/dev"
+	}
+	return s.DevicePath
+}
+
+func (s *HypervCsiDriver) nodeId() string {
+	if s.NodeId == "" {
+		return os.Getenv("KUBE_NODE_NAME")
+	}
+	return s.NodeId
+}
+
+// findDevice returns the path of the disk attached with diskIdentifier
+func (s *HypervCsiDriver) findDevice(diskIdentifier string) (string, error) {
+	// Only a full GUID suffix identifies one disk
+	if !validVolumeId(diskIdentifier) {
+		return "", status.Errorf(codes.NotFound, "no device for disk %s", diskIdentifier)
+	}
+	devices, err := filepath.Glob(filepath.Join(s.devicePath(), "disk", "by-id", "wwn-*"+volumeDeviceSuffix(diskIdentifier)))
+	if err != nil {
+		return "", err
+	}
+	if len(devices) == 0 {
+		return "", status.Errorf(codes.NotFound, "no device for disk %s", diskIdentifier)
+	}
+	return devices[0], nil
+}
+
+// healthChecks are what the node needs to find, format and mount disks
+func (s *HypervCsiDriver) healthChecks() []healthCheck {
+	return []healthCheck{
+		{name: "node id", check: func(ctx context.Context) error {
+			if s.nodeId() == "" {
+				return errors.New("KUBE_NODE_NAME isn't set")
+			}
+			return nil
+		}},
+		{name: "devices", check: func(ctx context.Context) error {
+			_, err := os.Stat(filepath.Join(s.devicePath(), "disk", "by-id"))
+			return err
+		}},
+		{name: "tools", check: func(ctx context.Context) error {
+			return s.mounter().CheckTools(ctx, supportedFilesystems)
+		}},
+	}
+}
+
+// IdentityServer
+func (s *HypervCsiDriver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return s.health.probe(ctx, s.healthChecks())
+}
+
+func (s *HypervCsiDriver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{
+		Name:          DriverName,
+		VendorVersion: driverVersion,
+	}, nil
+}
+
+// GetPluginCapabilities reports the plugin's controller service, which runs in its own deployment, so node
+// publish requests are expected to follow ControllerPublishVolume
+func (s *HypervCsiDriver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
+		},
+	}, nil
 }
 
 func (s *HypervCsiDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	logRequest("NodeGetInfo", req)
+	var topology *csi.Topology
+	if clusterName := os.Getenv("HV_CLUSTER_NAME"); clusterName != "" {
+		topology = clusterTopology(clusterName)
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId:             os.Getenv("KUBE_NODE_NAME"),
-		MaxVolumesPerNode:  hypervScsiControllerAvailable,
-		AccessibleTopology: nil,
+		NodeId:             s.nodeId(),
+		MaxVolumesPerNode:  s.maxVolumes(),
+		AccessibleTopology: topology,
 	}, nil
 }
 
+func (s *HypervCsiDriver) maxVolumes() int64 {
+	if s.MaxVolumes == 0 {
+		return hypervScsiControllerAvailable
+	}
+	return s.MaxVolumes
+}
+
 func (s *HypervCsiDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	logRequest("NodeGetCapabilities", req)
-	// TODO... I don't think I support any of the listed items...
 	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{},
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+		},
 	}, nil
 }
 
 // NodePublishVolume Mount a volume to the target path
 func (s *HypervCsiDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	logRequest("NodePublishVolume", req)
-
+	logger := klog.FromContext(ctx)
 	response := &csi.NodePublishVolumeResponse{}
+	if req.VolumeId == "" || req.TargetPath == "" || req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume id, target path and volume capability are required")
+	}
+	if req.VolumeCapability.GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "block volumes aren't supported")
+	}
+	unlock, err := s.volumeLocks.acquire(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Idempotence
+	mounted, err := s.mounter().IsMounted(ctx, req.TargetPath)
+	if err != nil {
+		return nil, err
+	}
+	if mounted {
+		logger.Info("volume already mounted", "pv", req.VolumeId, "target", req.TargetPath)
+		return response, nil
+	}
 
 	// Determine filesystem type
-	fsType := defaultFilesystem
-	if req.GetVolumeCapability() != nil && req.GetVolumeCapability().GetMount() != nil && req.GetVolumeCapability().GetMount().GetFsType() != "" {
+	fsType := s.DefaultFilesystem
+	if fsType == "" {
+		fsType = defaultFilesystem
+	}
+	if req.GetVolumeCapability().GetMount().GetFsType() != "" {
 		fsType = req.GetVolumeCapability().GetMount().GetFsType()
 	}
-	klog.V(8).Infof("using fstype %s", fsType)
+	logger.V(8).Info("using fstype", "fsType", fsType)
+
+	// Read-only-many volumes are attached as a per-node differencing child with its own disk identifier
+	diskIdentifier := req.VolumeId
+	if childIdentifier, ok := req.GetPublishContext()[publishContextDiskIdentifier]; ok && childIdentifier != "" {
+		diskIdentifier = childIdentifier
+	}
+	readOnly := req.Readonly || req.GetPublishContext()[publishContextReadOnly] == "true"
 
 	// Find block device from pvc ID (vhd id)
-	// TODO probably convert this to not use bitfield/script since that's the only place the dep is used
-	volumePath, err := script.ListFiles(fmt.Sprintf("/dev/disk/by-id/wwn-*%s", volumeDeviceSuffix(req.VolumeId))).First(1).String()
-	volumePath = strings.TrimRight(volumePath, " \t\n\r")
+	volumePath, err := s.findDevice(diskIdentifier)
 	if err != nil {
-		klog.ErrorS(err, "Couldn't find device for volume", "volumeId", req.VolumeId, "output", volumePath)
-		return response, err
+		logger.Error(err, "Couldn't find device for volume", "volumeId", req.VolumeId)
+		return nil, err
 	}
 
 	// Partition block device, if needed
 	partitionPath := volumePath + "-part1"
-	if _, err = os.Stat(partitionPath); err != nil {
-		klog.InfoS("partitioning pv", "pv", req.VolumeId)
-		shellCommand := []string{volumePath, "--script", "-a", "optimal", "mklabel", "gpt", "mkpart", "primary", fsType, "0%", "100%"}
-		if out, partErr := exec.CommandContext(ctx, "parted", shellCommand...).Output(); partErr != nil {
-			klog.ErrorS(partErr, "failed to partition disk", "command", shellCommand, "output", string(out))
-			return response, partErr
+	if _, err = os.Stat(partitionPath); err != nil && readOnly {
+		logger.Error(err, "read-only volume has no partition", "pv", req.VolumeId)
+		return nil, status.Error(codes.FailedPrecondition, "read-only volume has no filesystem")
+	} else if err != nil {
+		logger.Info("partitioning pv", "pv", req.VolumeId)
+		if err = s.mounter().Partition(ctx, volumePath, fsType); err != nil {
+			return nil, err
+		}
+	}
+
+	// Open encrypted partition, if needed
+	devicePath := partitionPath
+	if req.GetVolumeContext()[volumeParameterEncrypted] == "true" {
+		devicePath, err = cryptOpen(ctx, partitionPath, req.VolumeId, req.GetSecrets(), readOnly)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	// Format block device, if needed
-	out, err := exec.CommandContext(ctx, "blkid", "-o", "value", "-s", "TYPE", partitionPath).Output()
+	existingFsType, err := s.mounter().FilesystemType(ctx, devicePath)
 	if err != nil {
-		klog.ErrorS(err, "couldn't determine partition fstype", "partition", partitionPath, "output", out)
-		return response, err
+		return nil, err
 	}
-	if len(out) == 0 {
-		klog.InfoS("formatting pv", "pv", req.VolumeId, "fsType", fsType)
-		out, err := exec.CommandContext(ctx, "mkfs", "-t", fsType, partitionPath).Output()
-		if err != nil {
-			klog.ErrorS(err, "couldn't format partition", "fsType", fsType, "partition", partitionPath, "output", out)
-			return response, err
+	if existingFsType == "" && readOnly {
+		return nil, status.Error(codes.FailedPrecondition, "read-only volume has no filesystem")
+	}
+	if existingFsType == "" {
+		logger.Info("formatting pv", "pv", req.VolumeId, "fsType", fsType)
+		if err = s.mounter().Format(ctx, devicePath, fsType); err != nil {
+			return nil, err
 		}
 	}
 
-	klog.InfoS("creating mount point directory", "directory", req.TargetPath)
-	err = os.MkdirAll(req.TargetPath, 0700)
-
-	// Construct mount command
-	mountCommand := make([]string, 0)
-	var mountFlags []string
-	if req.GetVolumeCapability() != nil && req.GetVolumeCapability().GetMount() != nil {
-		mountFlags = req.GetVolumeCapability().GetMount().GetMountFlags()
+	logger.Info("creating mount point directory", "directory", req.TargetPath)
+	if err = os.MkdirAll(req.TargetPath, 0700); err != nil {
+		return nil, err
 	}
-	if len(mountFlags) > 0 {
-		// TODO, I think this works right... (need to verify what's actually in mount flags array)
-		mountCommand = append(mountCommand, "-o")
-		mountCommand = append(mountCommand, strings.Join(mountFlags, ","))
+
+	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
+	if readOnly {
+		mountFlags = append(mountFlags, "ro")
 	}
-	mountCommand = append(mountCommand, partitionPath)
-	mountCommand = append(mountCommand, req.TargetPath)
 
 	// Mount partition
-	klog.InfoS("running command", "command", mountCommand)
-	out, err = exec.CommandContext(ctx, "mount", mountCommand...).Output()
-	// TODO idempotence see https://github.com/container-storage-interface/spec/blob/master/spec.md#nodepublishvolume-errors
-	if err != nil {
-		klog.ErrorS(err, "failed to mount volume", "output", string(out))
-		if err.Error() == "exit status 32" {
-			return response, status.Error(codes.NotFound, "volume not found")
-		} else {
-			klog.ErrorS(err, "volume mount error", "output", out)
-		}
+	logger.Info("mounting volume", "device", devicePath, "target", req.TargetPath, "flags", mountFlags)
+	if err = s.mounter().Mount(ctx, devicePath, req.TargetPath, mountFlags); err != nil {
+		return nil, err
 	}
 
-	return response, err
+	return response, nil
 }
 
 // NodeUnpublishVolume Unmount a volume from the target path
 func (s *HypervCsiDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	logRequest("NodeUnpublishVolume", req)
-
+	logger := klog.FromContext(ctx)
 	response := &csi.NodeUnpublishVolumeResponse{}
-	var err error
-	out, err := exec.CommandContext(ctx, "umount", req.TargetPath).Output()
-	exec.CommandContext(ctx, "/usr/bin/rmdir", req.TargetPath)
+	if req.VolumeId == "" || req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and target path are required")
+	}
+	unlock, err := s.volumeLocks.acquire(req.VolumeId)
 	if err != nil {
-		if err.Error() == "exit status 32" {
-			klog.Warningf("failed to unmount %s '%s'", req.VolumeId, string(out))
-			// TODO this seemed to get stuck unless I return a normal request
-			// despite the docs suggesting this error should be returned
-			//return response, status.Error(codes.NotFound, "volume not found")
-			return response, nil
-		} else {
-			klog.ErrorS(err, "volume unmount error", "output", out)
+		return nil, err
+	}
+	defer unlock()
+
+	// Idempotence, the volume may already be unmounted
+	mounted, err := s.mounter().IsMounted(ctx, req.TargetPath)
+	if err != nil {
+		return nil, err
+	}
+	if mounted {
+		if err = s.mounter().Unmount(ctx, req.TargetPath); err != nil {
+			return nil, err
 		}
+	} else {
+		logger.Info("volume isn't mounted", "pv", req.VolumeId, "target", req.TargetPath)
+	}
+	if err = os.Remove(req.TargetPath); err != nil && !os.IsNotExist(err) {
+		logger.Error(err, "couldn't remove mount point", "target", req.TargetPath)
+		return nil, err
 	}
 
-	return response, err
+	// Without staging, a volume published to several target paths shares one crypt mapping. It's closed
+	// with the last mount.
+	if cryptMappingExists(req.VolumeId) {
+		inUse, err := s.mounter().DeviceMounted(ctx, cryptMapperPath(req.VolumeId))
+		if err != nil {
+			return nil, err
+		}
+		if inUse {
+			logger.Info("crypt mapping still mounted elsewhere", "pv", req.VolumeId)
+			return response, nil
+		}
+	}
+	return response, cryptClose(ctx, req.VolumeId)
 }
 
 // NodeStageVolume Not supported capability
 func (s *HypervCsiDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	logRequest("NodeStageVolume", req)
 	return nil, status.Error(codes.Unimplemented, "method NodeStageVolume not implemented")
 }
 
 // NodeUnstageVolume Not supported capability
 func (s *HypervCsiDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	logRequest("NodeUnstageVolume", req)
 	return nil, status.Error(codes.Unimplemented, "method NodeUnstageVolume not implemented")
 }
 
 // NodeGetVolumeStats Not supported capability
 func (s *HypervCsiDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	logRequest("NodeGetVolumeStats", req)
 	return nil, status.Error(codes.Unimplemented, "method NodeGetVolumeStats not implemented")
 }
 
-// NodeExpandVolume Not supported capability
+// NodeExpandVolume Grow the partition, crypt mapping (if encrypted) and filesystem to fill the disk
 func (s *HypervCsiDriver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	logRequest("NodeExpandVolume", req)
-	return nil, status.Error(codes.Unimplemented, "method NodeExpandVolume not implemented")
+	response := &csi.NodeExpandVolumeResponse{}
+	if req.VolumeId == "" || req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and volume path are required")
+	}
+
+	volumePath, err := s.findDevice(req.VolumeId)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Couldn't find device for volume", "volumeId", req.VolumeId)
+		return nil, err
+	}
+
+	if err = s.mounter().GrowPartition(ctx, volumePath); err != nil {
+		return nil, err
+	}
+
+	devicePath := volumePath + "-part1"
+	if cryptMappingExists(req.VolumeId) {
+		if err = cryptResize(ctx, req.VolumeId, req.GetSecrets()); err != nil {
+			return nil, err
+		}
+		devicePath = cryptMapperPath(req.VolumeId)
+	}
+
+	fsType, err := s.mounter().FilesystemType(ctx, devicePath)
+	if err != nil {
+		return nil, err
+	}
+	switch fsType {
+	case "xfs", "ext2", "ext3", "ext4":
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "can't resize %s filesystem", fsType)
+	}
+	if err = s.mounter().GrowFilesystem(ctx, devicePath, fsType, req.VolumePath); err != nil {
+		return nil, err
+	}
+
+	return response, nil
 }
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/klog/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Probes come from kubelet, the livenessprobe and every sidecar so results are reused for a while
+const healthCacheTTL = 10 * time.Second
+const healthCheckTimeout = 20 * time.Second
+
+// healthCheck is one thing the plugin needs to serve requests
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthCache remembers the result of the last health check run
+type healthCache struct {
+	lock    sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// run runs every check, unless they ran recently, and returns the failures joined together. Concurrent
+// callers wait for a single run.
+func (c *healthCache) run(ctx context.Context, checks []healthCheck) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.checked.IsZero() && time.Since(c.checked) < healthCacheTTL {
+		return c.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	failures := make([]error, 0)
+	for _, check := range checks {
+		if err := check.check(ctx); err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", check.name, err))
+		}
+	}
+	c.err = errors.Join(failures...)
+	c.checked = time.Now()
+	if c.err != nil {
+		klog.FromContext(ctx).Error(c.err, "health check failed")
+	}
+	return c.err
+}
+
+// probe answers a CSI Probe from the health checks, the reason the plugin isn't ready is in the status message
+func (c *healthCache) probe(ctx context.Context, checks []healthCheck) (*csi.ProbeResponse, error) {
+	if err := c.run(ctx, checks); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "not ready: %v", err)
+	}
+	return &csi.ProbeResponse{Ready: &wrapperspb.BoolValue{Value: true}}, nil
+}
+
+// HealthHandler serves the result of identity's Probe, for a readinessProbe's httpGet
+func HealthHandler(identity csi.IdentityServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, err := identity.Probe(r.Context(), &csi.ProbeRequest{})
+		if err != nil {
+			http.Error(w, status.Convert(err).Message(), http.StatusServiceUnavailable)
+			return
+		}
+		// Plugins that leave ready unset are ready
+		if ready := response.GetReady(); ready != nil && !ready.Value {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// LivenessHandler only answers while the process is serving, for a livenessProbe's httpGet. The Hyper-V host
+// being unreachable isn't fixed by a restart so it's left to HealthHandler.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
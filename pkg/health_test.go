@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeTools puts an executable for every tool on an otherwise empty PATH
+func fakeTools(t *testing.T, tools ...string) {
+	directory := t.TempDir()
+	for _, tool := range tools {
+		require.NoError(t, os.WriteFile(filepath.Join(directory, tool), []byte("#!/bin/sh\n"), 0700))
+	}
+	t.Setenv("PATH", directory)
+}
+
+// newHealthyDriver returns a driver whose device tree exists and whose tools are all installed
+func newHealthyDriver(t *testing.T) *HypervCsiDriver {
+	devicePath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(devicePath, "disk", "by-id"), 0700))
+	tools := append([]string{}, mountTools...)
+	for _, fsType := range supportedFilesystems {
+		tools = append(tools, filesystemTools[fsType]...)
+	}
+	fakeTools(t, tools...)
+	return &HypervCsiDriver{NodeId: "kube01", DevicePath: devicePath}
+}
+
+func Test_ControllerProbeNotReady(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	controller.Pools = map[string]string{"bulk": "E:\\Hyper-V\\Virtual Hard Disks"}
+	hyperv.FailNext("Ping", errors.New("http response error: 401 - invalid content type"))
+	hyperv.FailNext("CheckDirectory", nil)
+	hyperv.FailNext("CheckDirectory", errors.New("directory does not exist"))
+
+	_, err := controller.Probe(context.Background(), &csi.ProbeRequest{})
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "winrm: http response error: 401")
+	assert.Contains(t, status.Convert(err).Message(), "volume path: E:\\Hyper-V\\Virtual Hard Disks: directory does not exist")
+	assert.NotContains(t, status.Convert(err).Message(), "hyper-v module")
+}
+
+func Test_ControllerProbeCached(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+
+	for i := 0; i < 3; i++ {
+		probe, err := controller.Probe(context.Background(), &csi.ProbeRequest{})
+		require.NoError(t, err)
+		assert.True(t, probe.Ready.Value)
+	}
+
+	assert.Equal(t, 1, hyperv.Calls("Ping"))
+	assert.Equal(t, 1, hyperv.Calls("CheckHyperV"))
+	assert.Equal(t, 1, hyperv.Calls("CheckDirectory"))
+	assert.Zero(t, hyperv.Calls("ClusterInfo"))
+}
+
+func Test_NodeProbe(t *testing.T) {
+	driver := newHealthyDriver(t)
+
+	probe, err := driver.Probe(context.Background(), &csi.ProbeRequest{})
+
+	require.NoError(t, err)
+	assert.True(t, probe.Ready.Value)
+}
+
+func Test_NodeProbeNotReady(t *testing.T) {
+	t.Setenv("KUBE_NODE_NAME", "")
+	fakeTools(t, "parted", "blkid", "mkfs", "mount", "umount", "mountpoint", "findmnt", "mkfs.ext4", "resize2fs")
+	driver := &HypervCsiDriver{DevicePath: t.TempDir()}
+
+	_, err := driver.Probe(context.Background(), &csi.ProbeRequest{})
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	message := status.Convert(err).Message()
+	assert.Contains(t, message, "node id: KUBE_NODE_NAME isn't set")
+	assert.Contains(t, message, "devices: ")
+	assert.Contains(t, message, "tools: missing mkfs.ext2, mkfs.ext3, mkfs.xfs, xfs_growfs")
+}
+
+func Test_HealthHandler(t *testing.T) {
+	driver := newHealthyDriver(t)
+	recorder := httptest.NewRecorder()
+	HealthHandler(driver).ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, recorder.Code)
+
+	t.Setenv("KUBE_NODE_NAME", "")
+	driver = &HypervCsiDriver{DevicePath: driver.DevicePath}
+	recorder = httptest.NewRecorder()
+	HealthHandler(driver).ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 503, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "KUBE_NODE_NAME")
+
+	// Liveness doesn't depend on the health checks
+	recorder = httptest.NewRecorder()
+	LivenessHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/livez", nil))
+	assert.Equal(t, 200, recorder.Code)
+}
@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// VolumeInfo is what the controller knows about a volume, for operators
+type VolumeInfo struct {
+	VolumeId      string     `json:"volumeId"`
+	Pool          string     `json:"pool"`
+	Path          string     `json:"path"`
+	CapacityBytes int64      `json:"capacityBytes"`
+	ClusterId     string     `json:"clusterId,omitempty"`
+	PVCName       string     `json:"pvcName,omitempty"`
+	PVCNamespace  string     `json:"pvcNamespace,omitempty"`
+	PVName        string     `json:"pvName,omitempty"`
+	QoS           *volumeQoS `json:"qos,omitempty"`
+	// VMs are the VMs the volume is attached to
+	VMs []string `json:"vms"`
+	// Chain is only set by InspectVolume, see VolumeChain
+	Chain []VHD `json:"chain,omitempty"`
+}
+
+func (v *VolumeInfo) setMetadata(metadata *volumeMetadata) {
+	v.ClusterId = metadata.ClusterId
+	v.PVCName = metadata.PVCName
+	v.PVCNamespace = metadata.PVCNamespace
+	v.PVName = metadata.PVName
+	v.QoS = metadata.QoS
+}
+
+// fileVolumeId returns the ID of the volume a file belongs to, read-only children belong to their parent
+func (s *HypervCsiController) fileVolumeId(file string) string {
+	volumeId := strings.TrimPrefix(strings.TrimSuffix(fileName(file), ".vhdx"), s.volumePrefix())
+	volumeId, _, _ = strings.Cut(volumeId, readOnlyChildInfix)
+	return volumeId
+}
+
+// volumeChain returns a volume's VHDs from its base disk to the one that's attached. Per-node differencing
+// children of read-only-many volumes aren't part of the volume's own chain.
+func (s *HypervCsiController) volumeChain(ctx context.Context, directory string, volumeId string) ([]VHD, error) {
+	vhds, err := s.backend().GetVHD(ctx, s.volumeFilePath(directory, volumeId, false))
+	if err != nil && !errors.Is(err, ErrVHDNotFound) {
+		return nil, err
+	}
+	if len(vhds) == 0 {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeId)
+	}
+
+	children := map[string]VHD{}
+	for _, vhd := range vhds {
+		if strings.Contains(vhd.Path, readOnlyChildInfix) {
+			continue
+		}
+		children[vhd.ParentPath] = vhd
+	}
+	chain := make([]VHD, 0, len(children))
+	for parent := ""; ; {
+		child, ok := children[parent]
+		if !ok {
+			break
+		}
+		chain = append(chain, child)
+		parent = child.Path
+	}
+	return chain, nil
+}
+
+// VolumeChain returns the VHDs ControllerPublishVolume walks, from the volume's base disk to the one it attaches
+func (s *HypervCsiController) VolumeChain(ctx context.Context, volumeId string) ([]VHD, error) {
+	directory, err := s.volumeDirectory(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	return s.volumeChain(ctx, directory, volumeId)
+}
+
+// InspectVolume describes a volume, including its chain. Volumes of other clusters can be inspected too.
+func (s *HypervCsiController) InspectVolume(ctx context.Context, volumeId string) (*VolumeInfo, error) {
+	pool, err := s.volumePool(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	directory, err := s.poolDirectory(pool)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := s.volumeChain(ctx, directory, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := s.getVolumeMetadata(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := s.backend().ListAttachments(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &VolumeInfo{
+		VolumeId: volumeId,
+		Pool:     pool,
+		Path:     s.volumeFilePath(directory, volumeId, true),
+		VMs:      make([]string, 0, len(attachments)),
+		Chain:    chain,
+	}
+	if len(chain) > 0 {
+		info.CapacityBytes = chain[0].Size
+	}
+	info.setMetadata(metadata)
+	for _, attachment := range attachments {
+		info.VMs = append(info.VMs, attachment.VMName)
+	}
+	return info, nil
+}
+
+// ListVolumeInfo describes every volume ListVolumes returns, without their chains
+func (s *HypervCsiController) ListVolumeInfo(ctx context.Context) ([]VolumeInfo, error) {
+	volumes, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := s.listVolumeMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	index, err := s.loadVolumeIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := s.backend().ListAttachments(ctx, "\\"+s.volumePrefix())
+	if err != nil {
+		return nil, err
+	}
+	vms := map[string][]string{}
+	for _, attachment := range attachments {
+		volumeId := s.fileVolumeId(attachment.Path)
+		vms[volumeId] = append(vms[volumeId], attachment.VMName)
+	}
+	sizes := map[string]int64{}
+	for _, directory := range s.poolDirectories() {
+		vhds, err := s.backend().GetVHD(ctx, s.volumeFilePath(directory, "", false))
+		if err != nil && !errors.Is(err, ErrVHDNotFound) {
+			return nil, err
+		}
+		for _, vhd := range vhds {
+			sizes[strings.ToLower(vhd.Path)] = vhd.Size
+		}
+	}
+
+	infos := make([]VolumeInfo, 0, len(volumes.Entries))
+	for _, entry := range volumes.Entries {
+		volumeId := entry.Volume.VolumeId
+		pool, ok := index.Pools[volumeId]
+		if !ok {
+			pool = defaultPoolName
+		}
+		directory, err := s.poolDirectory(pool)
+		if err != nil {
+			return nil, err
+		}
+		info := VolumeInfo{
+			VolumeId: volumeId,
+			Pool:     pool,
+			Path:     s.volumeFilePath(directory, volumeId, true),
+			VMs:      vms[volumeId],
+		}
+		info.CapacityBytes = sizes[strings.ToLower(info.Path)]
+		if info.VMs == nil {
+			info.VMs = []string{}
+		}
+		if volumeMetadata, ok := metadata[volumeId]; ok {
+			info.setMetadata(volumeMetadata)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// RunPowerShell runs a command on the host the way the controller runs its own, for operators
+func (s *HypervCsiController) RunPowerShell(ctx context.Context, cmd string) (ExecResult, error) {
+	backend, ok := s.backend().(*powerShellBackend)
+	if !ok {
+		return ExecResult{}, errors.New("the backend doesn't run powershell")
+	}
+	return backend.psRun(ctx, cmd), nil
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+var multiNodeReader = &csi.VolumeCapability{
+	AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+}
+
+func Test_VolumeChain(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	basePath := controller.volumeFilePath(controller.VolumePath, volumeId, true)
+	// Hyper-V names a checkpoint after the disk and the checkpoint's GUID
+	tipPath := controller.volumeFilePath(controller.VolumePath, volumeId+"_8E3C4D2B-7F1A-4E6B-9C0D-5A2F1B3E4D6C", false) + ".avhdx"
+	_, err := hyperv.CreateDifferencingVHD(ctx, tipPath, basePath)
+	require.NoError(t, err)
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: multiNodeReader})
+	require.NoError(t, err)
+
+	chain, err := controller.VolumeChain(ctx, volumeId)
+
+	require.NoError(t, err)
+	require.Len(t, chain, 2)
+	assert.Equal(t, basePath, chain[0].Path)
+	assert.Empty(t, chain[0].ParentPath)
+	assert.Equal(t, tipPath, chain[1].Path)
+	// The read-only child was made from the end of the chain
+	child, err := hyperv.GetVHD(ctx, controller.readOnlyChildPath(controller.VolumePath, volumeId, "kube01"))
+	require.NoError(t, err)
+	assert.Equal(t, tipPath, child[0].ParentPath)
+
+	_, err = controller.VolumeChain(ctx, "missing")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_InspectVolume(t *testing.T) {
+	_, controller := newSimulatedController()
+	controller.Pools = map[string]string{"ssd": "S:\\Volumes"}
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+		Parameters:    map[string]string{volumeParameterPool: "ssd", volumeParameterMaximumIOPS: "500", parameterPVCName: "data", parameterPVCNamespace: "web"},
+	})
+	for _, node := range []string{"kube01", "kube02"} {
+		_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: node, VolumeCapability: multiNodeReader})
+		require.NoError(t, err)
+	}
+
+	info, err := controller.InspectVolume(ctx, volumeId)
+
+	require.NoError(t, err)
+	assert.Equal(t, "ssd", info.Pool)
+	assert.Equal(t, controller.volumeFilePath("S:\\Volumes", volumeId, true), info.Path)
+	assert.Equal(t, int64(1024*1024*1024), info.CapacityBytes)
+	assert.Equal(t, "web", info.PVCNamespace)
+	assert.Equal(t, "data", info.PVCName)
+	require.NotNil(t, info.QoS)
+	assert.Equal(t, uint64(500), info.QoS.MaximumIOPS)
+	assert.ElementsMatch(t, []string{"kube01", "kube02"}, info.VMs)
+	assert.Len(t, info.Chain, 1)
+}
+
+func Test_ListVolumeInfo(t *testing.T) {
+	_, controller := newSimulatedController()
+	controller.Pools = map[string]string{"ssd": "S:\\Volumes"}
+	ctx := context.Background()
+	published := createTestVolume(t, controller, &csi.CreateVolumeRequest{
+		Name:          "pvc-published",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+		Parameters:    map[string]string{volumeParameterPool: "ssd", parameterPVCName: "data"},
+	})
+	detached := createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-detached"})
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: published, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+	require.NoError(t, err)
+
+	infos, err := controller.ListVolumeInfo(ctx)
+
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	byId := map[string]VolumeInfo{}
+	for _, info := range infos {
+		byId[info.VolumeId] = info
+		assert.Nil(t, info.Chain)
+	}
+	assert.Equal(t, "ssd", byId[published].Pool)
+	assert.Equal(t, int64(1024*1024*1024), byId[published].CapacityBytes)
+	assert.Equal(t, "data", byId[published].PVCName)
+	assert.Equal(t, []string{"kube01"}, byId[published].VMs)
+	assert.Equal(t, defaultPoolName, byId[detached].Pool)
+	assert.Empty(t, byId[detached].VMs)
+}
@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+// operationLocks tracks the volumes with an operation in flight. The CSI spec asks for Aborted when
+// another operation is already pending on a volume, the CO retries later.
+type operationLocks struct {
+	lock     sync.Mutex
+	inFlight map[string]bool
+}
+
+// acquire marks key as busy, returning Aborted if it already is. Call the returned func when done.
+func (l *operationLocks) acquire(key string) (func(), error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.inFlight == nil {
+		l.inFlight = map[string]bool{}
+	}
+	if l.inFlight[key] {
+		return nil, status.Errorf(codes.Aborted, "an operation for %s is already in progress", key)
+	}
+	l.inFlight[key] = true
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		delete(l.inFlight, key)
+	}, nil
+}
+
+// serialLocks runs operations on the same key one at a time, e.g. attach and detach on a VM which
+// would otherwise race for the same SCSI location
+type serialLocks struct {
+	lock  sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// acquire waits for key to be free or ctx to be done. Call the returned func when done.
+func (l *serialLocks) acquire(ctx context.Context, key string) (func(), error) {
+	l.lock.Lock()
+	if l.slots == nil {
+		l.slots = map[string]chan struct{}{}
+	}
+	slot, ok := l.slots[key]
+	if !ok {
+		slot = make(chan struct{}, 1)
+		l.slots[key] = slot
+	}
+	l.lock.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
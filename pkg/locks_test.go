@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_operationLocks(t *testing.T) {
+	var locks operationLocks
+
+	unlock, err := locks.acquire("volume")
+	require.NoError(t, err)
+	_, err = locks.acquire("volume")
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	unlockOther, err := locks.acquire("other")
+	require.NoError(t, err)
+	unlockOther()
+
+	unlock()
+	unlock, err = locks.acquire("volume")
+	assert.NoError(t, err)
+	unlock()
+}
+
+func Test_serialLocks(t *testing.T) {
+	var locks serialLocks
+	unlock, err := locks.acquire(context.Background(), "kube01")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = locks.acquire(ctx, "kube01")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	acquired := make(chan struct{})
+	go func() {
+		unlock, err := locks.acquire(context.Background(), "kube01")
+		assert.NoError(t, err)
+		close(acquired)
+		unlock()
+	}()
+	unlock()
+	<-acquired
+}
+
+// concurrentAttachHyperv records how many attaches run at once on each VM
+type concurrentAttachHyperv struct {
+	*SimulatedHyperv
+	lock       sync.Mutex
+	running    map[string]int
+	maxRunning int
+}
+
+func (h *concurrentAttachHyperv) AttachDisk(ctx context.Context, vmName string, path string) error {
+	h.lock.Lock()
+	h.running[vmName]++
+	if h.running[vmName] > h.maxRunning {
+		h.maxRunning = h.running[vmName]
+	}
+	h.lock.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+	defer func() {
+		h.lock.Lock()
+		h.running[vmName]--
+		h.lock.Unlock()
+	}()
+	return h.SimulatedHyperv.AttachDisk(ctx, vmName, path)
+}
+
+func Test_ControllerSerializesAttachPerVM(t *testing.T) {
+	simulated, controller := newSimulatedController()
+	hyperv := &concurrentAttachHyperv{SimulatedHyperv: simulated, running: map[string]int{}}
+	controller.Backend = hyperv
+
+	volumeIds := make([]string, 4)
+	for i := range volumeIds {
+		volumeIds[i] = createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: fmt.Sprintf("pvc-%d", i)})
+	}
+	var wg sync.WaitGroup
+	for _, volumeId := range volumeIds {
+		wg.Add(1)
+		go func(volumeId string) {
+			defer wg.Done()
+			_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+			assert.NoError(t, err)
+		}(volumeId)
+	}
+	wg.Wait()
+
+	assert.Len(t, simulated.Attachments("kube01"), len(volumeIds))
+	assert.Equal(t, 1, hyperv.maxRunning)
+}
+
+func Test_ControllerVolumeOperationInProgress(t *testing.T) {
+	_, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+
+	unlock, err := controller.volumeLocks.acquire(volumeId)
+	require.NoError(t, err)
+
+	_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = controller.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{VolumeId: volumeId})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	unlock()
+	_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+	assert.NoError(t, err)
+}
+
+func Test_CreateVolumeInProgress(t *testing.T) {
+	_, controller := newSimulatedController()
+	unlock, err := controller.volumeLocks.acquire("pvc-1")
+	require.NoError(t, err)
+	defer unlock()
+
+	_, err = controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: singleNodeWriter})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func Test_NodeVolumeOperationInProgress(t *testing.T) {
+	driver := &HypervCsiDriver{NodeId: "kube01", DevicePath: t.TempDir()}
+	ctx := context.Background()
+	unlock, err := driver.volumeLocks.acquire("volume")
+	require.NoError(t, err)
+	defer unlock()
+
+	_, err = driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "volume", TargetPath: t.TempDir(), VolumeCapability: singleNodeWriter[0]})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = driver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "volume", TargetPath: t.TempDir()})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
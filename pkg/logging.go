@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/gofrs/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"k8s.io/klog/v2"
+	"path"
+	"time"
+)
+
+// redactedSecret replaces the values of csi_secret fields in logs
+const redactedSecret = "REDACTED"
+
+// redactSecrets returns a copy of message with every field marked csi_secret in the CSI descriptors redacted
+func redactSecrets(message proto.Message) proto.Message {
+	redacted := proto.Clone(message)
+	redactMessage(redacted.ProtoReflect())
+	return redacted
+}
+
+func redactMessage(message protoreflect.Message) {
+	message.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if secret, ok := proto.GetExtension(field.Options(), csi.E_CsiSecret).(bool); ok && secret {
+			switch {
+			case field.IsMap():
+				keys := make([]protoreflect.MapKey, 0, value.Map().Len())
+				value.Map().Range(func(key protoreflect.MapKey, _ protoreflect.Value) bool {
+					keys = append(keys, key)
+					return true
+				})
+				for _, key := range keys {
+					value.Map().Set(key, protoreflect.ValueOfString(redactedSecret))
+				}
+			case field.Kind() == protoreflect.StringKind && !field.IsList():
+				message.Set(field, protoreflect.ValueOfString(redactedSecret))
+			default:
+				message.Clear(field)
+			}
+			return true
+		}
+
+		switch {
+		case field.IsMap():
+			if field.MapValue().Kind() == protoreflect.MessageKind {
+				value.Map().Range(func(_ protoreflect.MapKey, entry protoreflect.Value) bool {
+					redactMessage(entry.Message())
+					return true
+				})
+			}
+		case field.IsList():
+			if field.Kind() == protoreflect.MessageKind {
+				for i := 0; i < value.List().Len(); i++ {
+					redactMessage(value.List().Get(i).Message())
+				}
+			}
+		case field.Kind() == protoreflect.MessageKind:
+			redactMessage(value.Message())
+		}
+		return true
+	})
+}
+
+// LoggingInterceptor gives every RPC a logger tagged with a request ID, the method and the volume and node
+// the RPC is for. The logger is passed down through the context. The request is logged with its
+// secrets redacted, and the result is logged with how long the RPC took.
+func LoggingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	logger := klog.FromContext(ctx).WithValues("requestId", uuid.Must(uuid.NewV4()).String(), "method", path.Base(info.FullMethod))
+	if request, ok := req.(interface{ GetVolumeId() string }); ok && request.GetVolumeId() != "" {
+		logger = logger.WithValues("volumeId", request.GetVolumeId())
+	}
+	if request, ok := req.(interface{ GetNodeId() string }); ok && request.GetNodeId() != "" {
+		logger = logger.WithValues("nodeId", request.GetNodeId())
+	}
+	ctx = klog.NewContext(ctx, logger)
+
+	if message, ok := req.(proto.Message); ok {
+		requestJson, _ := protojson.Marshal(redactSecrets(message))
+		logger.Info("received request", "request", string(requestJson))
+	}
+
+	start := time.Now()
+	response, err := handler(ctx, req)
+	code := status.Code(err)
+	if err != nil {
+		logger.Error(err, "request failed", "code", code.String(), "duration", time.Since(start))
+	} else {
+		logger.Info("request finished", "code", code.String(), "duration", time.Since(start))
+	}
+	return response, err
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"k8s.io/klog/v2"
+	"testing"
+)
+
+func Test_redactSecrets(t *testing.T) {
+	request := &csi.CreateVolumeRequest{
+		Name:       "pvc-1",
+		Parameters: map[string]string{volumeParameterPool: "bulk"},
+		Secrets:    map[string]string{secretPassphrase: "hunter2"},
+	}
+
+	redacted := redactSecrets(request).(*csi.CreateVolumeRequest)
+
+	assert.Equal(t, map[string]string{secretPassphrase: redactedSecret}, redacted.Secrets)
+	assert.Equal(t, "pvc-1", redacted.Name)
+	assert.Equal(t, "bulk", redacted.Parameters[volumeParameterPool])
+	// The request itself is left alone
+	assert.Equal(t, "hunter2", request.Secrets[secretPassphrase])
+}
+
+func Test_redactSecretsNested(t *testing.T) {
+	request := &csi.NodePublishVolumeRequest{
+		VolumeId: "volume",
+		Secrets:  map[string]string{secretPassphrase: "hunter2", secretPreviousPassphrase: "hunter1"},
+	}
+
+	requestJson, err := protojson.Marshal(redactSecrets(request))
+
+	require.NoError(t, err)
+	assert.NotContains(t, string(requestJson), "hunter")
+	assert.Contains(t, string(requestJson), "volume")
+}
+
+func Test_LoggingInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+	request := &csi.NodePublishVolumeRequest{VolumeId: "volume", Secrets: map[string]string{secretPassphrase: "hunter2"}}
+	base := klog.Background()
+
+	response, err := LoggingInterceptor(context.Background(), request, info, func(ctx context.Context, req any) (any, error) {
+		assert.NotEqual(t, base, klog.FromContext(ctx))
+		assert.Equal(t, request, req)
+		return "response", status.Error(codes.Aborted, "busy")
+	})
+
+	assert.Equal(t, "response", response)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Equal(t, "hunter2", request.Secrets[secretPassphrase])
+}
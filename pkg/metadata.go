@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"k8s.io/klog/v2"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Volume settings that need to outlive a single RPC are kept in an NTFS alternate data stream on the
+// volume's base VHDX so they move, and are deleted, along with the disk
+const volumeMetadataStream = "hyperv-csi"
+
+// Parameters the external-provisioner adds with --extra-create-metadata. Volumes report them back in their
+// volume context.
+const (
+	parameterPVCName      = "csi.storage.k8s.io/pvc/name"
+	parameterPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	parameterPVName       = "csi.storage.k8s.io/pv/name"
+)
+
+// maxVolumeNameLength keeps the readable part of a templated volume ID well clear of Windows' path limit
+const maxVolumeNameLength = 80
+
+type volumeMetadata struct {
+	// Name is the CreateVolume request name, it makes CreateVolume idempotent
+	Name string     `json:"name,omitempty"`
+	QoS  *volumeQoS `json:"qos,omitempty"`
+	// ClusterId is the cluster that created the volume
+	ClusterId string `json:"clusterId,omitempty"`
+	// PVCName, PVCNamespace and PVName tell host admins which claim a disk belongs to
+	PVCName      string `json:"pvcName,omitempty"`
+	PVCNamespace string `json:"pvcNamespace,omitempty"`
+	PVName       string `json:"pvName,omitempty"`
+	// DeletedAt and Pool are set when the volume is moved to the trash, Pool is where it's restored to
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	Pool      string     `json:"pool,omitempty"`
+}
+
+// volumeContext returns the Kubernetes names recorded with the volume, nil when there are none
+func (m *volumeMetadata) volumeContext() map[string]string {
+	context := map[string]string{}
+	for key, value := range map[string]string{parameterPVCName: m.PVCName, parameterPVCNamespace: m.PVCNamespace, parameterPVName: m.PVName} {
+		if value != "" {
+			context[key] = value
+		}
+	}
+	if len(context) == 0 {
+		return nil
+	}
+	return context
+}
+
+// ParseVolumeNameTemplate parses a template for the readable part of new volume IDs, e.g.
+// {{.PVCNamespace}}-{{.PVCName}}. It's run with the volume's metadata.
+func ParseVolumeNameTemplate(text string) (*template.Template, error) {
+	nameTemplate, err := template.New("volume name").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// Field names are only checked when the template runs
+	if err = nameTemplate.Execute(&strings.Builder{}, &volumeMetadata{}); err != nil {
+		return nil, err
+	}
+	return nameTemplate, nil
+}
+
+// newVolumeId returns the ID of a new volume. NameTemplate puts a readable name in front of the VHD's disk
+// identifier, the node finds the disk by the identifier's last group so it has to stay at the end.
+func (s *HypervCsiController) newVolumeId(metadata *volumeMetadata, diskIdentifier string) (string, error) {
+	if s.NameTemplate == nil {
+		return diskIdentifier, nil
+	}
+	var name strings.Builder
+	if err := s.NameTemplate.Execute(&name, metadata); err != nil {
+		return "", fmt.Errorf("couldn't render volume name: %w", err)
+	}
+	// Only lowercase letters, digits and dashes so the name can't look like a read-only child's infix
+	readable := strings.Map(func(char rune) rune {
+		if char >= 'a' && char <= 'z' || char >= '0' && char <= '9' {
+			return char
+		}
+		return '-'
+	}, strings.ToLower(name.String()))
+	if len(readable) > maxVolumeNameLength {
+		readable = readable[:maxVolumeNameLength]
+	}
+	readable = strings.Trim(readable, "-")
+	if readable == "" {
+		return diskIdentifier, nil
+	}
+	return readable + "-" + diskIdentifier, nil
+}
+
+// validVolumeId reports whether volumeId is a disk identifier, with or without a readable name in front
+func validVolumeId(volumeId string) bool {
+	if len(volumeId) < len(uuid.Nil.String()) {
+		return false
+	}
+	_, err := uuid.FromString(volumeId[len(volumeId)-len(uuid.Nil.String()):])
+	return err == nil
+}
+
+// listVolumeMetadata returns the metadata of every volume with the prefix by volume ID
+func (s *HypervCsiController) listVolumeMetadata(ctx context.Context) (map[string]*volumeMetadata, error) {
+	streams, err := s.backend().ReadStreams(ctx, s.poolDirectories(), s.volumePrefix(), volumeMetadataStream)
+	if err != nil {
+		return nil, err
+	}
+	volumes := map[string]*volumeMetadata{}
+	for volumeFile, output := range streams {
+		metadata, err := parseVolumeMetadata(output)
+		if err != nil {
+			klog.ErrorS(err, "skipping volume with unreadable metadata", "file", volumeFile, "output", output)
+			continue
+		}
+		volumes[strings.TrimPrefix(strings.TrimSuffix(volumeFile, ".vhdx"), s.volumePrefix())] = metadata
+	}
+	return volumes, nil
+}
+
+func parseVolumeMetadata(output string) (*volumeMetadata, error) {
+	metadata := &volumeMetadata{}
+	if output != "" {
+		if err := json.Unmarshal([]byte(output), metadata); err != nil {
+			return nil, err
+		}
+	}
+	return metadata, nil
+}
+
+func (s *HypervCsiController) writeVolumeMetadata(ctx context.Context, path string, metadata *volumeMetadata) error {
+	metadataJson, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	err = s.backend().WriteFile(ctx, path, volumeMetadataStream, string(metadataJson))
+	if err != nil {
+		klog.ErrorS(err, "couldn't write volume metadata", "path", path)
+	}
+	return err
+}
+
+func (s *HypervCsiController) getVolumeMetadata(ctx context.Context, volumeId string) (*volumeMetadata, error) {
+	directory, err := s.volumeDirectory(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := s.backend().ReadFile(ctx, s.volumeFilePath(directory, volumeId, true), volumeMetadataStream)
+	if err != nil {
+		klog.ErrorS(err, "couldn't read volume metadata", "volumeId", volumeId)
+		return nil, err
+	}
+
+	metadata, err := parseVolumeMetadata(output)
+	if err != nil {
+		klog.ErrorS(err, "couldn't unmarshal volume metadata", "volumeId", volumeId, "output", output)
+	}
+	return metadata, err
+}
+
+func (s *HypervCsiController) setVolumeMetadata(ctx context.Context, volumeId string, metadata *volumeMetadata) error {
+	directory, err := s.volumeDirectory(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+	return s.writeVolumeMetadata(ctx, s.volumeFilePath(directory, volumeId, true), metadata)
+}
+
+// findVolumeByName returns the ID of the volume created for a CreateVolume request name, or "" if there's none
+func (s *HypervCsiController) findVolumeByName(ctx context.Context, name string) (string, error) {
+	volumes, err := s.listVolumeMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for volumeId, metadata := range volumes {
+		// A temp volume with the name is a CreateVolume that stopped before the rename, it has to be finished
+		if strings.HasPrefix(volumeId, tempVolumePrefix) {
+			continue
+		}
+		if metadata.Name == name && s.ownsVolume(metadata) {
+			return volumeId, nil
+		}
+	}
+	return "", nil
+}
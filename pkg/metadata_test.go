@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"testing"
+)
+
+var extraCreateMetadata = map[string]string{
+	parameterPVCName:      "data",
+	parameterPVCNamespace: "Team.Apps",
+	parameterPVName:       "pvc-0b7a7a52-4c33-4a1c-a7ad-b0bbde8b1f63",
+}
+
+func Test_CreateVolumeRecordsKubernetesNames(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	parameters := map[string]string{volumeParameterEncrypted: "true"}
+	for key, value := range extraCreateMetadata {
+		parameters[key] = value
+	}
+
+	response, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-0b7a7a52-4c33-4a1c-a7ad-b0bbde8b1f63",
+		VolumeCapabilities: singleNodeWriter,
+		Parameters:         parameters,
+	})
+	require.NoError(t, err)
+	volumeId := response.Volume.VolumeId
+	assert.Equal(t, parameters, response.Volume.VolumeContext)
+
+	// Kept with the VHDX for host admins
+	output, err := hyperv.ReadFile(ctx, controller.volumeFilePath(controller.VolumePath, volumeId, true), volumeMetadataStream)
+	require.NoError(t, err)
+	assert.Contains(t, output, `"pvcName":"data","pvcNamespace":"Team.Apps","pvName":"pvc-0b7a7a52-4c33-4a1c-a7ad-b0bbde8b1f63"`)
+
+	volumes, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	require.Len(t, volumes.Entries, 1)
+	assert.Equal(t, extraCreateMetadata, volumes.Entries[0].Volume.VolumeContext)
+
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeId,
+		NodeId:           "kube01",
+		VolumeCapability: singleNodeWriter[0],
+	})
+	require.NoError(t, err)
+	volume, err := controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeId})
+	require.NoError(t, err)
+	assert.Equal(t, volumeId, volume.Volume.VolumeId)
+	assert.Equal(t, int64(defaultCapacity*1024*1024*1024), volume.Volume.CapacityBytes)
+	assert.Equal(t, extraCreateMetadata, volume.Volume.VolumeContext)
+	assert.Equal(t, []string{"kube01"}, volume.Status.PublishedNodeIds)
+}
+
+func Test_ControllerGetVolumeNotFound(t *testing.T) {
+	_, controller := newSimulatedController()
+	ctx := context.Background()
+
+	_, err := controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "eab72431-5d15-4152-a8d1-5cf4ea41627e"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_CreateVolumeNameTemplate(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	var err error
+	controller.NameTemplate, err = ParseVolumeNameTemplate("{{.PVCNamespace}}_{{.PVCName}}")
+	require.NoError(t, err)
+
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{Parameters: extraCreateMetadata})
+
+	assert.True(t, strings.HasPrefix(volumeId, "team-apps-data-"), volumeId)
+	assert.True(t, validVolumeId(volumeId))
+	vhds, err := hyperv.GetVHD(ctx, controller.volumeFilePath(controller.VolumePath, volumeId, true))
+	require.NoError(t, err)
+	// The node finds the disk by the identifier at the end of the ID
+	assert.Equal(t, volumeDeviceSuffix(vhds[0].DiskIdentifier), volumeDeviceSuffix(volumeId))
+
+	// A repeated request finds the renamed volume
+	assert.Equal(t, volumeId, createTestVolume(t, controller, &csi.CreateVolumeRequest{Parameters: extraCreateMetadata}))
+
+	// Without --extra-create-metadata there's no name to put in front
+	plainId := createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-plain"})
+	_, err = hyperv.GetVHD(ctx, controller.volumeFilePath(controller.VolumePath, plainId, true))
+	require.NoError(t, err)
+	assert.True(t, validVolumeId(plainId))
+	assert.Len(t, plainId, len("eab72431-5d15-4152-a8d1-5cf4ea41627e"))
+
+	// Templated IDs work as page tokens
+	volumes, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 1})
+	require.NoError(t, err)
+	require.NotEmpty(t, volumes.NextToken)
+	next, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: volumes.NextToken})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{volumeId, plainId}, []string{volumes.Entries[0].Volume.VolumeId, next.Entries[0].Volume.VolumeId})
+}
+
+func Test_ParseVolumeNameTemplate(t *testing.T) {
+	_, err := ParseVolumeNameTemplate("{{.PVCName")
+	assert.Error(t, err)
+	_, err = ParseVolumeNameTemplate("{{.Namespace}}")
+	assert.ErrorContains(t, err, "can't evaluate field Namespace")
+
+	controller := &HypervCsiController{}
+	controller.NameTemplate, err = ParseVolumeNameTemplate("{{.PVName}}")
+	require.NoError(t, err)
+	volumeId, err := controller.newVolumeId(&volumeMetadata{PVName: strings.Repeat("x", 200)}, "eab72431-5d15-4152-a8d1-5cf4ea41627e")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("x", maxVolumeNameLength)+"-eab72431-5d15-4152-a8d1-5cf4ea41627e", volumeId)
+}
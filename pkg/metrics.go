@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const metricsNamespace = "hyperv_csi"
+
+// Hyper-V operations are slow, attaches and New-VHD regularly take several seconds
+var operationBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+var (
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of CSI RPCs by method and gRPC status code",
+		Buckets:   operationBuckets,
+	}, []string{"method", "code"})
+	rpcInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_in_flight",
+		Help:      "CSI RPCs currently being handled by method",
+	}, []string{"method"})
+	powerShellDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "powershell_duration_seconds",
+		Help:      "Duration of PowerShell commands run on Hyper-V hosts",
+		Buckets:   operationBuckets,
+	})
+	powerShellExitCodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "powershell_exit_codes_total",
+		Help:      "PowerShell commands that completed, by exit code",
+	}, []string{"exit_code"})
+	powerShellTransportErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "powershell_transport_errors_total",
+		Help:      "PowerShell commands that failed to run because of a WinRM error",
+	})
+	nodeOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_operation_duration_seconds",
+		Help:      "Duration of node partition, format, mount and unmount operations",
+		Buckets:   operationBuckets,
+	}, []string{"operation"})
+	provisionedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "provisioned_bytes",
+		Help:      "Virtual size of all volumes in each pool, updated by ListVolumes",
+	}, []string{"pool"})
+	credentialReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "credential_reloads_total",
+		Help:      "Reloads of changed credential files by result",
+	}, []string{"result"})
+	reconcileFindings = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconcile_findings",
+		Help:      "Orphaned volumes, temp files and stale attachments found by the last reconcile, by kind",
+	}, []string{"kind"})
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		rpcDuration,
+		rpcInFlight,
+		powerShellDuration,
+		powerShellExitCodes,
+		powerShellTransportErrors,
+		nodeOperationDuration,
+		provisionedBytes,
+		credentialReloads,
+		reconcileFindings,
+	)
+}
+
+// MetricsHandler serves the driver's metrics in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// MetricsInterceptor records the latency, result and concurrency of every RPC
+func MetricsInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	method := path.Base(info.FullMethod)
+	rpcInFlight.WithLabelValues(method).Inc()
+	defer rpcInFlight.WithLabelValues(method).Dec()
+
+	start := time.Now()
+	response, err := handler(ctx, req)
+	rpcDuration.WithLabelValues(method, status.Code(err).String()).Observe(time.Since(start).Seconds())
+	return response, err
+}
+
+func observePowerShell(start time.Time, exitCode int, err error) {
+	powerShellDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		powerShellTransportErrors.Inc()
+		return
+	}
+	powerShellExitCodes.WithLabelValues(strconv.Itoa(exitCode)).Inc()
+}
+
+// metricsMounter times the slow node operations
+type metricsMounter struct {
+	Mounter
+}
+
+func observeNodeOperation(operation string, start time.Time) {
+	nodeOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func (m metricsMounter) Partition(ctx context.Context, device string, fsType string) error {
+	defer observeNodeOperation("partition", time.Now())
+	return m.Mounter.Partition(ctx, device, fsType)
+}
+
+func (m metricsMounter) Format(ctx context.Context, device string, fsType string) error {
+	defer observeNodeOperation("format", time.Now())
+	return m.Mounter.Format(ctx, device, fsType)
+}
+
+func (m metricsMounter) GrowFilesystem(ctx context.Context, device string, fsType string, mountPoint string) error {
+	defer observeNodeOperation("grow_filesystem", time.Now())
+	return m.Mounter.GrowFilesystem(ctx, device, fsType, mountPoint)
+}
+
+func (m metricsMounter) Mount(ctx context.Context, device string, target string, options []string) error {
+	defer observeNodeOperation("mount", time.Now())
+	return m.Mounter.Mount(ctx, device, target, options)
+}
+
+func (m metricsMounter) Unmount(ctx context.Context, target string) error {
+	defer observeNodeOperation("unmount", time.Now())
+	return m.Mounter.Unmount(ctx, target)
+}
+
+// updateProvisionedBytes sets the provisioned bytes gauge from the size of every volume in every pool.
+// It's best effort, a failure only leaves the gauge stale.
+func (s *HypervCsiController) updateProvisionedBytes(ctx context.Context) {
+	volumePath := s.volumePath()
+	pools := map[string]string{defaultPoolName: volumePath}
+	for name, directory := range s.Pools {
+		if directory != volumePath {
+			pools[name] = directory
+		}
+	}
+
+	for pool, directory := range pools {
+		vhds, err := s.backend().GetVHD(ctx, s.volumeFilePath(directory, "", false))
+		if err != nil && !errors.Is(err, ErrVHDNotFound) {
+			klog.ErrorS(err, "couldn't measure provisioned bytes", "pool", pool)
+			continue
+		}
+		var total int64
+		for _, vhd := range vhds {
+			// Differencing disks share their parent's virtual size
+			if vhd.ParentPath == "" && !strings.Contains(vhd.Path, readOnlyChildInfix) {
+				total += vhd.Size
+			}
+		}
+		provisionedBytes.WithLabelValues(pool).Set(float64(total))
+	}
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http/httptest"
+	"testing"
+)
+
+// histogramCount returns how many observations a histogram with the given labels has
+func histogramCount(t *testing.T, histogram *prometheus.HistogramVec, labels ...string) uint64 {
+	metric := &dto.Metric{}
+	require.NoError(t, histogram.WithLabelValues(labels...).(prometheus.Metric).Write(metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func Test_MetricsInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	before := histogramCount(t, rpcDuration, "ControllerPublishVolume", "NotFound")
+
+	_, err := MetricsInterceptor(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+		assert.Equal(t, 1.0, testutil.ToFloat64(rpcInFlight.WithLabelValues("ControllerPublishVolume")))
+		return nil, status.Error(codes.NotFound, "")
+	})
+
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, before+1, histogramCount(t, rpcDuration, "ControllerPublishVolume", "NotFound"))
+	assert.Zero(t, testutil.ToFloat64(rpcInFlight.WithLabelValues("ControllerPublishVolume")))
+}
+
+func Test_PowerShellMetrics(t *testing.T) {
+	exitCodes := testutil.ToFloat64(powerShellExitCodes.WithLabelValues("3"))
+	transportErrors := testutil.ToFloat64(powerShellTransportErrors)
+
+	backend := newPowerShellBackend(mockWinRmClient{ReturnCode: 3}, nil)
+	backend.psRun(context.Background(), "exit 3")
+	backend = newPowerShellBackend(mockWinRmClient{ReturnCode: 1, Error: errors.New("connection refused")}, nil)
+	backend.psRun(context.Background(), "exit 0")
+
+	assert.Equal(t, exitCodes+1, testutil.ToFloat64(powerShellExitCodes.WithLabelValues("3")))
+	assert.Equal(t, transportErrors+1, testutil.ToFloat64(powerShellTransportErrors))
+}
+
+func Test_ListVolumesProvisionedBytes(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	controller.Pools = map[string]string{"bulk": "E:\\Hyper-V\\Virtual Hard Disks"}
+	createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30}})
+	createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-2", CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30}})
+	readOnlyVolume := createTestVolume(t, controller, &csi.CreateVolumeRequest{
+		Name:          "pvc-3",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 4 << 30},
+		Parameters:    map[string]string{volumeParameterPool: "bulk"},
+	})
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: readOnlyVolume,
+		NodeId:   "kube01",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+
+	assert.Equal(t, float64(3<<30), testutil.ToFloat64(provisionedBytes.WithLabelValues(defaultPoolName)))
+	// The read-only child doesn't count
+	assert.Equal(t, float64(4<<30), testutil.ToFloat64(provisionedBytes.WithLabelValues("bulk")))
+	assert.NotZero(t, hyperv.Calls("GetVHD"))
+}
+
+func Test_MetricsHandler(t *testing.T) {
+	powerShellTransportErrors.Add(0)
+	recorder := httptest.NewRecorder()
+
+	MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "hyperv_csi_powershell_transport_errors_total")
+	assert.Contains(t, recorder.Body.String(), "go_goroutines")
+}
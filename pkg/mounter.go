@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s.io/klog/v2"
+	"os/exec"
+	"strings"
+)
+
+// Mounter is everything the node needs to prepare and mount a block device. Devices are paths under the
+// driver's device tree, e.g. /dev/disk/by-id/wwn-...-part1.
+type Mounter interface {
+	// Partition creates a GPT label with a single partition spanning the disk
+	Partition(ctx context.Context, device string, fsType string) error
+	// GrowPartition grows the first partition to fill the disk
+	GrowPartition(ctx context.Context, device string) error
+	// FilesystemType returns the filesystem on a device, or "" if it has none
+	FilesystemType(ctx context.Context, device string) (string, error)
+	Format(ctx context.Context, device string, fsType string) error
+	// GrowFilesystem grows a filesystem to fill its device, mountPoint is where the device is mounted
+	GrowFilesystem(ctx context.Context, device string, fsType string, mountPoint string) error
+	Mount(ctx context.Context, device string, target string, options []string) error
+	Unmount(ctx context.Context, target string) error
+	IsMounted(ctx context.Context, target string) (bool, error)
+	// DeviceMounted is true while device is mounted anywhere
+	DeviceMounted(ctx context.Context, device string) (bool, error)
+	// CheckTools returns an error naming every tool missing to partition, mount, format and grow fsTypes
+	CheckTools(ctx context.Context, fsTypes []string) error
+}
+
+// execMounter runs the usual util-linux, parted and filesystem tools
+type execMounter struct{}
+
+func (m execMounter) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("running command", "command", name, "args", args)
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		logger.Error(err, "command failed", "command", name, "args", args, "output", string(out))
+	}
+	return out, err
+}
+
+func (m execMounter) Partition(ctx context.Context, device string, fsType string) error {
+	_, err := m.run(ctx, "parted", device, "--script", "-a", "optimal", "mklabel", "gpt", "mkpart", "primary", fsType, "0%", "100%")
+	return err
+}
+
+func (m execMounter) GrowPartition(ctx context.Context, device string) error {
+	_, err := m.run(ctx, "parted", device, "--script", "resizepart", "1", "100%")
+	return err
+}
+
+func (m execMounter) FilesystemType(ctx context.Context, device string) (string, error) {
+	out, err := exec.CommandContext(ctx, "blkid", "-o", "value", "-s", "TYPE", device).Output()
+	// blkid exits 2 when it finds no filesystem at all
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		return "", nil
+	}
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "couldn't determine partition fstype", "partition", device, "output", string(out))
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (m execMounter) Format(ctx context.Context, device string, fsType string) error {
+	_, err := m.run(ctx, "mkfs", "-t", fsType, device)
+	return err
+}
+
+func (m execMounter) GrowFilesystem(ctx context.Context, device string, fsType string, mountPoint string) error {
+	var err error
+	switch fsType {
+	case "xfs":
+		// xfs can only be grown through its mount point
+		_, err = m.run(ctx, "xfs_growfs", mountPoint)
+	case "ext2", "ext3", "ext4":
+		_, err = m.run(ctx, "resize2fs", device)
+	default:
+		err = errors.New("can't resize " + fsType + " filesystem")
+	}
+	return err
+}
+
+func (m execMounter) Mount(ctx context.Context, device string, target string, options []string) error {
+	args := make([]string, 0)
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	_, err := m.run(ctx, "mount", append(args, device, target)...)
+	return err
+}
+
+func (m execMounter) Unmount(ctx context.Context, target string) error {
+	_, err := m.run(ctx, "umount", target)
+	return err
+}
+
+func (m execMounter) IsMounted(ctx context.Context, target string) (bool, error) {
+	// mountpoint exits non-zero for anything that isn't a mount point, including missing paths
+	err := exec.CommandContext(ctx, "mountpoint", "-q", target).Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m execMounter) DeviceMounted(ctx context.Context, device string) (bool, error) {
+	// findmnt exits 1 when nothing matches
+	err := exec.CommandContext(ctx, "findmnt", "--source", device).Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// mountTools are needed whatever the filesystem
+var mountTools = []string{"parted", "blkid", "mkfs", "mount", "umount", "mountpoint", "findmnt"}
+
+// filesystemTools are needed to format and grow each filesystem
+var filesystemTools = map[string][]string{
+	"ext2": {"mkfs.ext2", "resize2fs"},
+	"ext3": {"mkfs.ext3", "resize2fs"},
+	"ext4": {"mkfs.ext4", "resize2fs"},
+	"xfs":  {"mkfs.xfs", "xfs_growfs"},
+}
+
+func (m execMounter) CheckTools(ctx context.Context, fsTypes []string) error {
+	tools := append([]string{}, mountTools...)
+	for _, fsType := range fsTypes {
+		tools = append(tools, filesystemTools[fsType]...)
+	}
+
+	missing := make([]string, 0)
+	seen := map[string]bool{}
+	for _, tool := range tools {
+		if seen[tool] {
+			continue
+		}
+		seen[tool] = true
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
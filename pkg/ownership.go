@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"sort"
+)
+
+// Several Kubernetes clusters can share a host and its volume path. Each cluster claims its volume prefix in
+// every pool directory and tags the volumes it creates with its cluster ID so it never lists, publishes or
+// deletes another cluster's volumes. Without a cluster ID volumes aren't tagged and only the claims are checked.
+
+// volumeOwnerFileName follows the volume prefix, e.g. pv-owner.json
+const volumeOwnerFileName = "owner.json"
+
+// ErrVolumePrefixOwned is returned when another cluster has claimed the volume prefix
+var ErrVolumePrefixOwned = errors.New("volume prefix belongs to another cluster")
+
+type volumeOwner struct {
+	ClusterId string `json:"clusterId"`
+}
+
+func (s *HypervCsiController) ownerFilePath(directory string) string {
+	return directory + "\\" + s.volumePrefix() + volumeOwnerFileName
+}
+
+// ownsVolume reports whether a volume belongs to this cluster. Volumes from before cluster IDs have none and
+// belong to whichever cluster claimed their prefix.
+func (s *HypervCsiController) ownsVolume(metadata *volumeMetadata) bool {
+	return metadata.ClusterId == "" || metadata.ClusterId == s.ClusterId
+}
+
+// checkVolumeOwner returns an error for a volume owned by another cluster
+func (s *HypervCsiController) checkVolumeOwner(ctx context.Context, volumeId string) error {
+	if s.ClusterId == "" {
+		return nil
+	}
+	metadata, err := s.getVolumeMetadata(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+	if !s.ownsVolume(metadata) {
+		return status.Errorf(codes.FailedPrecondition, "volume %s belongs to cluster %q", volumeId, metadata.ClusterId)
+	}
+	return nil
+}
+
+// foreignVolumes returns the IDs of volumes with the prefix that another cluster tagged, and the cluster's ID
+func (s *HypervCsiController) foreignVolumes(ctx context.Context) (map[string]string, error) {
+	if s.ClusterId == "" {
+		return map[string]string{}, nil
+	}
+	volumes, err := s.listVolumeMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.foreignIn(volumes), nil
+}
+
+// foreignIn picks the volumes another cluster tagged out of volumes
+func (s *HypervCsiController) foreignIn(volumes map[string]*volumeMetadata) map[string]string {
+	foreign := map[string]string{}
+	if s.ClusterId == "" {
+		return foreign
+	}
+	for volumeId, metadata := range volumes {
+		if !s.ownsVolume(metadata) {
+			foreign[volumeId] = metadata.ClusterId
+		}
+	}
+	return foreign
+}
+
+// ClaimVolumePrefix claims the volume prefix in every pool directory for ClusterId. It fails with
+// ErrVolumePrefixOwned when another cluster claimed the prefix or tagged volumes with it.
+func (s *HypervCsiController) ClaimVolumePrefix(ctx context.Context) error {
+	if s.volumePath() == "" {
+		return errors.New("volume path isn't known yet")
+	}
+
+	unclaimed := make([]string, 0)
+	for _, directory := range s.poolDirectories() {
+		output, err := s.backend().ReadFile(ctx, s.ownerFilePath(directory), "")
+		if err != nil {
+			return err
+		}
+		if output == "" {
+			unclaimed = append(unclaimed, directory)
+			continue
+		}
+		owner := volumeOwner{}
+		if err = json.Unmarshal([]byte(output), &owner); err != nil {
+			return fmt.Errorf("couldn't unmarshal %s: %w", s.ownerFilePath(directory), err)
+		}
+		if owner.ClusterId != s.ClusterId {
+			return fmt.Errorf("%w: %s* in %s is claimed by cluster %q", ErrVolumePrefixOwned, s.volumePrefix(), directory, owner.ClusterId)
+		}
+	}
+
+	foreign, err := s.foreignVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(foreign) > 0 {
+		volumeIds := make([]string, 0, len(foreign))
+		for volumeId := range foreign {
+			volumeIds = append(volumeIds, volumeId)
+		}
+		sort.Strings(volumeIds)
+		return fmt.Errorf("%w: volume %s is tagged with cluster %q", ErrVolumePrefixOwned, volumeIds[0], foreign[volumeIds[0]])
+	}
+
+	// Without a cluster ID there's nothing to claim the prefix with
+	if s.ClusterId == "" {
+		s.prefixClaimed.Store(true)
+		return nil
+	}
+	ownerJson, err := json.Marshal(volumeOwner{ClusterId: s.ClusterId})
+	if err != nil {
+		return err
+	}
+	for _, directory := range unclaimed {
+		klog.InfoS("claiming volume prefix", "prefix", s.volumePrefix(), "directory", directory, "clusterId", s.ClusterId)
+		if err = s.backend().WriteFile(ctx, s.ownerFilePath(directory), "", string(ownerJson)); err != nil {
+			return err
+		}
+	}
+	s.prefixClaimed.Store(true)
+	return nil
+}
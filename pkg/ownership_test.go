@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// newClusterControllers returns two clusters' controllers sharing a simulated host and volume path
+func newClusterControllers(stagingPrefix string) (*SimulatedHyperv, *HypervCsiController, *HypervCsiController) {
+	hyperv, prod := newSimulatedController()
+	prod.ClusterId = "prod"
+	staging := &HypervCsiController{VolumePath: prod.VolumePath, Backend: hyperv, ClusterId: "staging", VolumePrefix: stagingPrefix}
+	return hyperv, prod, staging
+}
+
+func Test_ClaimVolumePrefix(t *testing.T) {
+	hyperv, prod, staging := newClusterControllers("")
+	ctx := context.Background()
+
+	require.NoError(t, prod.ClaimVolumePrefix(ctx))
+	owner, err := hyperv.ReadFile(ctx, prod.VolumePath+"\\pv-owner.json", "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"clusterId": "prod"}`, owner)
+	// Claiming again is a no-op
+	require.NoError(t, prod.ClaimVolumePrefix(ctx))
+
+	err = staging.ClaimVolumePrefix(ctx)
+	assert.ErrorIs(t, err, ErrVolumePrefixOwned)
+	assert.ErrorContains(t, err, `pv-* in V:\Hyper-V\Virtual Hard Disks is claimed by cluster "prod"`)
+	// A controller without a cluster ID can't use a claimed prefix either
+	assert.ErrorIs(t, (&HypervCsiController{VolumePath: prod.VolumePath, Backend: hyperv}).ClaimVolumePrefix(ctx), ErrVolumePrefixOwned)
+
+	staging.VolumePrefix = "staging-"
+	assert.NoError(t, staging.ClaimVolumePrefix(ctx))
+}
+
+func Test_ClaimVolumePrefixTaggedVolumes(t *testing.T) {
+	hyperv, prod, staging := newClusterControllers("")
+	ctx := context.Background()
+	createTestVolume(t, prod, &csi.CreateVolumeRequest{})
+	// e.g. the claim was deleted by hand
+	require.NoError(t, hyperv.DeleteFile(ctx, prod.VolumePath+"\\pv-owner.json"))
+
+	err := staging.ClaimVolumePrefix(ctx)
+
+	assert.ErrorIs(t, err, ErrVolumePrefixOwned)
+	assert.ErrorContains(t, err, `is tagged with cluster "prod"`)
+}
+
+func Test_ClaimVolumePrefixProbe(t *testing.T) {
+	_, prod, staging := newClusterControllers("")
+	ctx := context.Background()
+	require.NoError(t, prod.ClaimVolumePrefix(ctx))
+
+	_, err := staging.Probe(ctx, &csi.ProbeRequest{})
+
+	assert.ErrorContains(t, err, "volume prefix")
+}
+
+func Test_ForeignVolumesIgnored(t *testing.T) {
+	// Both clusters share the prefix, e.g. volumes tagged before one of them was given its own
+	hyperv, prod, staging := newClusterControllers("")
+	ctx := context.Background()
+	prodVolume := createTestVolume(t, prod, &csi.CreateVolumeRequest{Name: "pvc-prod"})
+	stagingVolume := createTestVolume(t, staging, &csi.CreateVolumeRequest{Name: "pvc-staging"})
+
+	volumes, err := staging.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	require.Len(t, volumes.Entries, 1)
+	assert.Equal(t, stagingVolume, volumes.Entries[0].Volume.VolumeId)
+
+	// The same request name in another cluster is a different volume
+	sameName := createTestVolume(t, staging, &csi.CreateVolumeRequest{Name: "pvc-prod"})
+	assert.NotEqual(t, prodVolume, sameName)
+
+	_, err = staging.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         prodVolume,
+		NodeId:           "kube01",
+		VolumeCapability: singleNodeWriter[0],
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Empty(t, hyperv.Attachments("kube01"))
+
+	_, err = staging.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: prodVolume})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = prod.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: prodVolume})
+	assert.NoError(t, err)
+
+	_, err = staging.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: prodVolume})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.ErrorContains(t, err, `belongs to cluster "prod"`)
+	_, err = hyperv.GetVHD(ctx, prod.volumeFilePath(prod.VolumePath, prodVolume, true))
+	assert.NoError(t, err)
+
+	_, err = prod.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: prodVolume})
+	assert.NoError(t, err)
+}
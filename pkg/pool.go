@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"sort"
+)
+
+// StorageClass/VolumeAttributesClass parameter selecting which pool (directory) holds a volume
+const volumeParameterPool = "pool"
+
+// The pool backed by VolumePath
+const defaultPoolName = "default"
+
+// Volumes keep their ID when they move between pools so which pool holds each volume is recorded in
+// an index file in the default pool. Volumes missing from the index are in the default pool.
+const volumeIndexFileName = "hyperv-csi-index.json"
+
+type volumeIndex struct {
+	Pools map[string]string `json:"pools"`
+}
+
+func (s *HypervCsiController) volumeFilePath(directory string, name string, withExtension bool) string {
+	extension := ""
+	if withExtension {
+		extension = ".vhdx"
+	}
+	return directory + "\\" + s.volumePrefix() + name + extension
+}
+
+func (s *HypervCsiController) poolDirectory(pool string) (string, error) {
+	if pool == "" || pool == defaultPoolName {
+		return s.volumePath(), nil
+	}
+	directory, ok := s.Pools[pool]
+	if !ok {
+		return "", status.Errorf(codes.InvalidArgument, "unknown pool %q", pool)
+	}
+	return directory, nil
+}
+
+// poolDirectories returns the directory of every pool, default first
+func (s *HypervCsiController) poolDirectories() []string {
+	names := make([]string, 0, len(s.Pools))
+	for name := range s.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	volumePath := s.volumePath()
+	directories := []string{volumePath}
+	for _, name := range names {
+		if s.Pools[name] != volumePath {
+			directories = append(directories, s.Pools[name])
+		}
+	}
+	return directories
+}
+
+func (s *HypervCsiController) loadVolumeIndex(ctx context.Context) (*volumeIndex, error) {
+	index := &volumeIndex{Pools: map[string]string{}}
+	// Single pool setups never need the index
+	if len(s.Pools) == 0 {
+		return index, nil
+	}
+
+	output, err := s.backend().ReadFile(ctx, s.volumePath()+"\\"+volumeIndexFileName, "")
+	if err != nil {
+		klog.ErrorS(err, "couldn't read volume index")
+		return nil, err
+	}
+
+	if output != "" {
+		if err := json.Unmarshal([]byte(output), index); err != nil {
+			klog.ErrorS(err, "couldn't unmarshal volume index", "output", output)
+			return nil, err
+		}
+	}
+	if index.Pools == nil {
+		index.Pools = map[string]string{}
+	}
+	return index, nil
+}
+
+func (s *HypervCsiController) saveVolumeIndex(ctx context.Context, index *volumeIndex) error {
+	indexJson, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	err = s.backend().WriteFile(ctx, s.volumePath()+"\\"+volumeIndexFileName, "", string(indexJson))
+	if err != nil {
+		klog.ErrorS(err, "couldn't write volume index")
+	}
+	return err
+}
+
+// setVolumePool records which pool holds a volume. An empty pool removes the volume from the index.
+func (s *HypervCsiController) setVolumePool(ctx context.Context, volumeId string, pool string) error {
+	if len(s.Pools) == 0 {
+		return nil
+	}
+
+	s.poolLock.Lock()
+	defer s.poolLock.Unlock()
+
+	index, err := s.loadVolumeIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if pool == "" || pool == defaultPoolName {
+		delete(index.Pools, volumeId)
+	} else {
+		index.Pools[volumeId] = pool
+	}
+	return s.saveVolumeIndex(ctx, index)
+}
+
+func (s *HypervCsiController) volumePool(ctx context.Context, volumeId string) (string, error) {
+	if len(s.Pools) == 0 {
+		return defaultPoolName, nil
+	}
+
+	s.poolLock.Lock()
+	defer s.poolLock.Unlock()
+
+	index, err := s.loadVolumeIndex(ctx)
+	if err != nil {
+		return "", err
+	}
+	if pool, ok := index.Pools[volumeId]; ok {
+		return pool, nil
+	}
+	return defaultPoolName, nil
+}
+
+// volumeDirectory returns the directory of the pool holding a volume
+func (s *HypervCsiController) volumeDirectory(ctx context.Context, volumeId string) (string, error) {
+	pool, err := s.volumePool(ctx, volumeId)
+	if err != nil {
+		return "", err
+	}
+	return s.poolDirectory(pool)
+}
+
+// MigrateVolume moves a volume and its differencing chain to another pool without changing its ID.
+// Attached volumes are moved live with Move-VMStorage, detached ones are copied then swapped.
+func (s *HypervCsiController) MigrateVolume(ctx context.Context, volumeId string, pool string) error {
+	sourcePool, err := s.volumePool(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+	sourceDirectory, err := s.poolDirectory(sourcePool)
+	if err != nil {
+		return err
+	}
+	destinationDirectory, err := s.poolDirectory(pool)
+	if err != nil {
+		return err
+	}
+	if sourceDirectory == destinationDirectory {
+		klog.InfoS("volume already in pool", "volumeId", volumeId, "pool", pool)
+		return nil
+	}
+
+	attachments, err := s.backend().ListAttachments(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+	// Move-VMStorage copies the disk contents but not necessarily its alternate data streams
+	metadata, err := s.getVolumeMetadata(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+	if !s.ownsVolume(metadata) {
+		return status.Errorf(codes.FailedPrecondition, "volume %s belongs to cluster %q", volumeId, metadata.ClusterId)
+	}
+
+	source := s.volumeFilePath(sourceDirectory, volumeId, false)
+	switch len(attachments) {
+	case 0:
+		klog.InfoS("copying detached volume", "volumeId", volumeId, "from", sourceDirectory, "to", destinationDirectory)
+		err = s.backend().CopyVHDs(ctx, source, destinationDirectory)
+	case 1:
+		klog.InfoS("moving attached volume", "volumeId", volumeId, "vm", attachments[0].VMName, "from", sourceDirectory, "to", destinationDirectory)
+		err = s.backend().MoveAttachedVHDs(ctx, attachments[0].VMName, source, destinationDirectory)
+	default:
+		// Read-only-many volumes share their parent between several VMs so it can't be moved live
+		return status.Errorf(codes.FailedPrecondition, "volume %s is attached to %d VMs", volumeId, len(attachments))
+	}
+	if err != nil {
+		klog.ErrorS(err, "couldn't migrate volume", "volumeId", volumeId)
+		return err
+	}
+
+	if err = s.setVolumePool(ctx, volumeId, pool); err != nil {
+		return err
+	}
+
+	if len(attachments) > 0 {
+		// Move-VMStorage already removed the source files, the metadata is written again in case it was lost
+		if err = s.setVolumeMetadata(ctx, volumeId, metadata); err != nil {
+			return err
+		}
+	} else {
+		// The copied source files are left behind
+		files, err := s.volumeFiles(ctx, sourceDirectory, volumeId)
+		if err == nil {
+			err = s.backend().DeleteFiles(ctx, files)
+		}
+		if err != nil {
+			// The volume is usable from its new pool so leftovers are only logged
+			klog.ErrorS(err, "couldn't remove migrated volume source", "volumeId", volumeId)
+		}
+	}
+
+	klog.InfoS("migrated volume", "volumeId", volumeId, "pool", pool)
+	return nil
+}
@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func Test_poolDirectories(t *testing.T) {
+	_, controller := newController()
+	controller.VolumePath = "V:\\default"
+	controller.Pools = map[string]string{"slow": "S:\\slow", "fast": "F:\\fast", "alias": "V:\\default"}
+
+	assert.Equal(t, []string{"V:\\default", "F:\\fast", "S:\\slow"}, controller.poolDirectories())
+}
+
+func Test_poolDirectoryDefault(t *testing.T) {
+	_, controller := newController()
+	controller.VolumePath = "V:\\default"
+
+	for _, pool := range []string{"", defaultPoolName} {
+		directory, err := controller.poolDirectory(pool)
+		assert.Nil(t, err)
+		assert.Equal(t, "V:\\default", directory)
+	}
+}
+
+func Test_CreateVolumeUnknownPool(t *testing.T) {
+	_, controller := newController()
+	controller.Pools = map[string]string{"fast": "F:\\fast"}
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-eab72431-5d15-4152-a8d1-5cf4ea41627e",
+		VolumeCapabilities: singleNodeWriter,
+		Parameters:         map[string]string{volumeParameterPool: "slow"},
+	})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func Test_volumePoolWithoutPools(t *testing.T) {
+	mockWinRm, controller := newController()
+	// The index is never read when there's only one pool
+	mockWinRm.ReturnCode = 1
+
+	pool, err := controller.volumePool(context.Background(), "eab72431-5d15-4152-a8d1-5cf4ea41627e")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultPoolName, pool)
+}
+
+func Test_ControllerModifyVolumeMigratesDetached(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	controller.Pools = map[string]string{"fast": "F:\\fast"}
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{
+		Parameters: map[string]string{volumeParameterMaximumIOPS: "500"},
+	})
+
+	_, err := controller.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeId,
+		MutableParameters: map[string]string{volumeParameterPool: "fast"},
+	})
+	require.NoError(t, err)
+
+	pool, err := controller.volumePool(ctx, volumeId)
+	require.NoError(t, err)
+	assert.Equal(t, "fast", pool)
+	vhds, err := hyperv.GetVHD(ctx, controller.volumeFilePath("F:\\fast", volumeId, false))
+	require.NoError(t, err)
+	assert.Equal(t, volumeId, vhds[0].DiskIdentifier)
+	_, err = hyperv.GetVHD(ctx, controller.volumeFilePath(controller.VolumePath, volumeId, false))
+	assert.ErrorIs(t, err, ErrVHDNotFound)
+
+	// Metadata moved with the volume
+	metadata, err := controller.getVolumeMetadata(ctx, volumeId)
+	require.NoError(t, err)
+	assert.Equal(t, &volumeQoS{MaximumIOPS: 500}, metadata.QoS)
+}
+
+func Test_ControllerModifyVolumeMigratesAttached(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	controller.Pools = map[string]string{"fast": "F:\\fast"}
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+	require.NoError(t, err)
+
+	_, err = controller.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeId,
+		MutableParameters: map[string]string{volumeParameterPool: "fast"},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{controller.volumeFilePath("F:\\fast", volumeId, true)}, hyperv.Attachments("kube01"))
+	assert.Equal(t, 1, hyperv.Calls("MoveAttachedVHDs"))
+}
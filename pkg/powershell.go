@@ -0,0 +1,476 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/go-xmlfmt/xmlfmt"
+	"github.com/gofrs/uuid"
+	"github.com/masterzen/winrm"
+	dotnetxml "github.com/nijave/hyperv-csi/dotnet-xml"
+	"github.com/sergeymakinen/go-quote/windows"
+	"io"
+	"k8s.io/klog/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemotePowerShellRunner runs a command on a Hyper-V host, *winrm.Client is the usual implementation
+type RemotePowerShellRunner interface {
+	RunWithContext(context.Context, string, io.Writer, io.Writer) (int, error)
+}
+
+const CliXmlPrefix = "#< CLIXML"
+
+func psCommand(cmd string) string {
+	cmd = winrm.Powershell(cmd)
+	return strings.Replace(cmd, "powershell.exe", "powershell.exe -NoProfile", 1)
+}
+
+func psQuote(value string) string {
+	return windows.PSSingleQuote.Quote(value)
+}
+
+// psQuoteArray quotes values as a PowerShell array
+func psQuoteArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = psQuote(value)
+	}
+	return "@(" + strings.Join(quoted, ", ") + ")"
+}
+
+type PSRemoteObjects struct {
+	XMLName xml.Name   `xml:"Objs"`
+	Objects []PSObject `xml:",any"`
+}
+
+// PSObject is one top level CLIXML element, only primitive types are kept, see MS-PSRP 2.2.5.1
+type PSObject struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// cliXmlPrimitives are the CLIXML elements that serialize a value as text, e.g. I64 for Get-Volume's
+// SizeRemaining. C is a character as a number and handled separately.
+var cliXmlPrimitives = map[string]bool{
+	"S": true, "SB": true, "URI": true, "XD": true, "Version": true, "G": true, "B": true, "DT": true, "TS": true,
+	"By": true, "SBy": true, "U16": true, "I16": true, "U32": true, "I32": true, "U64": true, "I64": true,
+	"Sg": true, "Db": true, "D": true,
+}
+
+func (o PSObject) text() (string, bool) {
+	if o.XMLName.Local == "C" {
+		char, err := strconv.ParseUint(o.Value, 10, 16)
+		return string(rune(char)), err == nil
+	}
+	if !cliXmlPrimitives[o.XMLName.Local] {
+		return "", false
+	}
+	return strings.Replace(dotnetxml.DecodeName(o.Value), "\r\n", "\n", -1), true
+}
+
+func parseCliXml(xmlString string) string {
+	xmlString = strings.Trim(xmlString, "\r\n\t ")
+	if !strings.HasPrefix(xmlString, CliXmlPrefix) {
+		return xmlString
+	} else {
+		xmlString = strings.TrimPrefix(xmlString, CliXmlPrefix)
+	}
+
+	var psRemoteObjects PSRemoteObjects
+	err := xml.Unmarshal([]byte(xmlString), &psRemoteObjects)
+	if err != nil {
+		klog.Warning("couldn't unmarshal Powershell objects")
+		return xmlfmt.FormatXML(xmlString, "", "  ", false)
+	}
+
+	output := strings.Builder{}
+	for _, object := range psRemoteObjects.Objects {
+		value, ok := object.text()
+		if !ok {
+			continue
+		}
+		// Each object goes on its own line, like PowerShell prints them. Error records already end in a new line.
+		if output.Len() > 0 && !strings.HasSuffix(output.String(), "\n") {
+			output.WriteString("\n")
+		}
+		output.WriteString(value)
+	}
+
+	return strings.Trim(output.String(), "\r\n\t ")
+}
+
+// syncBuffer collects stdout and stderr in one buffer, winrm writes them from separate goroutines
+type syncBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+type ExecResult struct {
+	ExitCode int
+	Output   string
+	Error    error
+}
+
+// err returns the result's error, if any, treating a non-zero exit code as an error
+func (r ExecResult) err() error {
+	if r.ExitCode != 0 && r.Error == nil {
+		return errors.New("powershell error")
+	}
+	return r.Error
+}
+
+// powerShellBackend runs Hyper-V cmdlets through a remote PowerShell session
+type powerShellBackend struct {
+	runner  RemotePowerShellRunner
+	cluster *ClusterConfig
+}
+
+func newPowerShellBackend(runner RemotePowerShellRunner, cluster *ClusterConfig) *powerShellBackend {
+	return &powerShellBackend{runner: runner, cluster: cluster}
+}
+
+func (b *powerShellBackend) psRun(ctx context.Context, cmd string) ExecResult {
+	return b.psRunWith(ctx, b.runner, cmd)
+}
+
+func (b *powerShellBackend) psRunWith(ctx context.Context, client RemotePowerShellRunner, cmd string) ExecResult {
+	var bytesOut syncBuffer
+	logger := klog.FromContext(ctx)
+	logger.V(8).Info("ps command", "command", cmd)
+	ctx, endSpan := startPowerShellSpan(ctx, cmd)
+	start := time.Now()
+	exit, err := client.RunWithContext(ctx, psCommand(cmd), &bytesOut, &bytesOut)
+	observePowerShell(start, exit, err)
+	endSpan(exit, err)
+	psOutput := strings.Trim(bytesOut.String(), "\r\n\t ")
+	logger.V(8).Info("ps raw output", "rc", exit, "output", psOutput)
+	psOutput = parseCliXml(psOutput)
+
+	return ExecResult{
+		ExitCode: exit,
+		Output:   psOutput,
+		Error:    err,
+	}
+}
+
+// psRunChecked runs a command, logging and returning an error if it fails
+func (b *powerShellBackend) psRunChecked(ctx context.Context, message string, cmd string) (string, error) {
+	result := b.psRun(ctx, cmd)
+	if err := result.err(); err != nil {
+		klog.FromContext(ctx).Error(err, message, "exitCode", result.ExitCode, "output", result.Output)
+		return result.Output, err
+	}
+	return result.Output, nil
+}
+
+// psRunJson runs a command that outputs JSON and unmarshals it into value
+func (b *powerShellBackend) psRunJson(ctx context.Context, message string, cmd string, value any) error {
+	output, err := b.psRunChecked(ctx, message, cmd)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal([]byte(output), value); err != nil {
+		klog.FromContext(ctx).Error(err, "couldn't unmarshal powershell json", "output", output)
+		return err
+	}
+	return nil
+}
+
+const vhdProperties = "Path, ParentPath, @{n='DiskIdentifier'; e={$_.DiskIdentifier.ToLower()}}, Size"
+
+func (b *powerShellBackend) ListDisks(ctx context.Context, directories []string, prefix string) ([]string, error) {
+	globs := make([]string, len(directories))
+	for i, directory := range directories {
+		globs[i] = psQuote(directory + "\\" + prefix + "*.vhdx")
+	}
+	result := b.psRun(idempotent(ctx), fmt.Sprintf("Get-Item %s | ForEach-Object { $_.Name }", strings.Join(globs, ", ")))
+	if result.ExitCode != 0 || result.Error != nil {
+		if result.Error == nil {
+			result.Error = errors.New("powershell error")
+		}
+		klog.ErrorS(result.Error, "error listing disks", "exitCode", result.ExitCode, "output", result.Output)
+		return nil, result.Error
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(result.Output, "\r") {
+		if name = strings.Trim(name, "\r\n\t "); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (b *powerShellBackend) GetVHD(ctx context.Context, pathPrefix string) ([]VHD, error) {
+	var vhds []VHD
+	err := b.psRunJson(idempotent(ctx), "couldn't get vhds", fmt.Sprintf("ConvertTo-Json @(Get-VHD (%s+\"*\") -ErrorAction SilentlyContinue | Select %s)", psQuote(pathPrefix), vhdProperties), &vhds)
+	if err == nil && len(vhds) == 0 {
+		err = ErrVHDNotFound
+	}
+	return vhds, err
+}
+
+func (b *powerShellBackend) newVHD(ctx context.Context, cmd string) (VHD, error) {
+	var vhd VHD
+	if err := b.psRunJson(ctx, "couldn't create vhd", cmd+fmt.Sprintf(" | Select %s | ConvertTo-Json", vhdProperties), &vhd); err != nil {
+		return vhd, err
+	}
+	if _, err := uuid.FromString(vhd.DiskIdentifier); err != nil {
+		psError := errors.New("unexpected New-VHD output. Expected parseable uuid")
+		klog.ErrorS(psError, "message", vhd.DiskIdentifier)
+		return vhd, psError
+	}
+	return vhd, nil
+}
+
+func (b *powerShellBackend) CreateVHD(ctx context.Context, path string, sizeBytes int64) (VHD, error) {
+	return b.newVHD(ctx, fmt.Sprintf("New-VHD -Path %s -SizeBytes %d -Dynamic", psQuote(path), sizeBytes))
+}
+
+func (b *powerShellBackend) CreateDifferencingVHD(ctx context.Context, path string, parentPath string) (VHD, error) {
+	return b.newVHD(ctx, fmt.Sprintf("$c = %s; if (-not (Test-Path $c)) { New-VHD -Path $c -ParentPath %s -Differencing | Out-Null }; Get-VHD $c", psQuote(path), psQuote(parentPath)))
+}
+
+func (b *powerShellBackend) ResizeVHD(ctx context.Context, path string, sizeBytes int64) (VHD, error) {
+	return b.newVHD(ctx, fmt.Sprintf("Resize-VHD -Path %s -SizeBytes %d -Passthru", psQuote(path), sizeBytes))
+}
+
+func (b *powerShellBackend) SetReadOnly(ctx context.Context, path string) error {
+	_, err := b.psRunChecked(ctx, "couldn't set file read-only", fmt.Sprintf("Set-ItemProperty -Path %s -Name IsReadOnly -Value $true", psQuote(path)))
+	return err
+}
+
+func (b *powerShellBackend) MoveFile(ctx context.Context, path string, newPath string) error {
+	_, err := b.psRunChecked(ctx, "couldn't move file", fmt.Sprintf("Move-Item -LiteralPath %s -Destination %s", psQuote(path), psQuote(newPath)))
+	return err
+}
+
+func (b *powerShellBackend) DeleteFiles(ctx context.Context, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	output, err := b.psRunChecked(ctx, "couldn't delete files", fmt.Sprintf("Remove-Item -Force -LiteralPath %s", psQuoteArray(paths)))
+	if err == nil && strings.Contains(output, "failed to delete attached volume") {
+		err = ErrDiskInUse
+		klog.ErrorS(err, "couldn't delete attached files", "paths", paths)
+	}
+	return err
+}
+
+func (b *powerShellBackend) DeleteFile(ctx context.Context, path string) error {
+	_, err := b.psRunChecked(ctx, "couldn't delete file", fmt.Sprintf("$p = %s; if (Test-Path -LiteralPath $p) { Remove-Item -Force -LiteralPath $p }", psQuote(path)))
+	return err
+}
+
+func streamArgument(stream string) string {
+	if stream == "" {
+		return ""
+	}
+	return " -Stream " + psQuote(stream)
+}
+
+func (b *powerShellBackend) ReadFile(ctx context.Context, path string, stream string) (string, error) {
+	output, err := b.psRunChecked(idempotent(ctx), "couldn't read file", fmt.Sprintf("Get-Content -LiteralPath %s%s -Raw -ErrorAction SilentlyContinue", psQuote(path), streamArgument(stream)))
+	return strings.Trim(output, "\r\n\t "), err
+}
+
+func (b *powerShellBackend) WriteFile(ctx context.Context, path string, stream string, content string) error {
+	_, err := b.psRunChecked(ctx, "couldn't write file", fmt.Sprintf("Set-Content -LiteralPath %s%s -Value %s", psQuote(path), streamArgument(stream), psQuote(content)))
+	return err
+}
+
+func (b *powerShellBackend) ReadStreams(ctx context.Context, directories []string, prefix string, stream string) (map[string]string, error) {
+	globs := make([]string, len(directories))
+	for i, directory := range directories {
+		globs[i] = psQuote(directory + "\\" + prefix + "*.vhdx")
+	}
+	cmd := fmt.Sprintf("ConvertTo-Json @(Get-Item %s | ForEach-Object { $c = Get-Content -LiteralPath $_.FullName%s -Raw -ErrorAction SilentlyContinue; if ($c) { @{Name = $_.Name; Content = $c} } })",
+		strings.Join(globs, ", "), streamArgument(stream))
+	var files []struct {
+		Name    string `json:"Name"`
+		Content string `json:"Content"`
+	}
+	if err := b.psRunJson(idempotent(ctx), "couldn't read streams", cmd, &files); err != nil {
+		return nil, err
+	}
+
+	streams := map[string]string{}
+	for _, file := range files {
+		streams[file.Name] = strings.Trim(file.Content, "\r\n\t ")
+	}
+	return streams, nil
+}
+
+func (b *powerShellBackend) CopyVHDs(ctx context.Context, pathPrefix string, directory string) error {
+	// Copy-Item keeps alternate data streams so volume metadata comes along. Differencing disks are re-pointed at their
+	// copied parents before anything is removed so a failure part way through leaves the original intact.
+	cmd := fmt.Sprintf("$ErrorActionPreference = 'Stop'; $src = @(Get-Item (%s+\"*\")); $dst = %s; "+
+		"New-Item -ItemType Directory -Force -Path $dst | Out-Null; "+
+		"foreach ($f in $src) { Copy-Item -LiteralPath $f.FullName -Destination $dst -Force }; "+
+		"foreach ($f in $src) { $v = Get-VHD -Path (Join-Path $dst $f.Name); if ($v.ParentPath) { Set-VHD -Path $v.Path -ParentPath (Join-Path $dst (Split-Path -Leaf $v.ParentPath)) } }",
+		psQuote(pathPrefix), psQuote(directory))
+	_, err := b.psRunChecked(ctx, "couldn't copy vhds", cmd)
+	return err
+}
+
+func (b *powerShellBackend) MoveVHDs(ctx context.Context, paths []string, directory string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	// Move-Item keeps alternate data streams on the same NTFS volume
+	cmd := fmt.Sprintf("$ErrorActionPreference = 'Stop'; $src = @(Get-Item -LiteralPath %s); $dst = %s; "+
+		"New-Item -ItemType Directory -Force -Path $dst | Out-Null; "+
+		"foreach ($f in $src) { Move-Item -LiteralPath $f.FullName -Destination $dst }; "+
+		"foreach ($f in $src) { $v = Get-VHD -Path (Join-Path $dst $f.Name); if ($v.ParentPath) { Set-VHD -Path $v.Path -ParentPath (Join-Path $dst (Split-Path -Leaf $v.ParentPath)) } }",
+		psQuoteArray(paths), psQuote(directory))
+	output, err := b.psRunChecked(ctx, "couldn't move vhds", cmd)
+	if strings.Contains(output, "being used by another process") {
+		err = ErrDiskInUse
+	}
+	return err
+}
+
+func (b *powerShellBackend) MoveAttachedVHDs(ctx context.Context, vmName string, pathPrefix string, directory string) error {
+	cmd := fmt.Sprintf("$ErrorActionPreference = 'Stop'; $dst = %s; "+
+		"$vhds = @(Get-Item (%s+\"*\") | ForEach-Object { @{SourceFilePath = $_.FullName; DestinationFilePath = (Join-Path $dst $_.Name)} }); "+
+		"Move-VMStorage -VMName %s -VHDs $vhds",
+		psQuote(directory), psQuote(pathPrefix), psQuote(vmName))
+	result := b.psRunOnVMHost(ctx, vmName, cmd)
+	if err := result.err(); err != nil {
+		klog.ErrorS(err, "couldn't move attached vhds", "vm", vmName, "output", result.Output)
+		return err
+	}
+	return nil
+}
+
+func (b *powerShellBackend) AttachDisk(ctx context.Context, vmName string, path string) error {
+	// Add-VMHardDiskDrive -VMName vmubt2204kube04 -ControllerType SCSI -ControllerNumber 0 -Path "v:\\hyper-v\\virtual hard disks\\pvc-583055da-f7b4-474f-9bea-59d346c21509.vhdx"
+	cmd := fmt.Sprintf("Add-VMHardDiskDrive -VMName %s -ControllerType SCSI -ControllerNumber 0 -Path %s", psQuote(vmName), psQuote(path))
+	result := b.psRunOnVMHost(ctx, vmName, cmd)
+
+	// Idempotence
+	if strings.Contains(result.Output, "The disk is already connect to the virtual machine") {
+		return nil
+	}
+	if strings.Contains(result.Output, "is already in use") || strings.Contains(result.Output, "being used by another process") {
+		return ErrDiskInUse
+	}
+	if strings.Contains(result.Output, "unable to find a virtual machine with name") {
+		return ErrVMNotFound
+	}
+	if err := result.err(); err != nil {
+		klog.ErrorS(err, "couldn't attach disk", "vm", vmName, "path", path, "output", result.Output)
+		return err
+	}
+	return nil
+}
+
+func (b *powerShellBackend) DetachDisk(ctx context.Context, vmName string, pattern string) error {
+	// Get-VMHardDiskDrive -VMName vmubt2204kube04 | Where-Object {$_.Path -like "*pvc-583055da-f7b4-474f-9bea-59d346c21509*"} | Remove-VMHardDiskDrive
+	cmd := fmt.Sprintf("Get-VMHardDiskDrive -VMName %s | Where-Object {$_.Path -like %s} | Remove-VMHardDiskDrive", psQuote(vmName), psQuote("*"+pattern+"*"))
+	result := b.psRunOnVMHost(ctx, vmName, cmd)
+	if err := result.err(); err != nil {
+		klog.ErrorS(err, "couldn't detach disk", "vm", vmName, "pattern", pattern, "output", result.Output)
+		return err
+	}
+	return nil
+}
+
+func (b *powerShellBackend) ListAttachments(ctx context.Context, pattern string) ([]DiskAttachment, error) {
+	cmd := fmt.Sprintf("ConvertTo-Json @(Get-VM | Get-VMHardDiskDrive | Where-Object {$_.Path -like %s} | Select VMName, Path)", psQuote("*"+pattern+"*"))
+	attachments := make([]DiskAttachment, 0)
+	for _, result := range b.psRunOnEachHost(idempotent(ctx), cmd) {
+		if err := result.err(); err != nil {
+			klog.ErrorS(err, "couldn't list attachments", "pattern", pattern, "output", result.Output)
+			return nil, err
+		}
+
+		var hostAttachments []DiskAttachment
+		if err := json.Unmarshal([]byte(result.Output), &hostAttachments); err != nil {
+			klog.ErrorS(err, "couldn't unmarshal attachments", "output", result.Output)
+			return nil, err
+		}
+		attachments = append(attachments, hostAttachments...)
+	}
+	return attachments, nil
+}
+
+func (b *powerShellBackend) SetDiskQoS(ctx context.Context, vmName string, pattern string, qos *volumeQoS) error {
+	if vmName != "" {
+		cmd := fmt.Sprintf("Get-VMHardDiskDrive -VMName %s | Where-Object {$_.Path -like %s} | Set-VMHardDiskDrive %s", psQuote(vmName), psQuote("*"+pattern+"*"), qos.setVMHardDiskDriveArguments())
+		result := b.psRunOnVMHost(ctx, vmName, cmd)
+		if err := result.err(); err != nil {
+			klog.ErrorS(err, "couldn't apply qos", "vm", vmName, "output", result.Output)
+			return err
+		}
+		return nil
+	}
+
+	cmd := fmt.Sprintf("Get-VM | Get-VMHardDiskDrive | Where-Object {$_.Path -like %s} | Set-VMHardDiskDrive %s", psQuote("*"+pattern+"*"), qos.setVMHardDiskDriveArguments())
+	for _, result := range b.psRunOnEachHost(ctx, cmd) {
+		if err := result.err(); err != nil {
+			klog.ErrorS(err, "couldn't apply qos", "output", result.Output)
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *powerShellBackend) FreeSpace(ctx context.Context, directory string) (int64, error) {
+	var free int64
+	err := b.psRunJson(idempotent(ctx), "couldn't get free space", fmt.Sprintf("(Get-Volume -FilePath %s).SizeRemaining", psQuote(directory)), &free)
+	return free, err
+}
+
+func (b *powerShellBackend) ClusterInfo(ctx context.Context) (ClusterInfo, error) {
+	var cluster ClusterInfo
+	err := b.psRunJson(idempotent(ctx), "couldn't discover failover cluster", "ConvertTo-Json @{Name = (Get-Cluster).Name; Csv = @(Get-ClusterSharedVolume | ForEach-Object { $_.SharedVolumeInfo.FriendlyVolumeName })}", &cluster)
+	return cluster, err
+}
+
+// psCheck runs a health check command, the error includes the command's output since it's the reason the check failed
+func (b *powerShellBackend) psCheck(ctx context.Context, cmd string) error {
+	result := b.psRun(idempotent(ctx), cmd)
+	if err := result.err(); err != nil {
+		if result.Output != "" {
+			return fmt.Errorf("%w: %s", err, result.Output)
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *powerShellBackend) Ping(ctx context.Context) error {
+	return b.psCheck(ctx, "Write-Output ok")
+}
+
+func (b *powerShellBackend) CheckHyperV(ctx context.Context) error {
+	return b.psCheck(ctx, "Import-Module Hyper-V -ErrorAction Stop")
+}
+
+func (b *powerShellBackend) CheckDirectory(ctx context.Context, directory string) error {
+	cmd := fmt.Sprintf("$ErrorActionPreference = 'Stop'; "+
+		"if (-not (Test-Path -LiteralPath %[1]s -PathType Container)) { throw 'directory does not exist' }; "+
+		"$probe = Join-Path %[1]s ('.hyperv-csi-probe-' + [guid]::NewGuid()); "+
+		"New-Item -ItemType File -Path $probe | Out-Null; Remove-Item -LiteralPath $probe", psQuote(directory))
+	return b.psCheck(ctx, cmd)
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"strconv"
+)
+
+// StorageClass/VolumeAttributesClass parameters for Hyper-V Storage QoS
+const volumeParameterMinimumIOPS = "minimumIOPS"
+const volumeParameterMaximumIOPS = "maximumIOPS"
+const volumeParameterQoSPolicyId = "qosPolicyId"
+
+type volumeQoS struct {
+	MinimumIOPS uint64 `json:"minimumIOPS"`
+	MaximumIOPS uint64 `json:"maximumIOPS"`
+	PolicyId    string `json:"policyId,omitempty"`
+}
+
+// parseVolumeQoS overlays any QoS parameters on current, returning nil if neither have QoS settings
+func parseVolumeQoS(parameters map[string]string, current *volumeQoS) (*volumeQoS, error) {
+	qos := volumeQoS{}
+	if current != nil {
+		qos = *current
+	}
+	found := current != nil
+
+	for key, target := range map[string]*uint64{
+		volumeParameterMinimumIOPS: &qos.MinimumIOPS,
+		volumeParameterMaximumIOPS: &qos.MaximumIOPS,
+	} {
+		if value, ok := parameters[key]; ok {
+			iops, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q", key, value)
+			}
+			*target = iops
+			found = true
+		}
+	}
+
+	if value, ok := parameters[volumeParameterQoSPolicyId]; ok {
+		if _, err := uuid.FromString(value); value != "" && err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q", volumeParameterQoSPolicyId, value)
+		}
+		qos.PolicyId = value
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+	// Hyper-V treats 0 as unlimited
+	if qos.MaximumIOPS != 0 && qos.MinimumIOPS > qos.MaximumIOPS {
+		return nil, status.Errorf(codes.InvalidArgument, "%s can't be more than %s", volumeParameterMinimumIOPS, volumeParameterMaximumIOPS)
+	}
+	return &qos, nil
+}
+
+func (q *volumeQoS) setVMHardDiskDriveArguments() string {
+	arguments := fmt.Sprintf("-MinimumIOPS %d -MaximumIOPS %d", q.MinimumIOPS, q.MaximumIOPS)
+	if q.PolicyId != "" {
+		arguments += " -QoSPolicyID " + q.PolicyId
+	}
+	return arguments
+}
+
+// applyVolumeQoS sets QoS on every VM drive the volume (or one of its read-only children) is attached through.
+// vmName limits this to a single VM when it isn't empty.
+func (s *HypervCsiController) applyVolumeQoS(ctx context.Context, volumeId string, vmName string, qos *volumeQoS) error {
+	if qos == nil {
+		return nil
+	}
+
+	klog.InfoS("applying qos", "volumeId", volumeId, "vm", vmName, "qos", qos)
+	return s.backend().SetDiskQoS(ctx, vmName, volumeId, qos)
+}
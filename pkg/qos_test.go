@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func Test_parseVolumeQoSNoParameters(t *testing.T) {
+	qos, err := parseVolumeQoS(map[string]string{"type": "hyperv"}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, qos)
+}
+
+func Test_parseVolumeQoSOverlay(t *testing.T) {
+	current := &volumeQoS{MinimumIOPS: 100, MaximumIOPS: 500}
+	qos, err := parseVolumeQoS(map[string]string{volumeParameterMaximumIOPS: "1000"}, current)
+	assert.Nil(t, err)
+	assert.Equal(t, &volumeQoS{MinimumIOPS: 100, MaximumIOPS: 1000}, qos)
+	assert.Equal(t, uint64(500), current.MaximumIOPS)
+}
+
+func Test_parseVolumeQoSInvalid(t *testing.T) {
+	for _, parameters := range []map[string]string{
+		{volumeParameterMinimumIOPS: "-1"},
+		{volumeParameterMaximumIOPS: "lots"},
+		{volumeParameterMinimumIOPS: "200", volumeParameterMaximumIOPS: "100"},
+		{volumeParameterQoSPolicyId: "not-a-guid"},
+	} {
+		_, err := parseVolumeQoS(parameters, nil)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), parameters)
+	}
+}
+
+func Test_setVMHardDiskDriveArguments(t *testing.T) {
+	qos := &volumeQoS{MinimumIOPS: 100, MaximumIOPS: 0, PolicyId: "eab72431-5d15-4152-a8d1-5cf4ea41627e"}
+	assert.Equal(t, "-MinimumIOPS 100 -MaximumIOPS 0 -QoSPolicyID eab72431-5d15-4152-a8d1-5cf4ea41627e", qos.setVMHardDiskDriveArguments())
+}
+
+func Test_ControllerModifyVolumeImmutableParameter(t *testing.T) {
+	_, controller := newController()
+
+	_, err := controller.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "eab72431-5d15-4152-a8d1-5cf4ea41627e",
+		MutableParameters: map[string]string{volumeParameterEncrypted: "true"},
+	})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func Test_ControllerModifyVolumeQoS(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{
+		Parameters: map[string]string{volumeParameterMinimumIOPS: "100"},
+	})
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+	require.NoError(t, err)
+	path := controller.volumeFilePath(controller.VolumePath, volumeId, true)
+	assert.Equal(t, &volumeQoS{MinimumIOPS: 100}, hyperv.DiskQoS("kube01", path))
+
+	_, err = controller.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeId,
+		MutableParameters: map[string]string{volumeParameterMaximumIOPS: "500"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &volumeQoS{MinimumIOPS: 100, MaximumIOPS: 500}, hyperv.DiskQoS("kube01", path))
+
+	// QoS comes back after re-attaching
+	_, err = controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01"})
+	require.NoError(t, err)
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube02", VolumeCapability: singleNodeWriter[0]})
+	require.NoError(t, err)
+	assert.Equal(t, &volumeQoS{MinimumIOPS: 100, MaximumIOPS: 500}, hyperv.DiskQoS("kube02", path))
+}
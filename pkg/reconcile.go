@@ -0,0 +1,234 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+	"strings"
+	"time"
+)
+
+// The reconciler compares the host with Kubernetes. Anything Kubernetes doesn't know about is reported and, with
+// Cleanup, removed once it's been found for GracePeriod. When each finding was first seen is kept in a state file
+// next to the volumes so one-shot runs honor the grace period too.
+
+// Kinds of reconcile findings
+const (
+	// findingOrphan is a volume no PersistentVolume refers to, e.g. a Retain PV that was deleted
+	findingOrphan = "orphan"
+	// findingTemp is a volume a failed CreateVolume didn't rename
+	findingTemp = "temp"
+	// findingStaleAttachment is a disk attached to a VM without a VolumeAttachment, e.g. a node that was deleted
+	findingStaleAttachment = "stale-attachment"
+)
+
+// reconcileStateFileName follows the volume prefix, e.g. pv-reconcile.json
+const reconcileStateFileName = "reconcile.json"
+
+// reconcileClock is a variable so tests can move time forward
+var reconcileClock = time.Now
+
+// KubernetesVolumes is what Kubernetes knows about the driver's volumes
+type KubernetesVolumes struct {
+	// Volumes are the volume handles of every PersistentVolume
+	Volumes map[string]bool
+	// Attachments are the nodes each volume should be attached to by volume handle, from VolumeAttachments. Node
+	// names are lowercase since Hyper-V VM names aren't case sensitive.
+	Attachments map[string]map[string]bool
+}
+
+// ReconcileFinding is something on the host Kubernetes doesn't know about
+type ReconcileFinding struct {
+	Kind     string `json:"kind"`
+	VolumeId string `json:"volumeId"`
+	// Path is the file of a temp volume
+	Path string `json:"path,omitempty"`
+	// VMName is the VM of a stale attachment
+	VMName    string    `json:"vmName,omitempty"`
+	FirstSeen time.Time `json:"firstSeen"`
+	// Action is what cleanup did about the finding, empty without cleanup
+	Action string `json:"action,omitempty"`
+}
+
+func (f *ReconcileFinding) key() string {
+	return f.Kind + "/" + f.VolumeId + "/" + f.VMName
+}
+
+// Reconciler finds orphaned volumes, temp volumes and stale attachments
+type Reconciler struct {
+	Controller *HypervCsiController
+	// Kubernetes lists the volumes and attachments Kubernetes knows about
+	Kubernetes func(ctx context.Context) (*KubernetesVolumes, error)
+	// Cleanup deletes orphans and temp volumes and detaches stale attachments once they've been found for GracePeriod
+	Cleanup     bool
+	GracePeriod time.Duration
+}
+
+func (r *Reconciler) stateFilePath() string {
+	return r.Controller.volumePath() + "\\" + r.Controller.volumePrefix() + reconcileStateFileName
+}
+
+// loadState returns when each finding was first seen by its key
+func (r *Reconciler) loadState(ctx context.Context) (map[string]time.Time, error) {
+	state := map[string]time.Time{}
+	output, err := r.Controller.backend().ReadFile(ctx, r.stateFilePath(), "")
+	if err != nil {
+		return nil, err
+	}
+	if output != "" {
+		if err = json.Unmarshal([]byte(output), &state); err != nil {
+			// The state only delays cleanup, starting over is safe
+			klog.ErrorS(err, "couldn't unmarshal reconcile state, starting over", "output", output)
+			return map[string]time.Time{}, nil
+		}
+	}
+	return state, nil
+}
+
+func (r *Reconciler) saveState(ctx context.Context, state map[string]time.Time) error {
+	stateJson, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return r.Controller.backend().WriteFile(ctx, r.stateFilePath(), "", string(stateJson))
+}
+
+// find lists what's on the host but not in Kubernetes. Stale attachments come first so cleanup detaches
+// orphans before deleting them.
+func (r *Reconciler) find(ctx context.Context, known *KubernetesVolumes) ([]ReconcileFinding, error) {
+	s := r.Controller
+	volumes, err := s.listVolumeMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	foreign := s.foreignIn(volumes)
+
+	findings := make([]ReconcileFinding, 0)
+	attachments, err := s.backend().ListAttachments(ctx, "\\"+s.volumePrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, attachment := range attachments {
+		volumeId := s.fileVolumeId(attachment.Path)
+		if _, ok := foreign[volumeId]; ok || known.Attachments[volumeId][strings.ToLower(attachment.VMName)] {
+			continue
+		}
+		findings = append(findings, ReconcileFinding{Kind: findingStaleAttachment, VolumeId: volumeId, VMName: attachment.VMName})
+	}
+
+	for _, directory := range s.poolDirectories() {
+		files, err := s.backend().ListDisks(ctx, []string{directory}, s.volumePrefix())
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			volumeId := s.fileVolumeId(file)
+			// Read-only children come and go with their attachments
+			if _, ok := foreign[volumeId]; ok || volumeId != strings.TrimPrefix(strings.TrimSuffix(file, ".vhdx"), s.volumePrefix()) {
+				continue
+			}
+			if strings.HasPrefix(volumeId, tempVolumePrefix) {
+				findings = append(findings, ReconcileFinding{Kind: findingTemp, VolumeId: volumeId, Path: directory + "\\" + file})
+			} else if !known.Volumes[volumeId] {
+				findings = append(findings, ReconcileFinding{Kind: findingOrphan, VolumeId: volumeId})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// Run reconciles the host with Kubernetes once and returns what it found
+func (r *Reconciler) Run(ctx context.Context) ([]ReconcileFinding, error) {
+	known, err := r.Kubernetes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list kubernetes volumes: %w", err)
+	}
+	findings, err := r.find(ctx, known)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := r.loadState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := reconcileClock()
+	seen := map[string]time.Time{}
+	counts := map[string]int{findingOrphan: 0, findingTemp: 0, findingStaleAttachment: 0}
+	for i := range findings {
+		firstSeen, ok := state[findings[i].key()]
+		if !ok {
+			firstSeen = now
+		}
+		findings[i].FirstSeen = firstSeen
+		seen[findings[i].key()] = firstSeen
+		counts[findings[i].Kind]++
+	}
+	// Findings that went away are forgotten so they start over if they come back
+	if len(seen) > 0 || len(state) > 0 {
+		if err = r.saveState(ctx, seen); err != nil {
+			return nil, err
+		}
+	}
+	for kind, count := range counts {
+		reconcileFindings.WithLabelValues(kind).Set(float64(count))
+	}
+
+	if r.Cleanup {
+		for i := range findings {
+			r.clean(ctx, &findings[i], now)
+		}
+	}
+	return findings, nil
+}
+
+// clean removes a finding once it's past the grace period
+func (r *Reconciler) clean(ctx context.Context, finding *ReconcileFinding, now time.Time) {
+	if now.Sub(finding.FirstSeen) < r.GracePeriod {
+		finding.Action = "waiting for grace period"
+		return
+	}
+
+	var err error
+	switch finding.Kind {
+	case findingStaleAttachment:
+		finding.Action = "detached"
+		_, err = r.Controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: finding.VolumeId, NodeId: finding.VMName})
+	case findingOrphan:
+		finding.Action = "deleted"
+		_, err = r.Controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: finding.VolumeId})
+	case findingTemp:
+		finding.Action = "deleted"
+		err = r.Controller.backend().DeleteFile(ctx, finding.Path)
+	}
+	if err != nil {
+		klog.ErrorS(err, "couldn't clean up reconcile finding", "kind", finding.Kind, "volumeId", finding.VolumeId, "vm", finding.VMName)
+		finding.Action = "failed: " + err.Error()
+		return
+	}
+	klog.InfoS("cleaned up reconcile finding", "kind", finding.Kind, "volumeId", finding.VolumeId, "vm", finding.VMName, "action", finding.Action)
+}
+
+// Loop reconciles every interval until ctx is done
+func (r *Reconciler) Loop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		findings, err := r.Run(ctx)
+		if err != nil {
+			klog.ErrorS(err, "reconcile failed")
+		}
+		for _, finding := range findings {
+			klog.InfoS("reconcile finding", "kind", finding.Kind, "volumeId", finding.VolumeId, "vm", finding.VMName,
+				"firstSeen", finding.FirstSeen, "action", finding.Action)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func fakeKubernetes(known *KubernetesVolumes) func(ctx context.Context) (*KubernetesVolumes, error) {
+	return func(ctx context.Context) (*KubernetesVolumes, error) {
+		return known, nil
+	}
+}
+
+func findingKinds(findings []ReconcileFinding) map[string]string {
+	kinds := map[string]string{}
+	for _, finding := range findings {
+		kinds[finding.VolumeId+finding.VMName] = finding.Kind
+	}
+	return kinds
+}
+
+func Test_ReconcileReport(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	known := createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-known"})
+	orphan := createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-orphan"})
+	for _, volumeId := range []string{known, orphan} {
+		_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeId,
+			NodeId:           "kube01",
+			VolumeCapability: singleNodeWriter[0],
+		})
+		require.NoError(t, err)
+	}
+	_, err := hyperv.CreateVHD(ctx, controller.VolumePath+"\\pv-temp-0123456789abcdef.vhdx", 1024)
+	require.NoError(t, err)
+	reconciler := &Reconciler{
+		Controller: controller,
+		Kubernetes: fakeKubernetes(&KubernetesVolumes{
+			Volumes:     map[string]bool{known: true},
+			Attachments: map[string]map[string]bool{known: {"kube01": true}},
+		}),
+	}
+
+	findings, err := reconciler.Run(ctx)
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		orphan + "kube01":       findingStaleAttachment,
+		orphan:                  findingOrphan,
+		"temp-0123456789abcdef": findingTemp,
+	}, findingKinds(findings))
+	for _, finding := range findings {
+		assert.Empty(t, finding.Action)
+	}
+	// Reporting doesn't change anything
+	assert.Len(t, hyperv.Attachments("kube01"), 2)
+	_, err = hyperv.GetVHD(ctx, controller.volumeFilePath(controller.VolumePath, orphan, true))
+	assert.NoError(t, err)
+}
+
+func Test_ReconcileVMNameCase(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	hyperv.AddVM("Kube03")
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-mixed-case"})
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeId,
+		NodeId:           "kube03",
+		VolumeCapability: singleNodeWriter[0],
+	})
+	require.NoError(t, err)
+	reconciler := &Reconciler{
+		Controller: controller,
+		Kubernetes: fakeKubernetes(&KubernetesVolumes{
+			Volumes:     map[string]bool{volumeId: true},
+			Attachments: map[string]map[string]bool{volumeId: {"kube03": true}},
+		}),
+	}
+
+	findings, err := reconciler.Run(ctx)
+
+	require.NoError(t, err)
+	assert.Empty(t, findings)
+}
+
+func Test_ReconcileCleanupGracePeriod(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	orphan := createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-orphan"})
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         orphan,
+		NodeId:           "kube01",
+		VolumeCapability: singleNodeWriter[0],
+	})
+	require.NoError(t, err)
+	tempPath := controller.VolumePath + "\\pv-temp-0123456789abcdef.vhdx"
+	_, err = hyperv.CreateVHD(ctx, tempPath, 1024)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	reconcileClock = func() time.Time { return now }
+	t.Cleanup(func() { reconcileClock = time.Now })
+	reconciler := &Reconciler{
+		Controller:  controller,
+		Kubernetes:  fakeKubernetes(&KubernetesVolumes{}),
+		Cleanup:     true,
+		GracePeriod: time.Hour,
+	}
+
+	findings, err := reconciler.Run(ctx)
+	require.NoError(t, err)
+	require.Len(t, findings, 3)
+	for _, finding := range findings {
+		assert.Equal(t, "waiting for grace period", finding.Action)
+		assert.Equal(t, now, finding.FirstSeen)
+	}
+	assert.Len(t, hyperv.Attachments("kube01"), 1)
+
+	// The first sighting is kept between runs
+	now = now.Add(time.Hour)
+	findings, err = reconciler.Run(ctx)
+	require.NoError(t, err)
+	require.Len(t, findings, 3)
+	for _, finding := range findings {
+		assert.Equal(t, now.Add(-time.Hour), finding.FirstSeen)
+		if finding.Kind == findingStaleAttachment {
+			assert.Equal(t, "detached", finding.Action)
+		} else {
+			assert.Equal(t, "deleted", finding.Action)
+		}
+	}
+	assert.Empty(t, hyperv.Attachments("kube01"))
+	_, err = hyperv.GetVHD(ctx, controller.volumeFilePath(controller.VolumePath, orphan, true))
+	assert.Error(t, err)
+	_, err = hyperv.GetVHD(ctx, tempPath)
+	assert.Error(t, err)
+
+	findings, err = reconciler.Run(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, findings)
+}
+
+func Test_ReconcileIgnoresForeignVolumes(t *testing.T) {
+	hyperv, prod, staging := newClusterControllers("")
+	ctx := context.Background()
+	createTestVolume(t, prod, &csi.CreateVolumeRequest{Name: "pvc-prod"})
+	reconciler := &Reconciler{Controller: staging, Kubernetes: fakeKubernetes(&KubernetesVolumes{}), Cleanup: true}
+
+	findings, err := reconciler.Run(ctx)
+
+	require.NoError(t, err)
+	assert.Empty(t, findings)
+	assert.Zero(t, hyperv.Calls("DeleteFiles"))
+}
@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"k8s.io/klog/v2"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// recordedSecret replaces secrets, it stays clear of characters that would break CLIXML
+const recordedSecret = "REDACTED"
+
+// RecordedCommand is one command sent to a Hyper-V host and what came back. Command is the decoded
+// PowerShell script and Stdout/Stderr are the raw output, CLIXML included.
+type RecordedCommand struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exitCode"`
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// decodePsCommand turns a command built with psCommand back into the PowerShell script it runs
+func decodePsCommand(command string) string {
+	_, encoded, found := strings.Cut(command, "-EncodedCommand ")
+	if !found {
+		return command
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(raw)%2 != 0 {
+		return command
+	}
+	utf16Script := make([]uint16, len(raw)/2)
+	for i := range utf16Script {
+		utf16Script[i] = binary.LittleEndian.Uint16(raw[i*2:])
+	}
+	return strings.TrimPrefix(string(utf16.Decode(utf16Script)), "$ProgressPreference = 'SilentlyContinue';")
+}
+
+// Recorder saves every command run through the runners it wraps to a fixtures file that a Replayer can
+// play back in tests. Secrets are replaced before anything is written.
+type Recorder struct {
+	path string
+	// secrets returns the current credentials, it's called for every command so rotated ones are scrubbed too
+	secrets func() []string
+	lock    sync.Mutex
+	// scrubbed is every secret seen so far, longest first so secrets containing others are replaced whole
+	scrubbed []string
+	recorded int
+}
+
+func NewRecorder(path string, secrets func() []string) *Recorder {
+	return &Recorder{path: path, secrets: secrets}
+}
+
+func (r *Recorder) scrub(value string) string {
+	for _, secret := range r.scrubbed {
+		value = strings.ReplaceAll(value, secret, recordedSecret)
+	}
+	return value
+}
+
+// updateSecrets adds the current secrets to the ones scrubbed, earlier ones are kept in case they show up in output
+func (r *Recorder) updateSecrets() {
+	for _, secret := range r.secrets() {
+		if secret != "" && !slices.Contains(r.scrubbed, secret) {
+			r.scrubbed = append(r.scrubbed, secret)
+		}
+	}
+	sort.SliceStable(r.scrubbed, func(i, j int) bool {
+		return len(r.scrubbed[i]) > len(r.scrubbed[j])
+	})
+}
+
+// Wrap returns a runner that records everything run through runner
+func (r *Recorder) Wrap(runner RemotePowerShellRunner) RemotePowerShellRunner {
+	return &recordingRunner{recorder: r, runner: runner}
+}
+
+func (r *Recorder) record(command RecordedCommand) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.updateSecrets()
+	command.Command = r.scrub(command.Command)
+	command.Stdout = r.scrub(command.Stdout)
+	command.Stderr = r.scrub(command.Stderr)
+	command.Error = r.scrub(command.Error)
+	entry, err := json.MarshalIndent(command, "  ", "  ")
+	if err != nil {
+		return err
+	}
+
+	if r.recorded == 0 {
+		err = os.WriteFile(r.path, []byte("[\n  "+string(entry)+"\n]"), 0600)
+	} else {
+		err = r.append(entry)
+	}
+	if err == nil {
+		r.recorded++
+	}
+	return err
+}
+
+// append writes entry over the file's closing bracket, so the file stays a valid JSON array if the process is killed
+func (r *Recorder) append(entry []byte) error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		_, err = file.WriteAt([]byte(",\n  "+string(entry)+"\n]"), info.Size()-int64(len("\n]")))
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type recordingRunner struct {
+	recorder *Recorder
+	runner   RemotePowerShellRunner
+}
+
+func (r *recordingRunner) RunWithContext(ctx context.Context, command string, stdout io.Writer, stderr io.Writer) (int, error) {
+	var recordedStdout, recordedStderr bytes.Buffer
+	exitCode, err := r.runner.RunWithContext(ctx, command, io.MultiWriter(stdout, &recordedStdout), io.MultiWriter(stderr, &recordedStderr))
+
+	recorded := RecordedCommand{
+		Command:  decodePsCommand(command),
+		ExitCode: exitCode,
+		Stdout:   recordedStdout.String(),
+		Stderr:   recordedStderr.String(),
+	}
+	if err != nil {
+		recorded.Error = err.Error()
+	}
+	if recordErr := r.recorder.record(recorded); recordErr != nil {
+		klog.ErrorS(recordErr, "couldn't record command", "path", r.recorder.path)
+	}
+	return exitCode, err
+}
+
+// Replayer is a RemotePowerShellRunner that plays back a recorded session. Commands have to be run in the
+// order they were recorded.
+type Replayer struct {
+	lock     sync.Mutex
+	commands []RecordedCommand
+	next     int
+}
+
+func NewReplayer(path string) (*Replayer, error) {
+	fixtures, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	replayer := &Replayer{}
+	if err = json.Unmarshal(fixtures, &replayer.commands); err != nil {
+		return nil, fmt.Errorf("couldn't parse fixtures %s: %w", path, err)
+	}
+	return replayer, nil
+}
+
+func (r *Replayer) RunWithContext(ctx context.Context, command string, stdout io.Writer, stderr io.Writer) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	script := decodePsCommand(command)
+	if r.next >= len(r.commands) {
+		return -1, fmt.Errorf("no recorded command left for %q", script)
+	}
+	recorded := r.commands[r.next]
+	if recorded.Command != script {
+		return -1, fmt.Errorf("expected recorded command %d to be %q, got %q", r.next, recorded.Command, script)
+	}
+	r.next++
+
+	stdout.Write([]byte(recorded.Stdout))
+	stderr.Write([]byte(recorded.Stderr))
+	if recorded.Error != "" {
+		return recorded.ExitCode, errors.New(recorded.Error)
+	}
+	return recorded.ExitCode, nil
+}
+
+// Remaining returns how many recorded commands haven't been replayed
+func (r *Replayer) Remaining() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.commands) - r.next
+}
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_decodePsCommand(t *testing.T) {
+	script := "Get-VHD -Path 'V:\\pv-😀.vhdx'"
+	assert.Equal(t, script, decodePsCommand(psCommand(script)))
+	assert.Equal(t, "echo ok", decodePsCommand("echo ok"))
+}
+
+func Test_RecorderScrubsAndReplays(t *testing.T) {
+	fixtures := filepath.Join(t.TempDir(), "session.json")
+	host := funcWinRmClient(func(command string) (int, string) {
+		return 0, "#< CLIXML\r\n<Objs><S>hunter2 _x000D__x000A_done</S></Objs>"
+	})
+	recorder := NewRecorder(fixtures, func() []string { return []string{"hunter2", ""} })
+	backend := newPowerShellBackend(recorder.Wrap(host), nil)
+
+	result := backend.psRun(context.Background(), "Write-Output 'hunter2'")
+	assert.Equal(t, "hunter2 \ndone", result.Output)
+
+	recorded, err := os.ReadFile(fixtures)
+	require.NoError(t, err)
+	assert.NotContains(t, string(recorded), "hunter2")
+	assert.Contains(t, string(recorded), "Write-Output 'REDACTED'")
+
+	replayer, err := NewReplayer(fixtures)
+	require.NoError(t, err)
+	backend = newPowerShellBackend(replayer, nil)
+	result = backend.psRun(context.Background(), "Write-Output 'REDACTED'")
+	assert.Equal(t, 0, result.ExitCode)
+	assert.Equal(t, "REDACTED \ndone", result.Output)
+	assert.Zero(t, replayer.Remaining())
+
+	// Nothing left to replay
+	result = backend.psRun(context.Background(), "Write-Output 'REDACTED'")
+	assert.Error(t, result.Error)
+}
+
+func Test_RecorderRereadsSecretsAndAppends(t *testing.T) {
+	fixtures := filepath.Join(t.TempDir(), "session.json")
+	host := funcWinRmClient(func(command string) (int, string) {
+		return 0, ""
+	})
+	// The password is rotated between commands and the ssh user only shows up later
+	secrets := []string{"administrator", "hunter2"}
+	recorder := NewRecorder(fixtures, func() []string { return secrets })
+	backend := newPowerShellBackend(recorder.Wrap(host), nil)
+
+	backend.psRun(context.Background(), "Write-Output 'administrator hunter2'")
+	first, err := os.ReadFile(fixtures)
+	require.NoError(t, err)
+	secrets = []string{"administrator", "hunter22", "csi"}
+	backend.psRun(context.Background(), "Write-Output 'hunter22 hunter2 csi'")
+
+	recorded, err := os.ReadFile(fixtures)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(recorded), strings.TrimSuffix(string(first), "\n]")))
+	var commands []RecordedCommand
+	require.NoError(t, json.Unmarshal(recorded, &commands))
+	require.Len(t, commands, 2)
+	assert.Equal(t, "Write-Output 'REDACTED REDACTED'", commands[0].Command)
+	assert.Equal(t, "Write-Output 'REDACTED REDACTED REDACTED'", commands[1].Command)
+
+	replayer, err := NewReplayer(fixtures)
+	require.NoError(t, err)
+	assert.Equal(t, 2, replayer.Remaining())
+}
+
+func Test_ReplayerUnexpectedCommand(t *testing.T) {
+	replayer, err := NewReplayer(filepath.Join("testdata", "new-vhd-exists.json"))
+	require.NoError(t, err)
+
+	result := newPowerShellBackend(replayer, nil).psRun(context.Background(), "Get-VHD")
+
+	assert.ErrorContains(t, result.Error, "expected recorded command 0")
+	assert.Equal(t, 1, replayer.Remaining())
+}
+
+func Test_ReplayNewVHDExists(t *testing.T) {
+	replayer, err := NewReplayer(filepath.Join("testdata", "new-vhd-exists.json"))
+	require.NoError(t, err)
+	backend := newPowerShellBackend(replayer, nil)
+
+	_, err = backend.CreateVHD(context.Background(), "V:\\Hyper-V\\Virtual Hard Disks\\pv-temp-b0475d14.vhdx", 1024*1024*1024)
+
+	assert.Error(t, err)
+	assert.Zero(t, replayer.Remaining())
+}
+
+func Test_ReplayNewVHDExistsOutput(t *testing.T) {
+	replayer, err := NewReplayer(filepath.Join("testdata", "new-vhd-exists.json"))
+	require.NoError(t, err)
+
+	result := newPowerShellBackend(replayer, nil).psRun(context.Background(), replayer.commands[0].Command)
+
+	assert.Equal(t, 1, result.ExitCode)
+	assert.Contains(t, result.Output, "The file \nexists. (0x80070050).")
+	assert.Contains(t, result.Output, "[New-VHD], VirtualizationException")
+	assert.NotContains(t, result.Output, "_x000D_")
+}
@@ -0,0 +1,191 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"k8s.io/klog/v2"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Idempotent commands are tried this many times in total when they fail for a transient reason
+const retryAttempts = 4
+const retryBaseDelay = 500 * time.Millisecond
+const retryMaxDelay = 10 * time.Second
+
+type idempotentKey struct{}
+
+// idempotent marks the commands run with ctx as safe to run again, only those are retried
+func idempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+func isIdempotent(ctx context.Context) bool {
+	retry, _ := ctx.Value(idempotentKey{}).(bool)
+	return retry
+}
+
+// retryWait sleeps before a retry, doubling from retryBaseDelay with up to 50% jitter. It's a variable so
+// tests don't have to wait out retries.
+var retryWait = func(ctx context.Context, attempt int) error {
+	delay := retryBaseDelay << attempt
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// transientErrorMessages are parts of WinRM errors that don't wrap their cause
+var transientErrorMessages = []string{
+	"connection refused",
+	"connection reset",
+	"i/o timeout",
+	"http error 503",
+	"http response error: 503",
+	// WS-Management quotas, e.g. MaxShellsPerUser
+	"maximum number of concurrent",
+	// The ssh connection broke before the command started, SSHRunner redials
+	"ssh session:",
+}
+
+// transientError reports whether a command failed for a reason that's likely to go away, e.g. the host
+// is rebooting or has run out of shells
+func transientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, transient := range transientErrorMessages {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconnectError reports whether a command failed authentication or TLS verification. The client is
+// rebuilt after these since the credentials or CA certificate may have changed.
+func reconnectError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var certificateInvalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var recordHeader tls.RecordHeaderError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &certificateInvalid) || errors.As(err, &hostname) || errors.As(err, &recordHeader) {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "http error 401") || strings.Contains(message, "http response error: 401") || strings.Contains(message, "x509: ") ||
+		strings.Contains(message, "ssh: unable to authenticate")
+}
+
+// ResilientRunner runs commands through a client from connect. Idempotent commands that fail for a transient
+// reason are retried with backoff, and the client is rebuilt after an authentication or TLS failure.
+type ResilientRunner struct {
+	connect func() (RemotePowerShellRunner, error)
+	lock    sync.Mutex
+	client  RemotePowerShellRunner
+}
+
+// NewResilientRunner returns a runner using a client from connect, connect is called again whenever the
+// client needs rebuilding
+func NewResilientRunner(connect func() (RemotePowerShellRunner, error)) (*ResilientRunner, error) {
+	client, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	return &ResilientRunner{connect: connect, client: client}, nil
+}
+
+func (r *ResilientRunner) runner() (RemotePowerShellRunner, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.client == nil {
+		client, err := r.connect()
+		if err != nil {
+			return nil, err
+		}
+		r.client = client
+	}
+	return r.client, nil
+}
+
+// Reconnect replaces the client with a new one from connect. Commands already running finish on the old client.
+func (r *ResilientRunner) Reconnect() error {
+	client, err := r.connect()
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.client = client
+	return nil
+}
+
+// reset makes the next command build a new client, unless another command already replaced client
+func (r *ResilientRunner) reset(client RemotePowerShellRunner) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.client == client {
+		r.client = nil
+	}
+}
+
+// RunWithContext runs a command, retrying it if ctx is idempotent. Output is held back until the last attempt
+// so a failed attempt's partial output doesn't end up in front of the next attempt's.
+func (r *ResilientRunner) RunWithContext(ctx context.Context, command string, stdout io.Writer, stderr io.Writer) (int, error) {
+	retry := isIdempotent(ctx)
+	for attempt := 0; ; attempt++ {
+		// winrm copies stdout and stderr concurrently so they can't share a buffer
+		var attemptStdout, attemptStderr bytes.Buffer
+		exit, err := r.runOnce(ctx, command, &attemptStdout, &attemptStderr)
+
+		reconnect := reconnectError(err)
+		if !retry || !(reconnect || transientError(err)) || attempt+1 >= retryAttempts || ctx.Err() != nil {
+			if _, copyErr := io.Copy(stdout, &attemptStdout); copyErr != nil && err == nil {
+				err = copyErr
+			}
+			if _, copyErr := io.Copy(stderr, &attemptStderr); copyErr != nil && err == nil {
+				err = copyErr
+			}
+			return exit, err
+		}
+		klog.FromContext(ctx).Info("retrying powershell command", "attempt", attempt+1, "reconnect", reconnect, "err", err)
+		if retryWait(ctx, attempt) != nil {
+			return exit, err
+		}
+	}
+}
+
+func (r *ResilientRunner) runOnce(ctx context.Context, command string, stdout io.Writer, stderr io.Writer) (int, error) {
+	client, err := r.runner()
+	if err != nil {
+		return -1, err
+	}
+	exit, err := client.RunWithContext(ctx, command, stdout, stderr)
+	if reconnectError(err) {
+		klog.FromContext(ctx).Info("rebuilding winrm client", "err", err)
+		r.reset(client)
+	}
+	return exit, err
+}
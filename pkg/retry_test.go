@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// scriptedAttempt is what one run of a scriptedRunner returns
+type scriptedAttempt struct {
+	stdout string
+	exit   int
+	err    error
+}
+
+// scriptedRunner returns its attempts in order, repeating the last one
+type scriptedRunner struct {
+	attempts []scriptedAttempt
+	runs     int
+}
+
+func (r *scriptedRunner) RunWithContext(ctx context.Context, command string, stdout, stderr io.Writer) (int, error) {
+	attempt := r.attempts[len(r.attempts)-1]
+	if r.runs < len(r.attempts) {
+		attempt = r.attempts[r.runs]
+	}
+	r.runs++
+	stdout.Write([]byte(attempt.stdout))
+	return attempt.exit, attempt.err
+}
+
+// noRetryWait skips retry delays and counts the retries
+func noRetryWait(t *testing.T) *int {
+	waits := 0
+	previous := retryWait
+	retryWait = func(ctx context.Context, attempt int) error {
+		waits++
+		return nil
+	}
+	t.Cleanup(func() { retryWait = previous })
+	return &waits
+}
+
+func newTestResilientRunner(t *testing.T, clients ...*scriptedRunner) (*ResilientRunner, *int) {
+	connects := 0
+	runner, err := NewResilientRunner(func() (RemotePowerShellRunner, error) {
+		client := clients[connects]
+		connects++
+		return client, nil
+	})
+	require.NoError(t, err)
+	return runner, &connects
+}
+
+func Test_transientError(t *testing.T) {
+	assert.True(t, transientError(fmt.Errorf("unknown error %w", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED})))
+	assert.True(t, transientError(errors.New("http error 503: ")))
+	assert.True(t, transientError(errors.New("http response error: 503 - invalid content type")))
+	assert.True(t, transientError(errors.New("This user has exceeded the maximum number of concurrent shells allowed for this plugin")))
+	assert.True(t, transientError(fmt.Errorf("ssh session: %w", io.EOF)))
+	assert.False(t, transientError(errors.New("http response error: 401 - invalid content type")))
+	assert.False(t, transientError(context.DeadlineExceeded))
+	assert.False(t, transientError(nil))
+
+	assert.True(t, reconnectError(errors.New("http response error: 401 - invalid content type")))
+	assert.True(t, reconnectError(fmt.Errorf("unknown error %w", errors.New("tls: failed to verify certificate: x509: certificate signed by unknown authority"))))
+	assert.True(t, reconnectError(errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain")))
+	assert.False(t, reconnectError(errors.New("http error 503: ")))
+}
+
+func Test_ResilientRunnerRetriesIdempotent(t *testing.T) {
+	waits := noRetryWait(t)
+	client := &scriptedRunner{attempts: []scriptedAttempt{
+		{stdout: "partial", exit: -1, err: errors.New("http error 503: ")},
+		{exit: -1, err: syscall.ECONNREFUSED},
+		{stdout: "ok"},
+	}}
+	runner, _ := newTestResilientRunner(t, client)
+
+	var output syncBuffer
+	exit, err := runner.RunWithContext(idempotent(context.Background()), "Get-VHD", &output, &output)
+
+	require.NoError(t, err)
+	assert.Zero(t, exit)
+	assert.Equal(t, "ok", output.String())
+	assert.Equal(t, 3, client.runs)
+	assert.Equal(t, 2, *waits)
+}
+
+func Test_ResilientRunnerGivesUp(t *testing.T) {
+	noRetryWait(t)
+	client := &scriptedRunner{attempts: []scriptedAttempt{{stdout: "unavailable", exit: -1, err: errors.New("http error 503: ")}}}
+	runner, _ := newTestResilientRunner(t, client)
+
+	var output syncBuffer
+	_, err := runner.RunWithContext(idempotent(context.Background()), "Get-VHD", &output, &output)
+
+	assert.ErrorContains(t, err, "503")
+	assert.Equal(t, retryAttempts, client.runs)
+	assert.Equal(t, "unavailable", output.String())
+}
+
+func Test_ResilientRunnerDoesntRetryWrites(t *testing.T) {
+	waits := noRetryWait(t)
+	client := &scriptedRunner{attempts: []scriptedAttempt{{exit: -1, err: errors.New("http error 503: ")}, {}}}
+	runner, _ := newTestResilientRunner(t, client)
+
+	_, err := runner.RunWithContext(context.Background(), "New-VHD", io.Discard, io.Discard)
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, client.runs)
+	assert.Zero(t, *waits)
+}
+
+func Test_ResilientRunnerReconnects(t *testing.T) {
+	noRetryWait(t)
+	expired := &scriptedRunner{attempts: []scriptedAttempt{{exit: -1, err: errors.New("http response error: 401 - invalid content type")}}}
+	renewed := &scriptedRunner{attempts: []scriptedAttempt{{stdout: "ok"}}}
+	runner, connects := newTestResilientRunner(t, expired, renewed)
+
+	// Writes aren't retried but the next command gets a new client
+	_, err := runner.RunWithContext(context.Background(), "New-VHD", io.Discard, io.Discard)
+	assert.ErrorContains(t, err, "401")
+	var output syncBuffer
+	_, err = runner.RunWithContext(context.Background(), "New-VHD", &output, &output)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, *connects)
+	assert.Equal(t, 1, expired.runs)
+	assert.Equal(t, "ok", output.String())
+}
+
+func Test_GetVHDRetried(t *testing.T) {
+	noRetryWait(t)
+	client := &scriptedRunner{attempts: []scriptedAttempt{
+		{exit: -1, err: errors.New("http error 503: ")},
+		{stdout: `[{"Path": "V:\\pv-1.vhdx", "DiskIdentifier": "1", "Size": 1}]`},
+	}}
+	runner, _ := newTestResilientRunner(t, client)
+	backend := newPowerShellBackend(runner, nil)
+
+	vhds, err := backend.GetVHD(context.Background(), "V:\\pv-1")
+
+	require.NoError(t, err)
+	assert.Len(t, vhds, 1)
+	assert.Equal(t, 2, client.runs)
+}
+
+// blockingRunner holds every command until release is closed
+type blockingRunner struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingRunner) RunWithContext(ctx context.Context, command string, stdout, stderr io.Writer) (int, error) {
+	close(r.started)
+	<-r.release
+	stdout.Write([]byte("old"))
+	return 0, nil
+}
+
+func Test_ResilientRunnerReconnectKeepsInFlight(t *testing.T) {
+	old := &blockingRunner{started: make(chan struct{}), release: make(chan struct{})}
+	renewed := &scriptedRunner{attempts: []scriptedAttempt{{stdout: "new"}}}
+	clients := []RemotePowerShellRunner{old, renewed}
+	runner, err := NewResilientRunner(func() (RemotePowerShellRunner, error) {
+		client := clients[0]
+		clients = clients[1:]
+		return client, nil
+	})
+	require.NoError(t, err)
+
+	var inFlight syncBuffer
+	done := make(chan error)
+	go func() {
+		_, err := runner.RunWithContext(context.Background(), "Get-VHD", &inFlight, &inFlight)
+		done <- err
+	}()
+	<-old.started
+
+	require.NoError(t, runner.Reconnect())
+	var output syncBuffer
+	_, err = runner.RunWithContext(context.Background(), "Get-VHD", &output, &output)
+	require.NoError(t, err)
+	assert.Equal(t, "new", output.String())
+
+	close(old.release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, "old", inFlight.String())
+}
@@ -0,0 +1,684 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Hyper-V VMs have 4 SCSI controllers with 64 locations each but volumes only use controller 0
+const simulatorScsiLocations = 64
+const simulatorDefaultFreeSpace = 1024 * 1024 * 1024 * 1024
+
+type simulatedFile struct {
+	path     string
+	vhd      *VHD
+	readOnly bool
+	// streams holds the file's contents under "" and any alternate data streams under their name
+	streams map[string]string
+}
+
+type simulatedDrive struct {
+	path string
+	qos  *volumeQoS
+}
+
+type simulatedVM struct {
+	name   string
+	drives []*simulatedDrive
+}
+
+// SimulatedHyperv is an in-memory HypervBackend for tests. It keeps track of VHDX files, their differencing
+// chains and which VM SCSI locations they're attached to. Paths and VM names are case-insensitive like on Windows.
+type SimulatedHyperv struct {
+	lock      sync.Mutex
+	files     map[string]*simulatedFile
+	vms       map[string]*simulatedVM
+	freeSpace map[string]int64
+	cluster   ClusterInfo
+	failures  map[string][]error
+	calls     map[string]int
+}
+
+func NewSimulatedHyperv() *SimulatedHyperv {
+	return &SimulatedHyperv{
+		files:     map[string]*simulatedFile{},
+		vms:       map[string]*simulatedVM{},
+		freeSpace: map[string]int64{},
+		failures:  map[string][]error{},
+		calls:     map[string]int{},
+	}
+}
+
+// AddVM creates a VM with an empty SCSI controller
+func (h *SimulatedHyperv) AddVM(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.vms[strings.ToLower(name)] = &simulatedVM{name: name}
+}
+
+// RemoveVM deletes a VM, its disks stay behind
+func (h *SimulatedHyperv) RemoveVM(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.vms, strings.ToLower(name))
+}
+
+// SetFreeSpace sets the bytes FreeSpace reports for directory, directories default to 1TiB
+func (h *SimulatedHyperv) SetFreeSpace(directory string, bytes int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.freeSpace[strings.ToLower(directory)] = bytes
+}
+
+// SetCluster makes the simulator report being part of a failover cluster
+func (h *SimulatedHyperv) SetCluster(cluster ClusterInfo) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.cluster = cluster
+}
+
+// FailNext makes the next call to operation (a HypervBackend method name) return err. Calling it
+// several times queues failures for consecutive calls.
+func (h *SimulatedHyperv) FailNext(operation string, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.failures[operation] = append(h.failures[operation], err)
+}
+
+// Calls returns how many times operation was called
+func (h *SimulatedHyperv) Calls(operation string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.calls[operation]
+}
+
+// Attachments returns the paths of the disks attached to a VM
+func (h *SimulatedHyperv) Attachments(vmName string) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	paths := make([]string, 0)
+	if vm, ok := h.vms[strings.ToLower(vmName)]; ok {
+		for _, drive := range vm.drives {
+			paths = append(paths, drive.path)
+		}
+	}
+	return paths
+}
+
+// DiskQoS returns the QoS of the drive attaching path to a VM, or nil
+func (h *SimulatedHyperv) DiskQoS(vmName string, path string) *volumeQoS {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if vm, ok := h.vms[strings.ToLower(vmName)]; ok {
+		for _, drive := range vm.drives {
+			if strings.EqualFold(drive.path, path) {
+				return drive.qos
+			}
+		}
+	}
+	return nil
+}
+
+// IsReadOnly reports whether a file exists and is read-only
+func (h *SimulatedHyperv) IsReadOnly(path string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	file, ok := h.files[strings.ToLower(path)]
+	return ok && file.readOnly
+}
+
+// begin locks the simulator and returns any failure injected for operation
+func (h *SimulatedHyperv) begin(operation string) error {
+	h.lock.Lock()
+	h.calls[operation]++
+	if failures := h.failures[operation]; len(failures) > 0 {
+		h.failures[operation] = failures[1:]
+		return failures[0]
+	}
+	return nil
+}
+
+// matching returns the files whose path starts with pathPrefix, sorted by path
+func (h *SimulatedHyperv) matching(pathPrefix string) []*simulatedFile {
+	files := make([]*simulatedFile, 0)
+	for key, file := range h.files {
+		if strings.HasPrefix(key, strings.ToLower(pathPrefix)) {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files
+}
+
+// existing returns the files at paths that exist
+func (h *SimulatedHyperv) existing(paths []string) []*simulatedFile {
+	files := make([]*simulatedFile, 0, len(paths))
+	for _, path := range paths {
+		if file, ok := h.files[strings.ToLower(path)]; ok {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// attachedTo returns the VM a file is attached to, if any
+func (h *SimulatedHyperv) attachedTo(path string) *simulatedVM {
+	for _, vm := range h.vms {
+		for _, drive := range vm.drives {
+			if strings.EqualFold(drive.path, path) {
+				return vm
+			}
+		}
+	}
+	return nil
+}
+
+func (h *SimulatedHyperv) vm(name string) (*simulatedVM, error) {
+	vm, ok := h.vms[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrVMNotFound
+	}
+	return vm, nil
+}
+
+func (h *SimulatedHyperv) newVHD(path string, parentPath string, size int64) (VHD, error) {
+	if _, ok := h.files[strings.ToLower(path)]; ok {
+		return VHD{}, fmt.Errorf("the file %s exists", path)
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return VHD{}, err
+	}
+	vhd := &VHD{Path: path, ParentPath: parentPath, DiskIdentifier: id.String(), Size: size}
+	h.files[strings.ToLower(path)] = &simulatedFile{path: path, vhd: vhd, streams: map[string]string{}}
+	return *vhd, nil
+}
+
+func fileName(path string) string {
+	return path[strings.LastIndex(path, "\\")+1:]
+}
+
+func (h *SimulatedHyperv) ListDisks(ctx context.Context, directories []string, prefix string) ([]string, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("ListDisks"); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, directory := range directories {
+		for _, file := range h.matching(directory + "\\" + prefix) {
+			name := fileName(file.path)
+			if len(file.path) == len(directory)+1+len(name) && strings.HasSuffix(strings.ToLower(name), ".vhdx") {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+func (h *SimulatedHyperv) GetVHD(ctx context.Context, pathPrefix string) ([]VHD, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("GetVHD"); err != nil {
+		return nil, err
+	}
+
+	vhds := make([]VHD, 0)
+	for _, file := range h.matching(pathPrefix) {
+		if file.vhd != nil {
+			vhds = append(vhds, *file.vhd)
+		}
+	}
+	if len(vhds) == 0 {
+		return nil, ErrVHDNotFound
+	}
+	return vhds, nil
+}
+
+func (h *SimulatedHyperv) CreateVHD(ctx context.Context, path string, sizeBytes int64) (VHD, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("CreateVHD"); err != nil {
+		return VHD{}, err
+	}
+	if sizeBytes <= 0 {
+		return VHD{}, errors.New("invalid vhd size")
+	}
+	return h.newVHD(path, "", sizeBytes)
+}
+
+func (h *SimulatedHyperv) CreateDifferencingVHD(ctx context.Context, path string, parentPath string) (VHD, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("CreateDifferencingVHD"); err != nil {
+		return VHD{}, err
+	}
+
+	if existing, ok := h.files[strings.ToLower(path)]; ok && existing.vhd != nil {
+		return *existing.vhd, nil
+	}
+	parent, ok := h.files[strings.ToLower(parentPath)]
+	if !ok || parent.vhd == nil {
+		return VHD{}, ErrVHDNotFound
+	}
+	return h.newVHD(path, parent.path, parent.vhd.Size)
+}
+
+func (h *SimulatedHyperv) ResizeVHD(ctx context.Context, path string, sizeBytes int64) (VHD, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("ResizeVHD"); err != nil {
+		return VHD{}, err
+	}
+
+	file, ok := h.files[strings.ToLower(path)]
+	if !ok || file.vhd == nil {
+		return VHD{}, ErrVHDNotFound
+	}
+	if sizeBytes < file.vhd.Size {
+		return VHD{}, errors.New("the size can't be smaller than the current size")
+	}
+	file.vhd.Size = sizeBytes
+	return *file.vhd, nil
+}
+
+func (h *SimulatedHyperv) SetReadOnly(ctx context.Context, path string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("SetReadOnly"); err != nil {
+		return err
+	}
+
+	file, ok := h.files[strings.ToLower(path)]
+	if !ok {
+		return fmt.Errorf("cannot find path %s", path)
+	}
+	file.readOnly = true
+	return nil
+}
+
+func (h *SimulatedHyperv) MoveFile(ctx context.Context, path string, newPath string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("MoveFile"); err != nil {
+		return err
+	}
+
+	file, ok := h.files[strings.ToLower(path)]
+	if !ok {
+		return fmt.Errorf("cannot find path %s", path)
+	}
+	if _, ok := h.files[strings.ToLower(newPath)]; ok {
+		return fmt.Errorf("the file %s exists", newPath)
+	}
+	if h.attachedTo(path) != nil {
+		return ErrDiskInUse
+	}
+
+	delete(h.files, strings.ToLower(path))
+	file.path = newPath
+	if file.vhd != nil {
+		file.vhd.Path = newPath
+	}
+	h.files[strings.ToLower(newPath)] = file
+	return nil
+}
+
+func (h *SimulatedHyperv) DeleteFiles(ctx context.Context, paths []string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("DeleteFiles"); err != nil {
+		return err
+	}
+
+	files := h.existing(paths)
+	for _, file := range files {
+		if h.attachedTo(file.path) != nil {
+			return ErrDiskInUse
+		}
+	}
+	for _, file := range files {
+		delete(h.files, strings.ToLower(file.path))
+	}
+	return nil
+}
+
+func (h *SimulatedHyperv) DeleteFile(ctx context.Context, path string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("DeleteFile"); err != nil {
+		return err
+	}
+
+	if h.attachedTo(path) != nil {
+		return ErrDiskInUse
+	}
+	delete(h.files, strings.ToLower(path))
+	return nil
+}
+
+func (h *SimulatedHyperv) ReadFile(ctx context.Context, path string, stream string) (string, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("ReadFile"); err != nil {
+		return "", err
+	}
+
+	if file, ok := h.files[strings.ToLower(path)]; ok {
+		return file.streams[stream], nil
+	}
+	return "", nil
+}
+
+func (h *SimulatedHyperv) WriteFile(ctx context.Context, path string, stream string, content string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("WriteFile"); err != nil {
+		return err
+	}
+
+	file, ok := h.files[strings.ToLower(path)]
+	if !ok {
+		if stream != "" {
+			return fmt.Errorf("cannot find path %s", path)
+		}
+		file = &simulatedFile{path: path, streams: map[string]string{}}
+		h.files[strings.ToLower(path)] = file
+	}
+	file.streams[stream] = content
+	return nil
+}
+
+func (h *SimulatedHyperv) ReadStreams(ctx context.Context, directories []string, prefix string, stream string) (map[string]string, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("ReadStreams"); err != nil {
+		return nil, err
+	}
+
+	streams := map[string]string{}
+	for _, directory := range directories {
+		for _, file := range h.matching(directory + "\\" + prefix) {
+			name := fileName(file.path)
+			content, ok := file.streams[stream]
+			if ok && len(file.path) == len(directory)+1+len(name) && strings.HasSuffix(strings.ToLower(name), ".vhdx") {
+				streams[name] = content
+			}
+		}
+	}
+	return streams, nil
+}
+
+// copyFile copies a file into directory keeping its name, differencing disks are re-pointed at a parent in directory
+func (h *SimulatedHyperv) copyFile(file *simulatedFile, directory string) *simulatedFile {
+	path := directory + "\\" + fileName(file.path)
+	copied := &simulatedFile{path: path, readOnly: file.readOnly, streams: map[string]string{}}
+	for stream, content := range file.streams {
+		copied.streams[stream] = content
+	}
+	if file.vhd != nil {
+		vhd := *file.vhd
+		vhd.Path = path
+		if vhd.ParentPath != "" {
+			vhd.ParentPath = directory + "\\" + fileName(vhd.ParentPath)
+		}
+		copied.vhd = &vhd
+	}
+	h.files[strings.ToLower(path)] = copied
+	return copied
+}
+
+func (h *SimulatedHyperv) CopyVHDs(ctx context.Context, pathPrefix string, directory string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("CopyVHDs"); err != nil {
+		return err
+	}
+
+	for _, file := range h.matching(pathPrefix) {
+		h.copyFile(file, directory)
+	}
+	return nil
+}
+
+func (h *SimulatedHyperv) MoveVHDs(ctx context.Context, paths []string, directory string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("MoveVHDs"); err != nil {
+		return err
+	}
+
+	files := h.existing(paths)
+	for _, file := range files {
+		if h.attachedTo(file.path) != nil {
+			return ErrDiskInUse
+		}
+	}
+	for _, file := range files {
+		h.copyFile(file, directory)
+		delete(h.files, strings.ToLower(file.path))
+	}
+	return nil
+}
+
+func (h *SimulatedHyperv) MoveAttachedVHDs(ctx context.Context, vmName string, pathPrefix string, directory string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("MoveAttachedVHDs"); err != nil {
+		return err
+	}
+
+	vm, err := h.vm(vmName)
+	if err != nil {
+		return err
+	}
+	for _, file := range h.matching(pathPrefix) {
+		copied := h.copyFile(file, directory)
+		delete(h.files, strings.ToLower(file.path))
+		for _, drive := range vm.drives {
+			if strings.EqualFold(drive.path, file.path) {
+				drive.path = copied.path
+			}
+		}
+	}
+	return nil
+}
+
+func (h *SimulatedHyperv) AttachDisk(ctx context.Context, vmName string, path string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("AttachDisk"); err != nil {
+		return err
+	}
+
+	vm, err := h.vm(vmName)
+	if err != nil {
+		return err
+	}
+	file, ok := h.files[strings.ToLower(path)]
+	if !ok || file.vhd == nil {
+		return ErrVHDNotFound
+	}
+	if owner := h.attachedTo(path); owner != nil {
+		if owner == vm {
+			return nil
+		}
+		return ErrDiskInUse
+	}
+	if len(vm.drives) >= simulatorScsiLocations {
+		return ErrNoFreeSlot
+	}
+	vm.drives = append(vm.drives, &simulatedDrive{path: file.path})
+	return nil
+}
+
+func (h *SimulatedHyperv) DetachDisk(ctx context.Context, vmName string, pattern string) error {
+	defer h.lock.Unlock()
+	if err := h.begin("DetachDisk"); err != nil {
+		return err
+	}
+
+	vm, err := h.vm(vmName)
+	if err != nil {
+		return err
+	}
+	drives := make([]*simulatedDrive, 0, len(vm.drives))
+	for _, drive := range vm.drives {
+		if !strings.Contains(strings.ToLower(drive.path), strings.ToLower(pattern)) {
+			drives = append(drives, drive)
+		}
+	}
+	vm.drives = drives
+	return nil
+}
+
+func (h *SimulatedHyperv) ListAttachments(ctx context.Context, pattern string) ([]DiskAttachment, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("ListAttachments"); err != nil {
+		return nil, err
+	}
+
+	attachments := make([]DiskAttachment, 0)
+	for _, vm := range h.vms {
+		for _, drive := range vm.drives {
+			if strings.Contains(strings.ToLower(drive.path), strings.ToLower(pattern)) {
+				attachments = append(attachments, DiskAttachment{VMName: vm.name, Path: drive.path})
+			}
+		}
+	}
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].VMName < attachments[j].VMName })
+	return attachments, nil
+}
+
+func (h *SimulatedHyperv) SetDiskQoS(ctx context.Context, vmName string, pattern string, qos *volumeQoS) error {
+	defer h.lock.Unlock()
+	if err := h.begin("SetDiskQoS"); err != nil {
+		return err
+	}
+
+	vms := make([]*simulatedVM, 0)
+	if vmName == "" {
+		for _, vm := range h.vms {
+			vms = append(vms, vm)
+		}
+	} else {
+		vm, err := h.vm(vmName)
+		if err != nil {
+			return err
+		}
+		vms = append(vms, vm)
+	}
+
+	for _, vm := range vms {
+		for _, drive := range vm.drives {
+			if strings.Contains(strings.ToLower(drive.path), strings.ToLower(pattern)) {
+				driveQoS := *qos
+				drive.qos = &driveQoS
+			}
+		}
+	}
+	return nil
+}
+
+func (h *SimulatedHyperv) FreeSpace(ctx context.Context, directory string) (int64, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("FreeSpace"); err != nil {
+		return 0, err
+	}
+
+	if free, ok := h.freeSpace[strings.ToLower(directory)]; ok {
+		return free, nil
+	}
+	return simulatorDefaultFreeSpace, nil
+}
+
+func (h *SimulatedHyperv) ClusterInfo(ctx context.Context) (ClusterInfo, error) {
+	defer h.lock.Unlock()
+	if err := h.begin("ClusterInfo"); err != nil {
+		return ClusterInfo{}, err
+	}
+
+	if h.cluster.Name == "" {
+		return ClusterInfo{}, errors.New("the cluster service is not running")
+	}
+	return h.cluster, nil
+}
+
+func (h *SimulatedHyperv) Ping(ctx context.Context) error {
+	defer h.lock.Unlock()
+	return h.begin("Ping")
+}
+
+func (h *SimulatedHyperv) CheckHyperV(ctx context.Context) error {
+	defer h.lock.Unlock()
+	return h.begin("CheckHyperV")
+}
+
+func (h *SimulatedHyperv) CheckDirectory(ctx context.Context, directory string) error {
+	defer h.lock.Unlock()
+	return h.begin("CheckDirectory")
+}
+
+// SimulatedMounter is an in-memory Mounter for tests. It keeps track of filesystems and mounts, partitions
+// are created as empty files next to the device so they show up in a fake device tree.
+type SimulatedMounter struct {
+	lock        sync.Mutex
+	filesystems map[string]string
+	mounts      map[string]string
+}
+
+func NewSimulatedMounter() *SimulatedMounter {
+	return &SimulatedMounter{filesystems: map[string]string{}, mounts: map[string]string{}}
+}
+
+func (m *SimulatedMounter) Partition(ctx context.Context, device string, fsType string) error {
+	return os.WriteFile(device+"-part1", nil, 0600)
+}
+
+func (m *SimulatedMounter) GrowPartition(ctx context.Context, device string) error {
+	return nil
+}
+
+func (m *SimulatedMounter) FilesystemType(ctx context.Context, device string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.filesystems[device], nil
+}
+
+func (m *SimulatedMounter) Format(ctx context.Context, device string, fsType string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.filesystems[device] = fsType
+	return nil
+}
+
+func (m *SimulatedMounter) GrowFilesystem(ctx context.Context, device string, fsType string, mountPoint string) error {
+	return nil
+}
+
+func (m *SimulatedMounter) Mount(ctx context.Context, device string, target string, options []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.mounts[target] = device
+	return nil
+}
+
+func (m *SimulatedMounter) Unmount(ctx context.Context, target string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.mounts, target)
+	return nil
+}
+
+func (m *SimulatedMounter) IsMounted(ctx context.Context, target string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.mounts[target]
+	return ok, nil
+}
+
+func (m *SimulatedMounter) DeviceMounted(ctx context.Context, device string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, mounted := range m.mounts {
+		if mounted == device {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *SimulatedMounter) CheckTools(ctx context.Context, fsTypes []string) error {
+	return nil
+}
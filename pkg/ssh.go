@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"k8s.io/klog/v2"
+	"net"
+	"strings"
+	"sync"
+)
+
+// sshPowerShell replaces psCommand's powershell.exe, errors and output both come back as CLIXML
+const sshPowerShell = "powershell -NoProfile -NonInteractive -OutputFormat xml "
+
+// SSHRunner runs commands on a host's OpenSSH server, an alternative to WinRM. Every command gets its own
+// session on one shared connection, which is redialed when it breaks.
+type SSHRunner struct {
+	address string
+	config  *ssh.ClientConfig
+
+	lock   sync.Mutex
+	client *ssh.Client
+}
+
+// NewSSHRunner returns a runner for the SSH server at address, host:port. config must verify the host key.
+func NewSSHRunner(address string, config *ssh.ClientConfig) *SSHRunner {
+	return &SSHRunner{address: address, config: config}
+}
+
+func (r *SSHRunner) connection(ctx context.Context) (*ssh.Client, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.client != nil {
+		return r.client, nil
+	}
+
+	conn, err := (&net.Dialer{Timeout: r.config.Timeout}).DialContext(ctx, "tcp", r.address)
+	if err != nil {
+		return nil, fmt.Errorf("ssh dial %s: %w", r.address, err)
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, r.address, r.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r.client = ssh.NewClient(sshConn, channels, requests)
+	return r.client, nil
+}
+
+// drop closes client unless it's already been replaced
+func (r *SSHRunner) drop(client *ssh.Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.client == client {
+		r.client = nil
+	}
+	client.Close()
+}
+
+// Close closes the connection, the next command dials a new one
+func (r *SSHRunner) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.client == nil {
+		return nil
+	}
+	err := r.client.Close()
+	r.client = nil
+	return err
+}
+
+// RunWithContext runs command, PowerShell commands from psCommand run with XML output which is decoded before
+// it's written to stdout and stderr
+func (r *SSHRunner) RunWithContext(ctx context.Context, command string, stdout io.Writer, stderr io.Writer) (int, error) {
+	client, err := r.connection(ctx)
+	if err != nil {
+		return -1, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		// The connection is broken, the next command redials
+		r.drop(client)
+		return -1, fmt.Errorf("ssh session: %w", err)
+	}
+	defer session.Close()
+
+	var sessionStdout, sessionStderr bytes.Buffer
+	session.Stdout, session.Stderr = &sessionStdout, &sessionStderr
+	if script, found := strings.CutPrefix(command, "powershell.exe -NoProfile "); found {
+		command = sshPowerShell + script
+	}
+	done := make(chan error, 1)
+	go func() { done <- session.Run(command) }()
+
+	select {
+	case <-ctx.Done():
+		if err := session.Signal(ssh.SIGKILL); err != nil {
+			klog.FromContext(ctx).V(4).Info("couldn't signal ssh command", "err", err)
+		}
+		session.Close()
+		return -1, ctx.Err()
+	case err = <-done:
+	}
+
+	exit := 0
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		exit, err = exitErr.ExitStatus(), nil
+	} else if err != nil {
+		// e.g. the connection closed before the command exited
+		r.drop(client)
+		return -1, fmt.Errorf("ssh command: %w", err)
+	}
+	if _, err = io.WriteString(stdout, parseCliXml(sessionStdout.String())); err != nil {
+		return exit, err
+	}
+	_, err = io.WriteString(stderr, parseCliXml(sessionStderr.String()))
+	return exit, err
+}
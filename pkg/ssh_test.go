@@ -0,0 +1,232 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sshHandler scripts the host, ctx is cancelled when the client signals the command
+type sshHandler func(ctx context.Context, command string) (exit int, stdout string, stderr string)
+
+// sshServer is an in-process OpenSSH stand-in that takes one user and key and runs exec requests with handler
+type sshServer struct {
+	address string
+	hostKey ssh.PublicKey
+	client  ssh.Signer
+
+	lock     sync.Mutex
+	conns    []net.Conn
+	commands []string
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+func newSSHServer(t *testing.T, user string, handler sshHandler) *sshServer {
+	hostSigner := newTestSigner(t)
+	server := &sshServer{hostKey: hostSigner.PublicKey(), client: newTestSigner(t)}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == user && string(key.Marshal()) == string(server.client.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	server.address = listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.lock.Lock()
+			server.conns = append(server.conns, conn)
+			server.lock.Unlock()
+			go server.serve(conn, config, handler)
+		}
+	}()
+	return server
+}
+
+func (s *sshServer) serve(conn net.Conn, config *ssh.ServerConfig, handler sshHandler) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(channel, channelRequests, handler)
+	}
+}
+
+func (s *sshServer) session(channel ssh.Channel, requests <-chan *ssh.Request, handler sshHandler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for request := range requests {
+		switch request.Type {
+		case "exec":
+			command := string(request.Payload[4 : 4+binary.BigEndian.Uint32(request.Payload)])
+			s.lock.Lock()
+			s.commands = append(s.commands, command)
+			s.lock.Unlock()
+			request.Reply(true, nil)
+			go func() {
+				exit, stdout, stderr := handler(ctx, command)
+				io.WriteString(channel, stdout)
+				io.WriteString(channel.Stderr(), stderr)
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(exit)}))
+				channel.Close()
+			}()
+		case "signal":
+			cancel()
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+// Commands returns every command line the server was asked to run
+func (s *sshServer) Commands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// CloseConnections drops every client connection
+func (s *sshServer) CloseConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *sshServer) runner(user string, hostKey ssh.PublicKey) *SSHRunner {
+	return NewSSHRunner(s.address, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(s.client)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         5 * time.Second,
+	})
+}
+
+func Test_SSHRunner(t *testing.T) {
+	server := newSSHServer(t, "csi", func(ctx context.Context, command string) (int, string, string) {
+		return 0, "#< CLIXML\r\n<Objs Version=\"1.1.0.1\" xmlns=\"http://schemas.microsoft.com/powershell/2004/04\"><S>[{\"Path\": \"V:\\\\pv-1.vhdx\", \"DiskIdentifier\": \"1\", \"Size\": 1}]</S></Objs>", ""
+	})
+	backend := newPowerShellBackend(server.runner("csi", server.hostKey), nil)
+
+	vhds, err := backend.GetVHD(context.Background(), "V:\\pv-1")
+
+	require.NoError(t, err)
+	require.Len(t, vhds, 1)
+	assert.Equal(t, "V:\\pv-1.vhdx", vhds[0].Path)
+	require.Len(t, server.Commands(), 1)
+	assert.True(t, strings.HasPrefix(server.Commands()[0], "powershell -NoProfile -NonInteractive -OutputFormat xml -EncodedCommand "), server.Commands()[0])
+}
+
+func Test_SSHRunnerNumber(t *testing.T) {
+	// Get-Volume's SizeRemaining is a UInt64, -OutputFormat xml sends it as <U64> rather than a string
+	server := newSSHServer(t, "csi", func(ctx context.Context, command string) (int, string, string) {
+		return 0, "#< CLIXML\r\n<Objs Version=\"1.1.0.1\" xmlns=\"http://schemas.microsoft.com/powershell/2004/04\"><U64>53687091200</U64></Objs>", ""
+	})
+	backend := newPowerShellBackend(server.runner("csi", server.hostKey), nil)
+
+	free, err := backend.FreeSpace(context.Background(), "V:\\Hyper-V")
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(53687091200), free)
+}
+
+func Test_SSHRunnerError(t *testing.T) {
+	server := newSSHServer(t, "csi", func(ctx context.Context, command string) (int, string, string) {
+		return 1, "", "#< CLIXML\r\n<Objs Version=\"1.1.0.1\" xmlns=\"http://schemas.microsoft.com/powershell/2004/04\"><S S=\"Error\">New-VHD : Failed to create the virtual hard disk._x000D__x000A_</S></Objs>"
+	})
+	backend := newPowerShellBackend(server.runner("csi", server.hostKey), nil)
+
+	result := backend.psRun(context.Background(), "New-VHD")
+
+	assert.Equal(t, 1, result.ExitCode)
+	assert.NoError(t, result.Error)
+	assert.Equal(t, "New-VHD : Failed to create the virtual hard disk.", result.Output)
+}
+
+func Test_SSHRunnerHostKeyPinned(t *testing.T) {
+	server := newSSHServer(t, "csi", func(ctx context.Context, command string) (int, string, string) {
+		return 0, "ok", ""
+	})
+
+	_, err := server.runner("csi", newTestSigner(t).PublicKey()).RunWithContext(context.Background(), "echo ok", io.Discard, io.Discard)
+	assert.ErrorContains(t, err, "host key mismatch")
+
+	_, err = server.runner("someone", server.hostKey).RunWithContext(context.Background(), "echo ok", io.Discard, io.Discard)
+	assert.ErrorContains(t, err, "unable to authenticate")
+	assert.True(t, reconnectError(err))
+	assert.Empty(t, server.Commands())
+}
+
+func Test_SSHRunnerCancel(t *testing.T) {
+	server := newSSHServer(t, "csi", func(ctx context.Context, command string) (int, string, string) {
+		<-ctx.Done()
+		return 1, "", ""
+	})
+	runner := server.runner("csi", server.hostKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := runner.RunWithContext(ctx, "Start-Sleep 60", io.Discard, io.Discard)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func Test_SSHRunnerRedials(t *testing.T) {
+	server := newSSHServer(t, "csi", func(ctx context.Context, command string) (int, string, string) {
+		return 0, "ok", ""
+	})
+	runner := server.runner("csi", server.hostKey)
+	var output syncBuffer
+	_, err := runner.RunWithContext(context.Background(), "echo ok", &output, &output)
+	require.NoError(t, err)
+
+	server.CloseConnections()
+	// The broken connection fails at most one command, which is safe to retry
+	_, err = runner.RunWithContext(context.Background(), "echo ok", io.Discard, io.Discard)
+	if err != nil {
+		assert.True(t, transientError(err), err.Error())
+	}
+	_, err = runner.RunWithContext(context.Background(), "echo ok", &output, &output)
+	require.NoError(t, err)
+	assert.Equal(t, "okok", output.String())
+}
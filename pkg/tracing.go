@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"context"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const tracerName = "github.com/nijave/hyperv-csi"
+
+// Span attributes
+const (
+	attributeVolumeId          = attribute.Key("csi.volume_id")
+	attributeNodeId            = attribute.Key("csi.node_id")
+	attributePowerShellCmdlets = attribute.Key("powershell.cmdlets")
+	attributePowerShellExit    = attribute.Key("powershell.exit_code")
+)
+
+// The sidecars send W3C trace context
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracer is looked up on every use so it follows whatever provider SetupTracing, or a test, installs
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// SetupTracing exports spans over OTLP when OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// is set, the exporter reads the rest of its configuration from the standard OTEL_* variables. Otherwise
+// spans aren't recorded. The returned func flushes spans that haven't been exported yet.
+func SetupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(tracePropagator)
+	noop := func(context.Context) error { return nil }
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return noop, nil
+	}
+	if os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return noop, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return noop, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	traceResource, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "hyperv-csi"), attribute.String("service.version", driverVersion)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return noop, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(traceResource))
+	otel.SetTracerProvider(provider)
+	klog.InfoS("exporting traces over otlp")
+	return provider.Shutdown, nil
+}
+
+// TracingInterceptor starts a span for every RPC, continuing the caller's trace, and tags it with the
+// volume and node the RPC is for
+func TracingInterceptor() grpc.UnaryServerInterceptor {
+	interceptor := otelgrpc.UnaryServerInterceptor(
+		otelgrpc.WithTracerProvider(otel.GetTracerProvider()),
+		otelgrpc.WithPropagators(tracePropagator),
+	)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			span := trace.SpanFromContext(ctx)
+			if request, ok := req.(interface{ GetVolumeId() string }); ok && request.GetVolumeId() != "" {
+				span.SetAttributes(attributeVolumeId.String(request.GetVolumeId()))
+			}
+			if request, ok := req.(interface{ GetNodeId() string }); ok && request.GetNodeId() != "" {
+				span.SetAttributes(attributeNodeId.String(request.GetNodeId()))
+			}
+			return handler(ctx, req)
+		})
+	}
+}
+
+var cmdletPattern = regexp.MustCompile(`\b[A-Z][A-Za-z]+-[A-Z][A-Za-z]+\b`)
+
+// psQuotedPattern matches strings quoted by psQuote
+var psQuotedPattern = regexp.MustCompile(`'(?:[^']|'')*'`)
+
+// psCmdlets returns the cmdlets a script runs, in order, without their arguments which can hold secrets
+func psCmdlets(cmd string) []string {
+	seen := map[string]bool{}
+	cmdlets := make([]string, 0)
+	for _, cmdlet := range cmdletPattern.FindAllString(psQuotedPattern.ReplaceAllString(cmd, "''"), -1) {
+		if !seen[cmdlet] {
+			seen[cmdlet] = true
+			cmdlets = append(cmdlets, cmdlet)
+		}
+	}
+	return cmdlets
+}
+
+// startPowerShellSpan starts a span for a command, call the returned func with the command's result
+func startPowerShellSpan(ctx context.Context, cmd string) (context.Context, func(exitCode int, err error)) {
+	cmdlets := psCmdlets(cmd)
+	name := "powershell"
+	if len(cmdlets) > 0 {
+		name += " " + strings.Join(cmdlets, " | ")
+	}
+	ctx, span := tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributePowerShellCmdlets.StringSlice(cmdlets)))
+	return ctx, func(exitCode int, err error) {
+		span.SetAttributes(attributePowerShellExit.Int(exitCode))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if exitCode != 0 {
+			span.SetStatus(codes.Error, "non-zero exit code")
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"testing"
+)
+
+// recordSpans installs a tracer provider that keeps every span in memory for the rest of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func Test_psCmdlets(t *testing.T) {
+	assert.Equal(t, []string{"ConvertTo-Json", "Get-VHD"}, psCmdlets("ConvertTo-Json @(Get-VHD ('V:\\pv-*') -ErrorAction SilentlyContinue | Select Path, Size)"))
+	assert.Equal(t, []string{"Get-VM", "Add-VMHardDiskDrive"}, psCmdlets("Get-VM -Name 'kube01' | Add-VMHardDiskDrive -Path 'V:\\pv-1.vhdx'; Get-VM"))
+	assert.Equal(t, []string{"Remove-Item"}, psCmdlets("Remove-Item -LiteralPath 'V:\\Hyper-V\\Get-Secret''s.vhdx'"))
+	assert.Empty(t, psCmdlets("echo ok"))
+}
+
+func Test_TracingInterceptor(t *testing.T) {
+	spans := recordSpans(t)
+	backend := newPowerShellBackend(mockWinRmClient{ReturnCode: 1}, nil)
+	// The sidecar's span
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	request := &csi.ControllerPublishVolumeRequest{VolumeId: "volume", NodeId: "kube01"}
+
+	_, err := TracingInterceptor()(ctx, request, info, func(ctx context.Context, req any) (any, error) {
+		result := backend.psRun(ctx, "Get-VM -Name 'kube01' | Add-VMHardDiskDrive -Path 'V:\\secret.vhdx'")
+		return nil, result.err()
+	})
+	require.Error(t, err)
+
+	ended := spans.Ended()
+	require.Len(t, ended, 2)
+	psSpan, rpcSpan := ended[0], ended[1]
+
+	assert.Equal(t, "csi.v1.Controller/ControllerPublishVolume", rpcSpan.Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", rpcSpan.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", rpcSpan.Parent().SpanID().String())
+	assert.Equal(t, "volume", spanAttributes(rpcSpan)[attributeVolumeId].AsString())
+	assert.Equal(t, "kube01", spanAttributes(rpcSpan)[attributeNodeId].AsString())
+
+	assert.Equal(t, "powershell Get-VM | Add-VMHardDiskDrive", psSpan.Name())
+	assert.Equal(t, rpcSpan.SpanContext().SpanID(), psSpan.Parent().SpanID())
+	assert.Equal(t, []string{"Get-VM", "Add-VMHardDiskDrive"}, spanAttributes(psSpan)[attributePowerShellCmdlets].AsStringSlice())
+	assert.Equal(t, int64(1), spanAttributes(psSpan)[attributePowerShellExit].AsInt64())
+	assert.Equal(t, otelcodes.Error, psSpan.Status().Code)
+	for _, kv := range psSpan.Attributes() {
+		assert.NotContains(t, kv.Value.Emit(), "secret")
+	}
+}
+
+func Test_SetupTracingDefaultsToNoop(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	previous := otel.GetTracerProvider()
+
+	shutdown, err := SetupTracing(context.Background())
+
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Equal(t, previous, otel.GetTracerProvider())
+}
@@ -0,0 +1,268 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"sort"
+	"strings"
+	"time"
+)
+
+// With SoftDelete, DeleteVolume moves a volume's files into a trash directory in its pool instead of removing
+// them. The deletion time and pool are added to the volume's metadata so it can be restored under its ID, and
+// it's purged once TrashRetention has passed.
+
+// trashDirectoryName follows the volume prefix, e.g. pv-trash, so clusters sharing a directory keep separate trash
+const trashDirectoryName = "trash"
+
+// trashPurgeInterval is how often PurgeTrashLoop looks for expired volumes
+const trashPurgeInterval = time.Hour
+
+// trashClock is a variable so tests can move time forward
+var trashClock = time.Now
+
+// TrashedVolume is a soft deleted volume
+type TrashedVolume struct {
+	VolumeId     string    `json:"volumeId"`
+	Pool         string    `json:"pool"`
+	DeletedAt    time.Time `json:"deletedAt"`
+	PVCName      string    `json:"pvcName,omitempty"`
+	PVCNamespace string    `json:"pvcNamespace,omitempty"`
+	PVName       string    `json:"pvName,omitempty"`
+
+	// directory is the pool directory the volume was deleted from
+	directory string
+}
+
+func (s *HypervCsiController) trashDirectory(directory string) string {
+	return directory + "\\" + s.volumePrefix() + trashDirectoryName
+}
+
+// volumeFiles returns the paths of a volume's base disk and every differencing disk made from it: Hyper-V's
+// checkpoints, pv-<id>_<GUID>.avhdx, and the read-only children, pv-<id>.node-<node>.vhdx. Following
+// ParentPath leaves out other files that only share the volume ID's prefix.
+func (s *HypervCsiController) volumeFiles(ctx context.Context, directory string, volumeId string) ([]string, error) {
+	vhds, err := s.backend().GetVHD(ctx, s.volumeFilePath(directory, volumeId, false))
+	if err != nil && !errors.Is(err, ErrVHDNotFound) {
+		return nil, err
+	}
+
+	// Parents come first so moving the files in order never leaves a child without its parent
+	base := strings.ToLower(s.volumeFilePath(directory, volumeId, true))
+	files := make([]string, 0, len(vhds))
+	included := map[string]bool{}
+	for added := true; added; {
+		added = false
+		for _, vhd := range vhds {
+			path := strings.ToLower(vhd.Path)
+			if included[path] || path != base && !included[strings.ToLower(vhd.ParentPath)] {
+				continue
+			}
+			included[path] = true
+			files = append(files, vhd.Path)
+			added = true
+		}
+	}
+	return files, nil
+}
+
+// trashVolume moves a volume into its pool's trash directory
+func (s *HypervCsiController) trashVolume(ctx context.Context, volumeId string) error {
+	exists, err := s.volumeExists(ctx, volumeId)
+	if err != nil || !exists {
+		return err
+	}
+	pool, err := s.volumePool(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+	directory, err := s.poolDirectory(pool)
+	if err != nil {
+		return err
+	}
+	metadata, err := s.getVolumeMetadata(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+
+	// The metadata is written first so a failed move leaves the volume where it was
+	deletedAt := trashClock().UTC()
+	metadata.DeletedAt = &deletedAt
+	metadata.Pool = pool
+	if err = s.writeVolumeMetadata(ctx, s.volumeFilePath(directory, volumeId, true), metadata); err != nil {
+		return err
+	}
+	klog.InfoS("moving volume to trash", "volumeId", volumeId, "pool", pool)
+	files, err := s.volumeFiles(ctx, directory, volumeId)
+	if err != nil {
+		return err
+	}
+	return s.backend().MoveVHDs(ctx, files, s.trashDirectory(directory))
+}
+
+// ListTrash returns this cluster's soft deleted volumes, oldest first
+func (s *HypervCsiController) ListTrash(ctx context.Context) ([]TrashedVolume, error) {
+	trashed := make([]TrashedVolume, 0)
+	for _, directory := range s.poolDirectories() {
+		streams, err := s.backend().ReadStreams(ctx, []string{s.trashDirectory(directory)}, s.volumePrefix(), volumeMetadataStream)
+		if err != nil {
+			return nil, err
+		}
+		for volumeFile, output := range streams {
+			volumeId := strings.TrimPrefix(strings.TrimSuffix(volumeFile, ".vhdx"), s.volumePrefix())
+			metadata, err := parseVolumeMetadata(output)
+			if err != nil || metadata.DeletedAt == nil {
+				klog.ErrorS(err, "skipping trashed volume with unreadable metadata", "file", volumeFile, "output", output)
+				continue
+			}
+			if !s.ownsVolume(metadata) || strings.Contains(volumeId, readOnlyChildInfix) {
+				continue
+			}
+			trashed = append(trashed, TrashedVolume{
+				VolumeId:     volumeId,
+				Pool:         metadata.Pool,
+				DeletedAt:    *metadata.DeletedAt,
+				PVCName:      metadata.PVCName,
+				PVCNamespace: metadata.PVCNamespace,
+				PVName:       metadata.PVName,
+				directory:    directory,
+			})
+		}
+	}
+	sort.Slice(trashed, func(i, j int) bool {
+		return trashed[i].DeletedAt.Before(trashed[j].DeletedAt)
+	})
+	return trashed, nil
+}
+
+// trashedVolume finds a soft deleted volume
+func (s *HypervCsiController) trashedVolume(ctx context.Context, volumeId string) (*TrashedVolume, error) {
+	trashed, err := s.ListTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range trashed {
+		if trashed[i].VolumeId == volumeId {
+			return &trashed[i], nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "volume %s isn't in the trash", volumeId)
+}
+
+// RestoreVolume moves a soft deleted volume back to the pool it was deleted from under its original ID
+func (s *HypervCsiController) RestoreVolume(ctx context.Context, volumeId string) error {
+	unlock, err := s.volumeLocks.acquire(volumeId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	trashed, err := s.trashedVolume(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+	exists, err := s.volumeExists(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return status.Errorf(codes.AlreadyExists, "volume %s already exists", volumeId)
+	}
+	// The pool may have been removed or moved since the volume was deleted
+	directory, err := s.poolDirectory(trashed.Pool)
+	if err != nil {
+		return err
+	}
+	if directory != trashed.directory {
+		return status.Errorf(codes.FailedPrecondition, "pool %s is %s now, volume %s was deleted from %s", trashed.Pool, directory, volumeId, trashed.directory)
+	}
+
+	files, err := s.volumeFiles(ctx, s.trashDirectory(trashed.directory), volumeId)
+	if err != nil {
+		return err
+	}
+	if err = s.backend().MoveVHDs(ctx, files, trashed.directory); err != nil {
+		return err
+	}
+	volumePath := s.volumeFilePath(trashed.directory, volumeId, true)
+	output, err := s.backend().ReadFile(ctx, volumePath, volumeMetadataStream)
+	if err != nil {
+		return err
+	}
+	metadata, err := parseVolumeMetadata(output)
+	if err != nil {
+		return err
+	}
+	metadata.DeletedAt = nil
+	metadata.Pool = ""
+	if err = s.writeVolumeMetadata(ctx, volumePath, metadata); err != nil {
+		return err
+	}
+	if err = s.setVolumePool(ctx, volumeId, trashed.Pool); err != nil {
+		return err
+	}
+	klog.InfoS("restored volume from trash", "volumeId", volumeId, "pool", trashed.Pool)
+	return nil
+}
+
+// PurgeVolume removes a soft deleted volume for good
+func (s *HypervCsiController) PurgeVolume(ctx context.Context, volumeId string) error {
+	unlock, err := s.volumeLocks.acquire(volumeId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	trashed, err := s.trashedVolume(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+	klog.InfoS("purging volume from trash", "volumeId", volumeId, "deletedAt", trashed.DeletedAt)
+	files, err := s.volumeFiles(ctx, s.trashDirectory(trashed.directory), volumeId)
+	if err != nil {
+		return err
+	}
+	return s.backend().DeleteFiles(ctx, files)
+}
+
+// PurgeExpiredTrash purges the volumes deleted more than TrashRetention ago. Without a retention volumes
+// stay in the trash until they're purged by hand.
+func (s *HypervCsiController) PurgeExpiredTrash(ctx context.Context) error {
+	if s.TrashRetention == 0 {
+		return nil
+	}
+	trashed, err := s.ListTrash(ctx)
+	if err != nil {
+		return err
+	}
+	failures := make([]error, 0)
+	for _, volume := range trashed {
+		if trashClock().Sub(volume.DeletedAt) < s.TrashRetention {
+			continue
+		}
+		if err = s.PurgeVolume(ctx, volume.VolumeId); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	return errors.Join(failures...)
+}
+
+// PurgeTrashLoop purges expired volumes every trashPurgeInterval until ctx is done
+func (s *HypervCsiController) PurgeTrashLoop(ctx context.Context) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.PurgeExpiredTrash(ctx); err != nil {
+			klog.ErrorS(err, "couldn't purge expired volumes from trash")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
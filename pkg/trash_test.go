@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func newSoftDeleteController() (*SimulatedHyperv, *HypervCsiController) {
+	hyperv, controller := newSimulatedController()
+	controller.Pools = map[string]string{"ssd": "S:\\Volumes"}
+	controller.SoftDelete = true
+	return hyperv, controller
+}
+
+func Test_SoftDeleteRestore(t *testing.T) {
+	hyperv, controller := newSoftDeleteController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{
+		Parameters: map[string]string{volumeParameterPool: "ssd", parameterPVCName: "data", parameterPVCNamespace: "web"},
+	})
+	volumePath := controller.volumeFilePath("S:\\Volumes", volumeId, true)
+
+	_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+	require.NoError(t, err)
+
+	_, err = hyperv.GetVHD(ctx, volumePath)
+	assert.ErrorIs(t, err, ErrVHDNotFound)
+	_, err = hyperv.GetVHD(ctx, controller.volumeFilePath("S:\\Volumes\\pv-trash", volumeId, true))
+	assert.NoError(t, err)
+	volumes, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, volumes.Entries)
+	trashed, err := controller.ListTrash(ctx)
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+	assert.Equal(t, volumeId, trashed[0].VolumeId)
+	assert.Equal(t, "ssd", trashed[0].Pool)
+	assert.Equal(t, "web", trashed[0].PVCNamespace)
+	assert.Equal(t, "data", trashed[0].PVCName)
+	assert.WithinDuration(t, time.Now(), trashed[0].DeletedAt, time.Minute)
+
+	// Deleting again succeeds
+	_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+	require.NoError(t, err)
+
+	require.NoError(t, controller.RestoreVolume(ctx, volumeId))
+
+	_, err = hyperv.GetVHD(ctx, volumePath)
+	assert.NoError(t, err)
+	pool, err := controller.volumePool(ctx, volumeId)
+	require.NoError(t, err)
+	assert.Equal(t, "ssd", pool)
+	metadata, err := controller.getVolumeMetadata(ctx, volumeId)
+	require.NoError(t, err)
+	assert.Nil(t, metadata.DeletedAt)
+	assert.Equal(t, "data", metadata.PVCName)
+	trashed, err = controller.ListTrash(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+
+	err = controller.RestoreVolume(ctx, volumeId)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_SoftDeletePublished(t *testing.T) {
+	hyperv, controller := newSoftDeleteController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeId, NodeId: "kube01", VolumeCapability: singleNodeWriter[0]})
+	require.NoError(t, err)
+
+	_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Len(t, hyperv.Attachments("kube01"), 1)
+	trashed, err := controller.ListTrash(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+}
+
+func Test_RestoreVolumeExists(t *testing.T) {
+	hyperv, controller := newSoftDeleteController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+	require.NoError(t, err)
+	// e.g. copied back by hand
+	_, err = hyperv.CreateVHD(ctx, controller.volumeFilePath(controller.VolumePath, volumeId, true), 1024)
+	require.NoError(t, err)
+
+	err = controller.RestoreVolume(ctx, volumeId)
+
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func Test_PurgeExpiredTrash(t *testing.T) {
+	hyperv, controller := newSoftDeleteController()
+	controller.TrashRetention = 24 * time.Hour
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	trashClock = func() time.Time { return now }
+	t.Cleanup(func() { trashClock = time.Now })
+	oldVolume := createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-old"})
+	_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: oldVolume})
+	require.NoError(t, err)
+	now = now.Add(12 * time.Hour)
+	newVolume := createTestVolume(t, controller, &csi.CreateVolumeRequest{Name: "pvc-new"})
+	_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: newVolume})
+	require.NoError(t, err)
+
+	now = now.Add(13 * time.Hour)
+	require.NoError(t, controller.PurgeExpiredTrash(ctx))
+
+	trashed, err := controller.ListTrash(ctx)
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+	assert.Equal(t, newVolume, trashed[0].VolumeId)
+	_, err = hyperv.GetVHD(ctx, controller.volumeFilePath(controller.trashDirectory(controller.VolumePath), oldVolume, false))
+	assert.ErrorIs(t, err, ErrVHDNotFound)
+
+	require.NoError(t, controller.PurgeVolume(ctx, newVolume))
+	trashed, err = controller.ListTrash(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+}
+
+func Test_DeleteVolumeSharedPrefix(t *testing.T) {
+	hyperv, controller := newSimulatedController()
+	ctx := context.Background()
+	volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+	// A file that starts with the volume's name but isn't part of it
+	backupPath := controller.volumeFilePath(controller.VolumePath, volumeId+"-backup", true)
+	_, err := hyperv.CreateVHD(ctx, backupPath, 1024)
+	require.NoError(t, err)
+
+	_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+	require.NoError(t, err)
+
+	_, err = hyperv.GetVHD(ctx, controller.volumeFilePath(controller.VolumePath, volumeId, true))
+	assert.ErrorIs(t, err, ErrVHDNotFound)
+	_, err = hyperv.GetVHD(ctx, backupPath)
+	assert.NoError(t, err)
+}
+
+func Test_DeleteVolumeCheckpoints(t *testing.T) {
+	for _, softDelete := range []bool{false, true} {
+		hyperv, controller := newSoftDeleteController()
+		controller.SoftDelete = softDelete
+		ctx := context.Background()
+		volumeId := createTestVolume(t, controller, &csi.CreateVolumeRequest{})
+		// Hyper-V names a checkpoint after the disk and the checkpoint's GUID
+		checkpointFile := controller.volumePrefix() + volumeId + "_8E3C4D2B-7F1A-4E6B-9C0D-5A2F1B3E4D6C.avhdx"
+		_, err := hyperv.CreateDifferencingVHD(ctx, controller.VolumePath+"\\"+checkpointFile, controller.volumeFilePath(controller.VolumePath, volumeId, true))
+		require.NoError(t, err)
+
+		_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+		require.NoError(t, err)
+
+		_, err = hyperv.GetVHD(ctx, controller.VolumePath+"\\"+checkpointFile)
+		assert.ErrorIs(t, err, ErrVHDNotFound, "soft delete %v", softDelete)
+		if !softDelete {
+			continue
+		}
+		trashDirectory := controller.trashDirectory(controller.VolumePath)
+		checkpoint, err := hyperv.GetVHD(ctx, trashDirectory+"\\"+checkpointFile)
+		require.NoError(t, err)
+		assert.Equal(t, controller.volumeFilePath(trashDirectory, volumeId, true), checkpoint[0].ParentPath)
+
+		require.NoError(t, controller.RestoreVolume(ctx, volumeId))
+		checkpoint, err = hyperv.GetVHD(ctx, controller.VolumePath+"\\"+checkpointFile)
+		require.NoError(t, err)
+		assert.Equal(t, controller.volumeFilePath(controller.VolumePath, volumeId, true), checkpoint[0].ParentPath)
+
+		_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+		require.NoError(t, err)
+		require.NoError(t, controller.PurgeVolume(ctx, volumeId))
+		_, err = hyperv.GetVHD(ctx, trashDirectory+"\\"+controller.volumePrefix()+volumeId)
+		assert.ErrorIs(t, err, ErrVHDNotFound)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"github.com/kubernetes-csi/csi-test/v5/pkg/sanity"
+	"github.com/nijave/hyperv-csi/pkg"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSanity runs the kubernetes-csi sanity suite against the real gRPC servers with a simulated Hyper-V host and node
+
+const sanityNodeId = "kube01"
+
+// deviceTreeHyperv makes attached disks show up in a fake /dev the way Hyper-V SCSI disks do on a Linux guest
+type deviceTreeHyperv struct {
+	*pkg.SimulatedHyperv
+	devicePath string
+}
+
+func (h *deviceTreeHyperv) AttachDisk(ctx context.Context, vmName string, path string) error {
+	if err := h.SimulatedHyperv.AttachDisk(ctx, vmName, path); err != nil {
+		return err
+	}
+	vhds, err := h.GetVHD(ctx, path)
+	if err != nil {
+		return err
+	}
+	identifier := vhds[0].DiskIdentifier
+	device := filepath.Join(h.devicePath, "disk", "by-id", "wwn-0x60022480"+identifier[strings.LastIndex(identifier, "-")+1:])
+	return os.WriteFile(device, nil, 0600)
+}
+
+// serve starts a gRPC server with the production interceptors on a unix socket in directory and returns its address
+func serve(t *testing.T, directory string, name string, register func(*grpc.Server)) string {
+	socket := filepath.Join(directory, name+".sock")
+	listen, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	grpcServer := newGRPCServer()
+	register(grpcServer)
+	go grpcServer.Serve(listen)
+	t.Cleanup(grpcServer.Stop)
+	return "unix://" + socket
+}
+
+func TestSanity(t *testing.T) {
+	// Unix socket paths are limited to ~100 characters so this doesn't use t.TempDir
+	directory, err := os.MkdirTemp("", "hyperv-csi-")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(directory) })
+	devicePath := filepath.Join(directory, "dev")
+	require.NoError(t, os.MkdirAll(filepath.Join(devicePath, "disk", "by-id"), 0700))
+
+	hyperv := pkg.NewSimulatedHyperv()
+	hyperv.AddVM(sanityNodeId)
+	controller := &pkg.HypervCsiController{
+		VolumePath: "V:\\Hyper-V\\Virtual Hard Disks",
+		Backend:    &deviceTreeHyperv{SimulatedHyperv: hyperv, devicePath: devicePath},
+	}
+	driver := &pkg.HypervCsiDriver{NodeId: sanityNodeId, DevicePath: devicePath, Mounter: pkg.NewSimulatedMounter()}
+
+	config := sanity.NewTestConfig()
+	config.ControllerAddress = serve(t, directory, "controller", func(grpcServer *grpc.Server) { initController(grpcServer, controller) })
+	config.Address = serve(t, directory, "node", func(grpcServer *grpc.Server) { initDriver(grpcServer, driver) })
+	config.TargetPath = filepath.Join(directory, "target")
+	config.StagingPath = filepath.Join(directory, "staging")
+	config.TestVolumeSize = 1024 * 1024 * 1024
+	sanity.Test(t, config)
+}
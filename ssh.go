@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nijave/hyperv-csi/pkg"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// newSSHClient returns a runner for an ssh:// WINRM_HOST. It logs in as the URL's user, or WINRM_USER, with the
+// private key in WINRM_SSH_KEY_FILE and only trusts the host keys in WINRM_SSH_KNOWN_HOSTS.
+func newSSHClient(host *url.URL) (*pkg.SSHRunner, error) {
+	user := host.User.Username()
+	if user == "" {
+		var err error
+		if user, err = envOrFile("WINRM_USER"); err != nil {
+			return nil, err
+		}
+	}
+
+	keyFile := os.Getenv("WINRM_SSH_KEY_FILE")
+	if keyFile == "" {
+		return nil, errors.New("ssh needs a private key in WINRM_SSH_KEY_FILE")
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read WINRM_SSH_KEY_FILE: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse WINRM_SSH_KEY_FILE: %w", err)
+	}
+
+	knownHostsFile := os.Getenv("WINRM_SSH_KNOWN_HOSTS")
+	if knownHostsFile == "" {
+		return nil, errors.New("ssh needs the host's keys in WINRM_SSH_KNOWN_HOSTS")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read WINRM_SSH_KNOWN_HOSTS: %w", err)
+	}
+
+	port := host.Port()
+	if port == "" {
+		port = "22"
+	}
+	return pkg.NewSSHRunner(net.JoinHostPort(host.Hostname(), port), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout(driverSettings.Timeouts.Operation, 30*time.Second),
+	}), nil
+}
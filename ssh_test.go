@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/nijave/hyperv-csi/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSSHFiles writes a client key and a known_hosts file for host and sets the variables pointing at them
+func writeSSHFiles(t *testing.T, host string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+	hostKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostPublicKey, err := ssh.NewPublicKey(hostKey)
+	require.NoError(t, err)
+
+	directory := t.TempDir()
+	keyFile, knownHostsFile := filepath.Join(directory, "id_ed25519"), filepath.Join(directory, "known_hosts")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+	require.NoError(t, os.WriteFile(knownHostsFile, []byte(knownhosts.Line([]string{host}, hostPublicKey)+"\n"), 0600))
+	t.Setenv("WINRM_SSH_KEY_FILE", keyFile)
+	t.Setenv("WINRM_SSH_KNOWN_HOSTS", knownHostsFile)
+}
+
+func TestNewRemoteClientSSH(t *testing.T) {
+	writeSSHFiles(t, "hyperv01")
+
+	client, err := newRemoteClient("ssh://csi@hyperv01", nil)
+
+	require.NoError(t, err)
+	assert.IsType(t, &pkg.SSHRunner{}, client)
+}
+
+func TestNewRemoteClientSSHConfig(t *testing.T) {
+	t.Setenv("WINRM_SSH_KEY_FILE", "")
+	_, err := newRemoteClient("ssh://csi@hyperv01", nil)
+	assert.ErrorContains(t, err, "WINRM_SSH_KEY_FILE")
+
+	writeSSHFiles(t, "hyperv01")
+	t.Setenv("WINRM_SSH_KNOWN_HOSTS", "")
+	_, err = newRemoteClient("ssh://csi@hyperv01", nil)
+	assert.ErrorContains(t, err, "WINRM_SSH_KNOWN_HOSTS")
+
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0600))
+	t.Setenv("WINRM_SSH_KEY_FILE", keyFile)
+	_, err = newRemoteClient("ssh://csi@hyperv01", nil)
+	assert.ErrorContains(t, err, "couldn't parse WINRM_SSH_KEY_FILE")
+}